@@ -1,28 +1,49 @@
 // A straightforward but efficient way to block (or authorize) DNS domains.
-// TODO: add ip filtering
 // TODO: add auto-reload of blocklists
 
 package main
 
 import (
+	"io"
 	"log"
 	"net"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"github.com/quic-go/quic-go"
 )
 
 func main() {
-	// this will sync our go routines
-	var wg sync.WaitGroup
-
 	// get command line arguments
-	conf := readCliArgs()
-	defer conf.logFileHAndle.Close()
+	command, conf, args := readCliArgs(os.Args[1:])
+
+	switch command {
+	case CMD_CHECK:
+		os.Exit(checkDomain(os.Stdout, conf, args))
+	case CMD_VALIDATE:
+		os.Exit(validateConfig(os.Stdout, conf))
+	case CMD_QUERY:
+		os.Exit(queryPipeline(os.Stdout, conf, args))
+	case CMD_COMPILE:
+		os.Exit(compileLists(os.Stdout, conf, args))
+	}
+	serve(conf)
+}
 
+// Answer DNS queries until a termination signal is received
+func serve(conf *Config) {
 	if conf.debug {
 		log.Printf("%v", conf)
 	}
-	log.Printf("using resolver: %s", conf.resolver)
+	log.Printf("using resolvers: %v", conf.resolvers)
+
+	// sockets might have been opened by systemd
+	sockets, err := listenFDs()
+	if err != nil {
+		log.Fatalf("error: <%v> in sockets passed by systemd", err)
+	}
 
 	// listen to this local address
 	serverAddress := net.UDPAddr{
@@ -30,33 +51,118 @@ func main() {
 		IP:   net.ParseIP("127.0.0.1"),
 	}
 
-	// start udp UDPServer on previously defined address
-	UDPServer, err := net.ListenUDP("udp", &serverAddress)
+	// start udp UDPServer on previously defined address, unless systemd already did it
+	UDPServer, err := sockets.packetConn(SD_NAME_DNS)
 	if err != nil {
-		log.Fatalf("error: <%v> when creating udp server on 127.0.0.1:53", err)
+		log.Fatalf("error: <%v> when creating udp server", err)
+	}
+	udpActivated := UDPServer != nil
+	if UDPServer == nil {
+		UDPServer, err = net.ListenUDP("udp", &serverAddress)
+		if err != nil {
+			log.Fatalf("error: <%v> when creating udp server on 127.0.0.1:53", err)
+		}
 	}
-	defer UDPServer.Close()
-	log.Printf("listening to DNS requests")
+	log.Printf("listening to DNS requests on %v", UDPServer.LocalAddr())
 
-	// launch goroutine to regularly update the blocklists
-	//go updateBlockLists(&conf)
+	// listeners closed on shutdown to stop accepting new connections
+	var listeners []io.Closer
 
-	// handle DNS requests from clients
-	for {
-		// read data from client
-		buf := make([]byte, 1024)
-		nbBytes, clientAddr, err := UDPServer.ReadFrom(buf)
+	// plain TCP listener on the same address, for clients retrying truncated answers. When systemd passed the
+	// UDP socket, it must also pass the TCP one
+	if !udpActivated || sockets.has(SD_NAME_DNS_TCP) {
+		TCPServer, err := listenTCP(UDPServer.LocalAddr().String(), sockets)
+		if err != nil {
+			log.Fatalf("error: <%v> when creating tcp server on %v", err, UDPServer.LocalAddr())
+		}
+		listeners = append(listeners, TCPServer)
+		log.Printf("listening to DNS requests over TCP on %v", TCPServer.Addr())
+
+		go serveTCP(TCPServer, conf)
+	} else {
+		log.Printf("error: no <%s> socket passed by systemd, truncated answers can't be retried over TCP", SD_NAME_DNS_TCP)
+	}
+
+	// start DNS over TLS listener if configured
+	if conf.tlsListener.Address != "" || sockets.has(SD_NAME_DOT) {
+		TLSServer, err := listenTLS(&conf.tlsListener, sockets)
+		if err != nil {
+			log.Fatalf("error: <%v> when creating DoT server on %s", err, conf.tlsListener.Address)
+		}
+		listeners = append(listeners, TLSServer)
+		log.Printf("listening to DoT requests on %v", TLSServer.Addr())
+
+		go serveTLS(TLSServer, conf)
+	}
+
+	// start DNS over HTTPS listener if configured
+	if conf.httpsListener.Address != "" || sockets.has(SD_NAME_DOH) {
+		HTTPSServer, err := listenHTTPS(&conf.httpsListener, sockets)
+		if err != nil {
+			log.Fatalf("error: <%v> when creating DoH server on %s", err, conf.httpsListener.Address)
+		}
+		listeners = append(listeners, HTTPSServer)
+		log.Printf("listening to DoH requests on %v", HTTPSServer.Addr())
+
+		go serveHTTPS(HTTPSServer, conf)
+	}
+
+	// start DNS over QUIC listener if configured. Closing it also closes its connections, so it's only done
+	// once queries are drained
+	var QUICServer *quic.EarlyListener
+	if conf.quicListener.Address != "" || sockets.has(SD_NAME_DOQ) {
+		QUICServer, err = listenQUIC(&conf.quicListener, sockets)
 		if err != nil {
-			log.Printf("error: <%v> reading bytes from address: <%v>\n", nbBytes, clientAddr)
-			continue
+			log.Fatalf("error: <%v> when creating DoQ server on %s", err, conf.quicListener.Address)
 		}
+		log.Printf("listening to DoQ requests on %v", QUICServer.Addr())
+
+		go serveQUIC(QUICServer, conf)
+	}
 
-		// serve request
-		log.Printf("%d bytes received from address: %v\n", nbBytes, clientAddr)
-		go handleDNSRequest(UDPServer, clientAddr, buf[:nbBytes], &conf)
+	sockets.closeUnused()
+
+	// all listeners are bound: root privileges are no longer needed
+	if err := dropPrivileges(&conf.privileges); err != nil {
+		log.Fatalf("error: <%v> when dropping privileges", err)
+	}
+
+	// launch goroutine to regularly update the blocklists
+	//go updateBlockLists(conf)
+
+	// handle DNS requests from clients, using a bounded pool of workers
+	server := newUDPServer(UDPServer, conf)
+	served := make(chan struct{})
+	go func() {
+		server.serve()
+		close(served)
+	}()
+
+	// tell systemd we're ready, and keep its watchdog happy
+	notifyState("READY=1")
+	stopWatchdog := make(chan struct{})
+	if interval := watchdogInterval(); interval != 0 {
+		go watchdog(interval, stopWatchdog)
 	}
 
-	wg.Wait()
+	// reload the configuration on SIGHUP, until a termination signal
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		log.Printf("signal <%v> received, reloading configuration", sig)
+		notifyReloading()
+		if err := conf.readBlocklists(); err != nil {
+			log.Printf("error: %v, keeping the previous configuration", err)
+		}
+		notifyState("READY=1")
+		sig = <-signals
+	}
+	signal.Stop(signals)
+	close(stopWatchdog)
+	log.Printf("signal <%v> received, shutting down", sig)
+
+	os.Exit(shutdown(conf, server, served, listeners, QUICServer))
 }
 
 // Update the blocklist regularly
@@ -66,7 +172,9 @@ func updateBlockLists(conf *Config) {
 		time.Sleep(time.Duration(conf.timeout) * time.Second)
 
 		log.Printf("updating blocklists\n")
-		conf.readBlocklists()
+		if err := conf.readBlocklists(); err != nil {
+			log.Printf("error: %v, keeping the previous configuration", err)
+		}
 	}
 
 }
@@ -6,149 +6,326 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// subcommands
+const (
+	CMD_SERVE    = "serve"    // answer DNS queries, the default
+	CMD_CHECK    = "check"    // tell whether a domain is blocked
+	CMD_VALIDATE = "validate" // load the configuration and lists, and report errors
+	CMD_QUERY    = "query"    // send a query through the whole pipeline, and print the answer
+	CMD_COMPILE  = "compile"  // read the lists and write them to a snapshot
+)
+
 const Usage = `
 NAME
-	goget: this is a grep utility written in Go. Project repository: https://github.com/dandyvica/gogrep
-	Files matching the regex (see regexp Go syntax: https://golang.org/pkg/regexp/syntax) are displayed in
-	addition to matching lines, with different colors.
+	dnswall: a DNS forwarder blocking domains matching regexes. Project repository: https://github.com/dandyvica/dnswall
 
 USAGE
-	goget [OPTIONS...] PATTERN [FILE...]
+	dnswall [serve] [OPTIONS...]
+	dnswall check [OPTIONS...] DOMAIN [TYPE]
+	dnswall validate [OPTIONS...]
+	dnswall query [OPTIONS...] NAME [TYPE]
+	dnswall compile [OPTIONS...] [FILE]
+
+COMMANDS
+	serve
+		answer DNS queries, until SIGINT or SIGTERM is received. This is the default command
+
+	check DOMAIN [TYPE]
+		tell whether a query for the domain (type A by default) is answered from local records, blocked or
+		rewritten, and by which list and rule
+
+	validate
+		load the configuration file and every list, and report errors without starting any listener
+
+	query NAME [TYPE]
+		send a query (type A by default) through the whole pipeline, as if it was received by a listener,
+		and print the answer
+
+	compile [FILE]
+		read every list, and write the rules in use to a snapshot file (default: the snapshot of the
+		configuration file). dnswall loads it at startup instead of the lists, as long as they don't change
 
 OPTIONS
-	-u, -url
-		base url
+	-c FILE
+		configuration file name and path (default: dnswall.yml)
 
-	-b, -bounds
-		bounds expressed as lower..upper
+	-l FILE
+		log file name and path, only used by serve (default: dnswall.log)
 
-	-p, -padding
-		padding value (leading 0's)
+	-r ADDRESS
+		DNS resolver to which unfiltered requests are forwarded, taking precedence over the configuration
+		file (default: 1.1.1.1)
+
+	-n
+		don't filter nor rewrite DNS requests, just log them
+
+	-d
+		debug flag
+
+	-t SECONDS
+		timeout when sending queries to resolver or sending back data to client (default: 300)
 `
 
 // This will hold all options given from the command line
 type Config struct {
-	resolver        string          // DNS resolver to which forward requests
-	resolverAddress string          // Whole resolver address (e.g.: 1.1.1.1:53) for the one
-	timeout         int             // timeout when sending queries to resolver or sending back data to client
-	logFile         string          // log file
-	dontFilter      bool            // do not filter, just log requests
-	yamlConfigFile  string          // configuration file
-	logFileHAndle   *os.File        // pointer on log file
-	debug           bool            // debug flag
-	filters         FilteredDomains // list of either whitelisted domains for which DNS domain will not be blocked and blacklisted ones for which a NXDOMAIN will be sent back
-	mu              sync.Mutex      // used to synchronize access to block lists
+	resolver        string              // DNS resolver to which forward requests
+	resolverAddress string              // Whole resolver address (e.g.: 1.1.1.1:53) for the one
+	timeout         int                 // timeout when sending queries to resolver or sending back data to client
+	logFile         string              // log file
+	dontFilter      bool                // do not filter, just log requests
+	yamlConfigFile  string              // configuration file
+	logFileHAndle   *os.File            // pointer on log file
+	debug           bool                // debug flag
+	blockAction     string              // what is sent back for a blocked domain: nxdomain, refused, nodata or null
+	filters         FilteredDomains     // list of either whitelisted domains for which DNS domain will not be blocked and blacklisted ones for which a NXDOMAIN will be sent back
+	localRecords    LocalRecords        // records for which dnswall is answering by itself
+	resolvers       []Upstream          // default resolvers, tried in order
+	forwarders      Forwarders          // resolvers used for specific domains
+	resolverFromCli bool                // true if the resolver was given on the command line, taking precedence over the YAML file
+	tlsListener     TLSListenerConfig   // settings of the DNS over TLS listener, if any
+	httpsListener   HTTPSListenerConfig // settings of the DNS over HTTPS listener, if any
+	quicListener    QUICListenerConfig  // settings of the DNS over QUIC listener, if any
+	rateLimiter     *RateLimiter        // limits the rate of queries of each client, nil if not configured
+	responseLimiter *ResponseLimiter    // limits the rate of answers sent to UDP clients, nil if not configured
+	workerPool      WorkerPoolConfig    // settings of the UDP server worker pool
+	drainTimeout    int                 // number of seconds queries being processed are given to complete on shutdown
+	inflight        inflightQueries     // queries being processed
+	privileges      PrivilegesConfig    // user, group and chroot switched to once listeners are bound
+	filterSettings  FiltersConfig       // lists as found in the YAML configuration file, to compile them
+	qtypes          QTypePolicy         // query types blocked or filtered whatever the domain
+	mu              sync.RWMutex        // held for reading while a query is processed, and for writing on reload
 }
 
 // This will match the YAML configuration file where all settings are defined
 type YAMLConfig struct {
-	Resolvers []string `yaml:"resolvers"`
-	Timeout   int      `yaml:"update_timeout"`
-	Filters   struct {
-		Whitelist []string `yaml:"whitelist"`
-		Blacklist []string `yaml:"blacklist"`
-	} `yaml:"filters"`
+	Resolvers     []ResolverConfig    `yaml:"resolvers"`
+	Timeout       int                 `yaml:"update_timeout"`
+	Filters       FiltersConfig       `yaml:"filters"`
+	QTypes        QTypesConfig        `yaml:"qtypes"`
+	BlockAction   string              `yaml:"block_action"`
+	LocalRecords  []LocalRecordConfig `yaml:"local_records"`
+	ZoneFiles     []string            `yaml:"zone_files"`
+	Forwarders    []ForwarderConfig   `yaml:"forwarders"`
+	TLSListener   TLSListenerConfig   `yaml:"tls_listener"`
+	HTTPSListener HTTPSListenerConfig `yaml:"https_listener"`
+	QUICListener  QUICListenerConfig  `yaml:"quic_listener"`
+	RateLimit     RateLimitConfig     `yaml:"rate_limit"`
+	RRL           RRLConfig           `yaml:"response_rate_limit"`
+	WorkerPool    WorkerPoolConfig    `yaml:"worker_pool"`
+	DrainTimeout  int                 `yaml:"drain_timeout"`
+	Privileges    PrivilegesConfig    `yaml:",inline"`
 }
 
-// Read command line arguments and read the YAML configuration file
-func readCliArgs() Config {
+// Read command line arguments and read the YAML configuration file. The subcommand is returned, along with
+// its arguments. Only serve logs to the log file, other commands log to the standard error
+func readCliArgs(args []string) (string, *Config, []string) {
 	// init struct
-	var conf Config
+	conf := new(Config)
+
+	// serve is the default command, for options to be given without any
+	command := CMD_SERVE
+	if len(args) != 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case CMD_SERVE, CMD_CHECK, CMD_VALIDATE, CMD_QUERY, CMD_COMPILE:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command <%s>\n", command)
+		fmt.Print(Usage)
+		os.Exit(2)
+	}
 
-	// if set, we want the line number from the file
-	flag.StringVar(&conf.resolver, "r", "1.1.1.1", "DNS resolver to which unfiltered requests are forwarded")
-	flag.StringVar(&conf.logFile, "l", "dnswall.log", "log file name and path")
-	flag.StringVar(&conf.yamlConfigFile, "c", "dnswall.yml", "configuration file name and path")
-	flag.BoolVar(&conf.dontFilter, "n", false, "don't filter DNS requests")
-	flag.BoolVar(&conf.debug, "d", false, "debug flag")
-	flag.IntVar(&conf.timeout, "t", 300, "timeout (in seconds) when sending queries to resolver or sending back data to client")
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.StringVar(&conf.resolver, "r", "1.1.1.1", "DNS resolver to which unfiltered requests are forwarded")
+	flags.StringVar(&conf.logFile, "l", "dnswall.log", "log file name and path")
+	flags.StringVar(&conf.yamlConfigFile, "c", "dnswall.yml", "configuration file name and path")
+	flags.BoolVar(&conf.dontFilter, "n", false, "don't filter DNS requests")
+	flags.BoolVar(&conf.debug, "d", false, "debug flag")
+	flags.IntVar(&conf.timeout, "t", 300, "timeout (in seconds) when sending queries to resolver or sending back data to client")
 
-	flag.Usage = func() {
+	flags.Usage = func() {
 		fmt.Print(Usage)
 	}
 
-	flag.Parse()
+	flags.Parse(args)
 
-	// open or create log file
-	f, err := os.OpenFile(conf.logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("error: <%v> opening file: <%v>", conf.logFile, err)
+	// check the number of arguments of the command
+	nbArgs := len(flags.Args())
+	if (command == CMD_CHECK && (nbArgs < 1 || nbArgs > 2)) || (command == CMD_QUERY && (nbArgs < 1 || nbArgs > 2)) || ((command == CMD_SERVE || command == CMD_VALIDATE) && nbArgs != 0) || (command == CMD_COMPILE && nbArgs > 1) {
+		fmt.Print(Usage)
+		os.Exit(2)
 	}
-	log.SetOutput(f)
 
-	// customize log format to get date for each line of the log
-	log.SetFlags(log.Ldate | log.Lmicroseconds)
+	if command == CMD_SERVE {
+		// customize log format to get date for each line of the log
+		log.SetFlags(log.Ldate | log.Lmicroseconds)
 
-	// save pointer to opened log file to close it gracefully when exiting
-	conf.logFileHAndle = f
+		// open or create log file
+		f, err := os.OpenFile(conf.logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Fatalf("error: <%v> opening file: <%v>", conf.logFile, err)
+		}
+		log.SetOutput(f)
+
+		// save pointer to opened log file to close it gracefully when exiting
+		conf.logFileHAndle = f
+	} else {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(0)
+	}
 
 	// build resolver full address
 	conf.resolverAddress = fmt.Sprintf("%s:53", conf.resolver)
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "r" {
+			conf.resolverFromCli = true
+		}
+	})
 
 	// read YAML config
-	conf.readBlocklists()
-
-	// var yamlConf YAMLConfig
-	// yamlConf.read(conf.yamlConfigFile)
-	// fmt.Printf("config=%+v\n", yamlConf)
-
-	// // now read blocklists
-	// conf.filters.init()
-
-	// for _, list := range yamlConf.Filters.Blacklist {
-	// 	conf.filters.blackList.readFilterFile(list)
-	// }
-	// for _, list := range yamlConf.Filters.Whitelist {
-	// 	conf.filters.whiteList.readFilterFile(list)
-	// }
-
-	// nothing entered: show help
-	// if len(flag.Args()) == 0 {
-	// 	fmt.Print(Usage)
-	// 	os.Exit(0)
-	// }
+	if err := conf.readBlocklists(); err != nil {
+		log.Fatalf("error: %v", err)
+	}
 
-	return conf
+	return command, conf, flags.Args()
 }
 
 // Read the YAML configuration file
-func (yamlConf *YAMLConfig) read(configFile string) *YAMLConfig {
+func (yamlConf *YAMLConfig) read(configFile string) error {
 	yamlFile, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		log.Fatalf("error <%v> opening YAML configuration file: <%s>", err, configFile)
+		return fmt.Errorf("<%v> opening YAML configuration file: <%s>", err, configFile)
 	}
 	err = yaml.Unmarshal(yamlFile, yamlConf)
 	if err != nil {
-		log.Fatalf("error <%v> reading YAML configuration file: <%s>", err, configFile)
+		return fmt.Errorf("<%v> reading YAML configuration file: <%s>", err, configFile)
 	}
-	log.Printf("succesfully read YAML file: <%s>, data: <%+v>\n", configFile, yamlConf)
+	log.Printf("succesfully read YAML file: <%s>", configFile)
 
-	return yamlConf
+	return nil
 }
 
-// Read blocklists and convert them into regexes
-func (conf *Config) readBlocklists() {
-	//defer conf.mu.Unlock()
-
+// Read the configuration file, blocklists and local records. Everything is loaded before replacing the
+// configuration in use, which is left untouched if an error is returned
+func (conf *Config) readBlocklists() error {
 	// read YAML config
 	var yamlConf YAMLConfig
-	yamlConf.read(conf.yamlConfigFile)
-	fmt.Printf("config=%+v\n", yamlConf)
+	if err := yamlConf.read(conf.yamlConfigFile); err != nil {
+		return err
+	}
+	if conf.debug {
+		log.Printf("configuration: <%+v>", yamlConf)
+	}
 
-	// now read blocklists
-	conf.mu.Lock()
-	conf.filters.init()
+	// default is to reply NXDOMAIN for blocked domains
+	blockAction := strings.ToLower(yamlConf.BlockAction)
+	switch blockAction {
+	case "":
+		blockAction = BLOCK_NXDOMAIN
+	case BLOCK_NXDOMAIN, BLOCK_REFUSED, BLOCK_NODATA, BLOCK_NULL:
+	default:
+		return fmt.Errorf("unknown block action <%s> in YAML configuration file: <%s>", yamlConf.BlockAction, conf.yamlConfigFile)
+	}
 
-	for _, list := range yamlConf.Filters.Blacklist {
-		conf.filters.blackList.readFilterFile(list)
+	rateLimiter, err := newRateLimiter(yamlConf.RateLimit)
+	if err != nil {
+		return fmt.Errorf("<%v> in YAML configuration file: <%s>", err, conf.yamlConfigFile)
+	}
+
+	responseLimiter, err := newResponseLimiter(yamlConf.RRL)
+	if err != nil {
+		return fmt.Errorf("<%v> in YAML configuration file: <%s>", err, conf.yamlConfigFile)
+	}
+
+	qtypes, err := newQTypePolicy(yamlConf.QTypes)
+	if err != nil {
+		return fmt.Errorf("<%v> in YAML configuration file: <%s>", err, conf.yamlConfigFile)
 	}
-	for _, list := range yamlConf.Filters.Whitelist {
-		conf.filters.whiteList.readFilterFile(list)
+
+	// local records
+	var localRecords LocalRecords
+	localRecords.init()
+	if err := localRecords.addConfig(yamlConf.LocalRecords); err != nil {
+		return fmt.Errorf("<%v> in YAML configuration file: <%s>", err, conf.yamlConfigFile)
+	}
+	for _, zoneFile := range yamlConf.ZoneFiles {
+		if err := localRecords.readZoneFile(zoneFile); err != nil {
+			return fmt.Errorf("<%v> reading zone file", err)
+		}
+	}
+	localRecords.synthesizePTR()
+
+	// now read blocklists. Invalid lines are skipped, and lists with too many of them are rejected, rather
+	// than stopping dnswall. Rules point to the lists they're coming from, kept in filterSettings
+	filterSettings := yamlConf.Filters
+	var filters FilteredDomains
+	filters.init()
+	filters.load(&filterSettings)
+	for _, report := range filters.reports {
+		report.log()
 	}
+
+	// resolvers from the YAML file are used, unless one is given on the command line
+	resolvers := []ResolverConfig{{Address: conf.resolverAddress}}
+	if len(yamlConf.Resolvers) != 0 && !conf.resolverFromCli {
+		resolvers = yamlConf.Resolvers
+	}
+	upstreams, err := newUpstreams(resolvers)
+	if err != nil {
+		return fmt.Errorf("<%v> in YAML configuration file: <%s>", err, conf.yamlConfigFile)
+	}
+
+	var forwarders Forwarders
+	if err := forwarders.init(yamlConf.Forwarders); err != nil {
+		closeUpstreams(upstreams)
+		return fmt.Errorf("<%v> in YAML configuration file: <%s>", err, conf.yamlConfigFile)
+	}
+
+	// queries being processed hold the read lock: they're answered with the previous configuration, and new
+	// ones wait for the new one
+	conf.mu.Lock()
+	previous := append(conf.forwarders.upstreams(), conf.resolvers...)
+	conf.resolvers = upstreams
+	conf.forwarders = forwarders
+	conf.tlsListener = yamlConf.TLSListener
+	conf.httpsListener = yamlConf.HTTPSListener
+	conf.quicListener = yamlConf.QUICListener
+	// clients keep their counters when the limits don't change, or a reload would be a way to reset them
+	if rateLimiter == nil || conf.rateLimiter == nil || !reflect.DeepEqual(rateLimiter.settings, conf.rateLimiter.settings) {
+		conf.rateLimiter = rateLimiter
+	}
+	if responseLimiter == nil || conf.responseLimiter == nil || !reflect.DeepEqual(responseLimiter.settings, conf.responseLimiter.settings) {
+		conf.responseLimiter = responseLimiter
+	}
+	conf.workerPool = yamlConf.WorkerPool
+	conf.drainTimeout = yamlConf.DrainTimeout
+	conf.privileges = yamlConf.Privileges
+	conf.blockAction = blockAction
+	conf.filterSettings = filterSettings
+	conf.filters = filters
+	conf.qtypes = qtypes
+	conf.localRecords = localRecords
 	conf.mu.Unlock()
+
+	// upstreams replaced on reload are closed once the queries sent to them are answered
+	if len(previous) != 0 {
+		time.AfterFunc(UPSTREAM_TIMEOUT, func() { closeUpstreams(previous) })
+	}
+	return nil
+}
+
+// Release the connections kept open to the resolvers, on shutdown
+func (conf *Config) closeUpstreams() {
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	closeUpstreams(append(conf.forwarders.upstreams(), conf.resolvers...))
 }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Tell whether a query for a domain (type A by default) is answered from local records, blocked or rewritten, and
+// by which list and rule. Checks are done in the order queries go through them. Exit status is 0 in all cases,
+// unless the query type is unknown
+func checkDomain(w io.Writer, conf *Config, args []string) int {
+	domain := strings.ToLower(strings.TrimSuffix(args[0], "."))
+	qtype := TYPE_A
+	if len(args) > 1 {
+		value, found := qTypeValue(args[1])
+		if !found {
+			fmt.Fprintf(w, "error: unknown query type <%s>\n", args[1])
+			return 1
+		}
+		qtype = value
+	}
+
+	// local records are answered first, whatever the filters
+	query := DNSMessage{Questions: []DNSQuestion{{Domain: domain, QType: qtype, QClass: CLASS_IN}}}
+	if conf.localRecords.answer(query.toNetworkBytes()) != nil {
+		fmt.Fprintf(w, "%s is answered from local records\n", domain)
+		return 0
+	}
+
+	if conf.qtypes.isBlocked(qtype) && !conf.dontFilter {
+		fmt.Fprintf(w, "%s is blocked as query type %s is blocked\n", domain, qType(qtype))
+		return 0
+	}
+
+	// rewrite rules only apply to domains which are not blocked
+	filtered := !conf.dontFilter && conf.qtypes.isFiltered(qtype)
+	result := conf.filters.match(domain, qtype)
+	if rule := conf.filters.rewrites.match(domain); rule != nil && !conf.dontFilter && !(filtered && result.Blocked) {
+		fmt.Fprintf(w, "%s is rewritten to %s by %v\n", domain, rule.targets(), rule)
+		return 0
+	}
+
+	if conf.dontFilter {
+		fmt.Fprintf(w, "%s is not blocked as filtering is disabled\n", domain)
+		return 0
+	}
+	if !filtered {
+		fmt.Fprintf(w, "%s is not blocked as query type %s is not filtered\n", domain, qType(qtype))
+		return 0
+	}
+	fmt.Fprintf(w, "%s is %v\n", domain, result)
+	return 0
+}
+
+// Report what was loaded from the configuration file. Errors stop dnswall while loading, so reaching this
+// point means the configuration is valid, unless a list was rejected. Certificates of the listeners are loaded too
+func validateConfig(w io.Writer, conf *Config) int {
+	status := 0
+	for _, listener := range []struct {
+		name     string
+		address  string
+		certFile string
+		keyFile  string
+	}{
+		{"DoT", conf.tlsListener.Address, conf.tlsListener.CertFile, conf.tlsListener.KeyFile},
+		{"DoH", conf.httpsListener.Address, conf.httpsListener.CertFile, conf.httpsListener.KeyFile},
+		{"DoQ", conf.quicListener.Address, conf.quicListener.CertFile, conf.quicListener.KeyFile},
+	} {
+		if listener.address == "" {
+			continue
+		}
+		if _, err := newCertReloader(listener.certFile, listener.keyFile); err != nil {
+			fmt.Fprintf(w, "error: <%v> when loading the certificate of the %s listener\n", err, listener.name)
+			status = 1
+		}
+	}
+
+	if !printReports(w, conf.filters.reports) {
+		status = 1
+	}
+
+	fmt.Fprintf(w, "resolvers: %v\n", conf.resolvers)
+	fmt.Fprintf(w, "forwarding rules: %d\n", len(conf.forwarders.rules))
+	fmt.Fprintf(w, "whitelist rules: %d\n", len(conf.filters.whiteList.exprList))
+	fmt.Fprintf(w, "whitelist domains: %d\n", conf.filters.whiteList.domains.len())
+	fmt.Fprintf(w, "blacklist rules: %d\n", len(conf.filters.blackList.exprList))
+	fmt.Fprintf(w, "blacklist domains: %d\n", conf.filters.blackList.domains.len())
+	fmt.Fprintf(w, "blocked IP ranges: %d\n", len(conf.filters.ipBlackList.netList))
+	fmt.Fprintf(w, "rewrite rules: %d\n", conf.filters.rewrites.len())
+	if status == 0 {
+		fmt.Fprintf(w, "configuration file <%s> is valid\n", conf.yamlConfigFile)
+	}
+	return status
+}
+
+// Print the invalid lines and the summary of each list. Return false if a list was rejected
+func printReports(w io.Writer, reports []*ListReport) bool {
+	ok := true
+	for _, report := range reports {
+		for _, lineErr := range report.Errors {
+			fmt.Fprintf(w, "error: <%s> at line %d of list <%s>\n", lineErr.Reason, lineErr.Line, report.Path)
+		}
+		fmt.Fprintln(w, report)
+		if report.Err != nil {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Read every list, even if they were loaded from an up to date snapshot, and write the rules in use to the
+// snapshot given as argument or in the configuration file. Exit status is 1 if a list was rejected, or if the
+// snapshot can't be written
+func compileLists(w io.Writer, conf *Config, args []string) int {
+	path := conf.filterSettings.Snapshot
+	if len(args) != 0 {
+		path = args[0]
+	}
+	if path == "" {
+		fmt.Fprintln(w, "error: no snapshot file, neither on the command line nor in the configuration file")
+		return 1
+	}
+
+	var filters FilteredDomains
+	filters.init()
+	filters.readLists(&conf.filterSettings)
+
+	status := 0
+	if !printReports(w, filters.reports) {
+		status = 1
+	}
+	if err := filters.writeSnapshot(path, &conf.filterSettings); err != nil {
+		fmt.Fprintf(w, "error: <%v> when writing snapshot <%s>\n", err, path)
+		return 1
+	}
+	fmt.Fprintf(w, "snapshot <%s> written\n", path)
+	return status
+}
+
+// Send a query through the whole pipeline, as if it was received from a local client, and print the answer.
+// Exit status is 1 if no answer was sent back
+func queryPipeline(w io.Writer, conf *Config, args []string) int {
+	typeName := "A"
+	if len(args) > 1 {
+		typeName = strings.ToUpper(args[1])
+	}
+	query, err := jsonQuery(args[0], typeName)
+	if err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+		return 1
+	}
+	id := randomID()
+	query[0], query[1] = byte(id>>8), byte(id)
+
+	writer := new(bufferResponseWriter)
+	handleDNSRequest(writer, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, query, conf)
+	conf.closeUpstreams()
+	if writer.buffer == nil {
+		fmt.Fprintln(w, "no answer")
+		return 1
+	}
+
+	answer := new(DNSMessage)
+	if err := answer.fromNetworkBytes(writer.buffer); err != nil {
+		fmt.Fprintf(w, "error: <%v> when decoding the answer\n", err)
+		return 1
+	}
+	printMessage(w, answer)
+	return 0
+}
+
+// Print a message in a format close to the one of dig
+func printMessage(w io.Writer, msg *DNSMessage) {
+	flags := new(DNSPacketFlags)
+	flags.fromNetworkBytes(msg.Header.Flags)
+
+	names := []string{}
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{{"qr", flags.QR == 1}, {"aa", flags.AA}, {"tc", flags.TC}, {"rd", flags.RD}, {"ra", flags.RA}, {"ad", flags.AD}, {"cd", flags.CD}} {
+		if flag.set {
+			names = append(names, flag.name)
+		}
+	}
+
+	fmt.Fprintf(w, ";; status: %s, id: %d\n", rcodeName(uint16(flags.RCODE)), msg.Header.Id)
+	fmt.Fprintf(w, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(names, " "), len(msg.Questions), len(msg.Answers), len(msg.Authorities), len(msg.Additionals))
+
+	fmt.Fprintf(w, "\n;; QUESTION SECTION:\n")
+	for _, question := range msg.Questions {
+		fmt.Fprintf(w, ";%s.\t\t%s\t%s\n", question.Domain, className(question.QClass), qType(question.QType))
+	}
+
+	for _, section := range []struct {
+		name    string
+		records []DNSResourceRecord
+	}{{"ANSWER", msg.Answers}, {"AUTHORITY", msg.Authorities}, {"ADDITIONAL", msg.Additionals}} {
+		if len(section.records) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n;; %s SECTION:\n", section.name)
+		for i := range section.records {
+			rr := &section.records[i]
+			if rr.Type == TYPE_OPT {
+				fmt.Fprintf(w, ";; OPT PSEUDOSECTION: udp: %d\n", rr.Class)
+				continue
+			}
+			fmt.Fprintf(w, "%s.\t%d\t%s\t%s\t%s\n", rr.Name, rr.TTL, className(rr.Class), qType(rr.Type), rr.data())
+		}
+	}
+}
+
+// Name of a response code
+func rcodeName(rcode uint16) string {
+	switch rcode {
+	case RCODE_NOERROR:
+		return "NOERROR"
+	case 1:
+		return "FORMERR"
+	case RCODE_SERVFAIL:
+		return "SERVFAIL"
+	case RCODE_NXDOMAIN:
+		return "NXDOMAIN"
+	case 4:
+		return "NOTIMP"
+	case RCODE_REFUSED:
+		return "REFUSED"
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// Name of a class, as used in zone files
+func className(class uint16) string {
+	if class == CLASS_IN {
+		return "IN"
+	}
+	return fmt.Sprintf("CLASS%d", class)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCliArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	command, conf, args := readCliArgs([]string{"check", "-c", "dnswall.yml", "-r", "9.9.9.9", "www.foo.com"})
+	assert.Equal(command, CMD_CHECK)
+	assert.Equal(args, []string{"www.foo.com"})
+	assert.Equal(conf.yamlConfigFile, "dnswall.yml")
+	assert.Equal(conf.resolvers[0].String(), "9.9.9.9:53")
+	assert.Nil(conf.logFileHAndle)
+
+	// serve is the default command, and logs to the file
+	logFile := filepath.Join(t.TempDir(), "dnswall.log")
+	command, conf, args = readCliArgs([]string{"-c", "dnswall.yml", "-l", logFile})
+	defer log.SetOutput(os.Stderr)
+	defer conf.logFileHAndle.Close()
+	assert.Equal(command, CMD_SERVE)
+	assert.Equal(len(args), 0)
+	assert.FileExists(logFile)
+}
+
+func TestReadBlocklistsReload(t *testing.T) {
+	assert := assert.New(t)
+
+	configFile := filepath.Join(t.TempDir(), "dnswall.yml")
+	writeConfig := func(blockAction string) {
+		config := fmt.Sprintf("resolvers:\n  - address: %s\nblock_action: %s\nfilters:\n  blacklist:\n    - path: ./tests/blacklist.1\n",
+			startUDPStandIn(t, answerWith("1.2.3.4")), blockAction)
+		if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("nxdomain")
+
+	conf := &Config{yamlConfigFile: configFile}
+	assert.Nil(conf.readBlocklists())
+	defer conf.closeUpstreams()
+
+	// queries processed during reloads are answered with either configuration, never a partial one
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				writer := new(bufferResponseWriter)
+				handleDNSRequest(writer, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, buildQuery("adtracking.foo.com", TYPE_A), conf)
+				assert.Equal(rcode(writer.buffer), byte(RCODE_NXDOMAIN))
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		assert.Nil(conf.readBlocklists())
+	}
+	close(stop)
+	wg.Wait()
+
+	// an invalid configuration is reported, and the previous one is kept
+	writeConfig("foo")
+	assert.NotNil(conf.readBlocklists())
+	assert.Equal(conf.blockAction, BLOCK_NXDOMAIN)
+	assert.True(conf.filters.match("adtracking.foo.com", 0).Blocked)
+
+	conf.yamlConfigFile = filepath.Join(t.TempDir(), "foo.yml")
+	assert.NotNil(conf.readBlocklists())
+	assert.True(conf.filters.match("adtracking.foo.com", 0).Blocked)
+}
+
+func TestReadBlocklistsKeepsLimiters(t *testing.T) {
+	assert := assert.New(t)
+
+	configFile := filepath.Join(t.TempDir(), "dnswall.yml")
+	writeConfig := func(qps int) {
+		config := fmt.Sprintf("resolvers:\n  - address: %s\nrate_limit:\n  qps: %d\nresponse_rate_limit:\n  responses_per_second: %d\n",
+			startUDPStandIn(t, answerWith("1.2.3.4")), qps, qps)
+		if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(5)
+
+	conf := &Config{yamlConfigFile: configFile}
+	assert.Nil(conf.readBlocklists())
+	defer conf.closeUpstreams()
+	rateLimiter, responseLimiter := conf.rateLimiter, conf.responseLimiter
+	assert.NotNil(rateLimiter)
+	assert.NotNil(responseLimiter)
+
+	// counters of clients survive a reload with the same limits
+	assert.Nil(conf.readBlocklists())
+	assert.True(conf.rateLimiter == rateLimiter)
+	assert.True(conf.responseLimiter == responseLimiter)
+
+	// and are reset when the limits change
+	writeConfig(10)
+	assert.Nil(conf.readBlocklists())
+	assert.False(conf.rateLimiter == rateLimiter)
+	assert.False(conf.responseLimiter == responseLimiter)
+	assert.Equal(conf.rateLimiter.settings.QPS, float64(10))
+
+	writeConfig(0)
+	assert.Nil(conf.readBlocklists())
+	assert.Nil(conf.rateLimiter)
+	assert.Nil(conf.responseLimiter)
+}
+
+func TestCheckDomain(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := newTestConfig(t)
+	conf.filters.whiteList.readFilterFile("./tests/whitelist.1")
+
+	var output bytes.Buffer
+	checkDomain(&output, conf, []string{"Adtracking.foo.com."})
+	assert.Equal(output.String(), "adtracking.foo.com is blocked by rule <^adtrack(er|ing)?[0-9]*[_.-]> of list <./tests/blacklist.1> at line 1\n")
+
+	output.Reset()
+	checkDomain(&output, conf, []string{"adtracking.yandex.com"})
+	assert.Equal(output.String(), "adtracking.yandex.com is allowed by whitelist rule <yandex> of list <./tests/whitelist.1> at line 1, "+
+		"overriding blacklist rule <^adtrack(er|ing)?[0-9]*[_.-]> of list <./tests/blacklist.1> at line 1\n")
+
+	output.Reset()
+	checkDomain(&output, conf, []string{"www.foo.com"})
+	assert.Equal(output.String(), "www.foo.com is not blocked\n")
+
+	// rewritten, unless blocked
+	conf.filters.rewrites.readRewriteList(&FilterList{Path: writeList(t, "www.foo.com 10.0.0.1\nadtracking.foo.com 10.0.0.2\n")}, DEFAULT_MAX_ERRORS)
+	output.Reset()
+	checkDomain(&output, conf, []string{"www.foo.com"})
+	assert.Contains(output.String(), "www.foo.com is rewritten to 10.0.0.1 by rule <www.foo.com 10.0.0.1> of list <")
+
+	output.Reset()
+	checkDomain(&output, conf, []string{"adtracking.foo.com"})
+	assert.Contains(output.String(), "adtracking.foo.com is blocked")
+
+	// query types blocked, or not filtered, whatever the domain
+	conf.qtypes, _ = newQTypePolicy(QTypesConfig{Blocked: []string{"ANY"}, Filtered: []string{"A", "AAAA"}})
+	output.Reset()
+	checkDomain(&output, conf, []string{"www.foo.com", "any"})
+	assert.Equal(output.String(), "www.foo.com is blocked as query type ANY is blocked\n")
+
+	output.Reset()
+	checkDomain(&output, conf, []string{"stats.foo.com", "TXT"})
+	assert.Equal(output.String(), "stats.foo.com is not blocked as query type TXT is not filtered\n")
+
+	output.Reset()
+	assert.Equal(checkDomain(&output, conf, []string{"www.foo.com", "NOTATYPE"}), 1)
+
+	// local records are answered whatever the filters and the query type
+	output.Reset()
+	checkDomain(&output, conf, []string{"Printer.lan.", "ANY"})
+	assert.Equal(output.String(), "printer.lan is answered from local records\n")
+
+	// nothing is blocked nor rewritten when filtering is disabled
+	conf.dontFilter = true
+	output.Reset()
+	checkDomain(&output, conf, []string{"adtracking.foo.com"})
+	assert.Equal(output.String(), "adtracking.foo.com is not blocked as filtering is disabled\n")
+
+	output.Reset()
+	checkDomain(&output, conf, []string{"www.foo.com", "ANY"})
+	assert.Equal(output.String(), "www.foo.com is not blocked as filtering is disabled\n")
+}
+
+func TestValidateConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	var output bytes.Buffer
+	assert.Equal(validateConfig(&output, newTestConfig(t)), 0)
+	assert.Contains(output.String(), "blacklist rules: 11\n")
+
+	// certificate of a listener can't be loaded
+	conf := newTestConfig(t)
+	conf.tlsListener = TLSListenerConfig{Address: "127.0.0.1:853", CertFile: "./tests/missing.pem", KeyFile: "./tests/missing.key"}
+	output.Reset()
+	assert.Equal(validateConfig(&output, conf), 1)
+	assert.Contains(output.String(), "DoT listener")
+	assert.NotContains(output.String(), "is valid")
+
+	// lists with invalid lines
+	conf = newTestConfig(t)
+	conf.filters.reports = append(conf.filters.reports, conf.filters.blackList.readFilterFile(writeList(t, "(\n^foo\\.\n")))
+	output.Reset()
+	assert.Equal(validateConfig(&output, conf), 0)
+	assert.Contains(output.String(), "at line 1 of list")
+	assert.Contains(output.String(), "1 rules loaded, 1 invalid lines skipped")
+
+	conf.filters.reports = append(conf.filters.reports, conf.filters.blackList.readFilterList(&FilterList{Path: "./tests/no-such-list"}, 0))
+	output.Reset()
+	assert.Equal(validateConfig(&output, conf), 1)
+	assert.Contains(output.String(), "list <./tests/no-such-list> rejected")
+	assert.NotContains(output.String(), "is valid")
+}
+
+func TestCompileLists(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := newTestConfig(t)
+	conf.filterSettings = *snapshotSettings(t)
+
+	var output bytes.Buffer
+	assert.Equal(compileLists(&output, conf, nil), 0)
+	assert.Contains(output.String(), "1 shadowed domains removed")
+	assert.Contains(output.String(), "snapshot <"+conf.filterSettings.Snapshot+"> written\n")
+	assert.FileExists(conf.filterSettings.Snapshot)
+
+	// snapshot given on the command line
+	path := filepath.Join(t.TempDir(), "other.snapshot")
+	output.Reset()
+	assert.Equal(compileLists(&output, conf, []string{path}), 0)
+	assert.FileExists(path)
+
+	conf.filterSettings.Snapshot = ""
+	output.Reset()
+	assert.Equal(compileLists(&output, conf, nil), 1)
+}
+
+func TestQueryPipeline(t *testing.T) {
+	assert := assert.New(t)
+
+	var output bytes.Buffer
+	assert.Equal(queryPipeline(&output, newTestConfig(t), []string{"www.foo.com"}), 0)
+	assert.Contains(output.String(), ";; status: NOERROR")
+	assert.Contains(output.String(), "www.foo.com.\t60\tIN\tA\t1.2.3.4\n")
+
+	// blocked domains
+	output.Reset()
+	assert.Equal(queryPipeline(&output, newTestConfig(t), []string{"adtracking.foo.com", "aaaa"}), 0)
+	assert.Contains(output.String(), ";; status: NXDOMAIN")
+	assert.Contains(output.String(), ";adtracking.foo.com.\t\tIN\tAAAA\n")
+
+	output.Reset()
+	assert.Equal(queryPipeline(&output, newTestConfig(t), []string{"www.foo.com", "NOTATYPE"}), 1)
+
+	// rewritten domains
+	rewriteConfig := func() *Config {
+		conf := newTestConfig(t)
+		conf.filters.rewrites.readRewriteList(&FilterList{Path: "./tests/rewrite.1"}, DEFAULT_MAX_ERRORS)
+		return conf
+	}
+	output.Reset()
+	assert.Equal(queryPipeline(&output, rewriteConfig(), []string{"www.bing.com"}), 0)
+	assert.Contains(output.String(), "www.bing.com.\t300\tIN\tCNAME\tstrict.bing.com.\n")
+	assert.Contains(output.String(), "strict.bing.com.\t60\tIN\tA\t1.2.3.4\n")
+
+	// the answer for the target is filtered too
+	conf := rewriteConfig()
+	conf.filters.blackList.readFilterList(&FilterList{Path: writeList(t, "strict.bing.com\n"), Format: LIST_DOMAINS, CNAME: true}, DEFAULT_MAX_ERRORS)
+	output.Reset()
+	assert.Equal(queryPipeline(&output, conf, []string{"www.bing.com"}), 0)
+	assert.Contains(output.String(), ";; status: NXDOMAIN")
+	conf = rewriteConfig()
+	conf.filters.ipBlackList.readFilterList(writeList(t, "10.0.0.0/8\n"), DEFAULT_MAX_ERRORS)
+	output.Reset()
+	assert.Equal(queryPipeline(&output, conf, []string{"api.internal"}), 0)
+	assert.Contains(output.String(), ";; status: NXDOMAIN")
+
+	// nothing is rewritten when nothing is filtered
+	conf = rewriteConfig()
+	conf.dontFilter = true
+	output.Reset()
+	assert.Equal(queryPipeline(&output, conf, []string{"www.bing.com"}), 0)
+	assert.Contains(output.String(), "www.bing.com.\t60\tIN\tA\t1.2.3.4\n")
+	assert.NotContains(output.String(), "CNAME")
+
+	// blocked query types
+	conf = newTestConfig(t)
+	conf.qtypes, _ = newQTypePolicy(QTypesConfig{Blocked: []string{"ANY"}})
+	output.Reset()
+	assert.Equal(queryPipeline(&output, conf, []string{"www.foo.com", "ANY"}), 0)
+	assert.Contains(output.String(), ";; status: NOERROR")
+	assert.Contains(output.String(), "ANSWER: 0,")
+
+	// rules limited to some query types answer NODATA whatever the block action, for the other types to be resolved
+	conf = newTestConfig(t)
+	conf.filters.blackList.readFilterList(&FilterList{Path: writeList(t, "foo\\.com$qtype=AAAA\n"), CNAME: true}, DEFAULT_MAX_ERRORS)
+	output.Reset()
+	assert.Equal(queryPipeline(&output, conf, []string{"www.foo.com", "AAAA"}), 0)
+	assert.Contains(output.String(), ";; status: NOERROR")
+	assert.Contains(output.String(), "ANSWER: 0,")
+	output.Reset()
+	assert.Equal(queryPipeline(&output, newTestConfig(t), []string{"adtracking.foo.com", "AAAA"}), 0)
+	assert.Contains(output.String(), ";; status: NXDOMAIN")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// possible formats of a list
+const (
+	LIST_REGEX   = "regex"   // one regex per line, the default
+	LIST_DOMAINS = "domains" // one domain or glob per line, blocking the domain and all its subdomains
+	LIST_HOSTS   = "hosts"   // hosts file, e.g.: "0.0.0.0 ads.example.com"
+)
+
+// names found in hosts files which are not meant to be blocked
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// A domain coming from a list of domains or a hosts file
+type DomainRule struct {
+	Domain   string      // the domain, matching its subdomains too. If it starts with "*.", only subdomains match
+	List     *FilterList // list holding the rule
+	Line     int         // line number of the rule in the list file, starting at 1
+	shadowed bool        // true if a rule for a parent domain was added afterwards, making this one useless
+}
+
+// Domains are kept in a tree, reversed (e.g.: moc.elpmaxe), for subdomains to share the nodes of their
+// parent domain. The value of a node is the index of the rule in rules, plus 1. Rules for subdomains only
+// (e.g.: *.example.com) are kept under the "*" child of the dot preceding the domain
+type DomainFilter struct {
+	root  Node
+	rules []DomainRule
+}
+
+// Number of domains in use, not counting the ones shadowed by a parent domain
+func (filter *DomainFilter) len() int {
+	count := 0
+	for i := range filter.rules {
+		if !filter.rules[i].shadowed {
+			count++
+		}
+	}
+	return count
+}
+
+// Return the rule matching the domain or one of its parent domains, nil if none. If cname is true, only
+// rules of lists for which CNAME checking is enabled are used
+func (filter *DomainFilter) match(domain string, cname bool) *DomainRule {
+	node := &filter.root
+	for i := len(domain) - 1; i >= 0; i-- {
+		if node = node.getNode(rune(domain[i])); node == nil {
+			return nil
+		}
+
+		// a rule only matches whole labels
+		if node.value != 0 && (i == 0 || domain[i-1] == '.') {
+			if rule := &filter.rules[node.value-1]; !cname || rule.List.CNAME {
+				return rule
+			}
+		}
+
+		// rules for subdomains only, as there's a label before the dot
+		if domain[i] == '.' && i > 0 {
+			if wildcard := node.getNode('*'); wildcard != nil && wildcard.value != 0 {
+				if rule := &filter.rules[wildcard.value-1]; !cname || rule.List.CNAME {
+					return rule
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Return true if the domain is already in the tree
+func (filter *DomainFilter) has(domain string) bool {
+	node := &filter.root
+	for i := len(domain) - 1; i >= 0; i-- {
+		if node = node.getNode(rune(domain[i])); node == nil {
+			return false
+		}
+	}
+	return node.value != 0
+}
+
+// Add a domain to the tree, unless a parent domain already covers it, and remove the subdomains it covers.
+// A rule of a list without CNAME checking neither shadows nor is shadowed by a rule of a list with CNAME checking.
+// The number of rules shadowed is returned, counting the domain itself if it's covered by a parent domain
+func (filter *DomainFilter) insert(rule DomainRule) int {
+	if filter.match(rule.Domain, rule.List.CNAME) != nil {
+		return 1
+	}
+
+	// the same domain can only be there if coming from a list without CNAME checking: it's replaced
+	shadowed := 0
+	node := filter.root.Insert(reverse(rule.Domain))
+	if node.value != 0 {
+		filter.rules[node.value-1].shadowed = true
+		shadowed++
+	}
+	filter.rules = append(filter.rules, rule)
+	node.value = len(filter.rules)
+
+	// subdomains are under the dot following the domain, which for subdomains only is the one before the "*"
+	sub := node.getNode('.')
+	if strings.HasPrefix(rule.Domain, "*.") {
+		sub = filter.root.Insert(reverse(rule.Domain[1:]))
+	}
+	if sub != nil {
+		sub.walk(func(n *Node) {
+			if child := &filter.rules[n.value-1]; n != node && (rule.List.CNAME || !child.List.CNAME) {
+				child.shadowed = true
+				n.value = 0
+				shadowed++
+			}
+		})
+	}
+	return shadowed
+}
+
+// Return the characters of the string in reverse order
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// Convert a domain found in a list to the form used in queries: lower case, without the trailing dot
+func parseDomain(text string) (string, error) {
+	domain := strings.ToLower(strings.TrimSuffix(text, "."))
+	if domain == "" || len(domain) > 253 {
+		return "", fmt.Errorf("invalid domain <%s>", text)
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return "", fmt.Errorf("invalid domain <%s>", text)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", fmt.Errorf("invalid character <%c> in domain <%s>", c, text)
+			}
+		}
+	}
+	return domain, nil
+}
+
+// Convert a domain or a glob found in a list of domains to the form used in queries. A "*" matches any
+// characters within a label, and a "*" label any label: as a rule matches subdomains too, "*.example.com" matches
+// all the subdomains of example.com, but not example.com itself
+func parseDomainPattern(text string) (string, error) {
+	if !strings.Contains(text, "*") {
+		return parseDomain(text)
+	}
+	if strings.Trim(text, "*.") == "" {
+		return "", fmt.Errorf("glob <%s> matches all domains", text)
+	}
+
+	// checked as a domain, with "*" replaced by a valid character
+	if _, err := parseDomain(strings.ReplaceAll(text, "*", "x")); err != nil {
+		return "", fmt.Errorf("invalid glob <%s>", text)
+	}
+	return strings.ToLower(strings.TrimSuffix(text, ".")), nil
+}
+
+// Translate a glob to an anchored regex matching the same domains and their subdomains, e.g. "ads*.example.com"
+// to "(^|\.)ads[^.]*\.example\.com$". An empty string is returned for plain domains and for globs only
+// matching subdomains (e.g.: *.example.com), which are kept in the tree instead
+func globRegexp(glob string) string {
+	if !strings.Contains(glob, "*") || (strings.HasPrefix(glob, "*.") && !strings.Contains(glob[2:], "*")) {
+		return ""
+	}
+	return domainRegexp(glob)
+}
+
+// Translate a domain or a glob to an anchored regex matching the same domains and their subdomains. The pattern is
+// lowercase, as parseDomainPattern returns it, and so are names when they are matched
+func domainRegexp(pattern string) string {
+	labels := strings.Split(pattern, ".")
+	for i, label := range labels {
+		if label == "*" {
+			labels[i] = `[^.]+`
+			continue
+		}
+		parts := strings.Split(label, "*")
+		for j := range parts {
+			parts[j] = regexp.QuoteMeta(parts[j])
+		}
+		labels[i] = strings.Join(parts, `[^.]*`)
+	}
+	return `(^|\.)` + strings.Join(labels, `\.`) + "$"
+}
+
+// Get the domains of a hosts file line, e.g.: "0.0.0.0 ads.example.com tracker.example.com # comment".
+// Names of the local host are ignored
+func parseHostsLine(text string) ([]string, error) {
+	if i := strings.Index(text, "#"); i != -1 {
+		text = text[:i]
+	}
+	fields := strings.Fields(text)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil, fmt.Errorf("invalid hosts line <%s>", text)
+	}
+
+	domains := []string{}
+	for _, field := range fields[1:] {
+		if hostsLocalNames[strings.ToLower(field)] {
+			continue
+		}
+		domain, err := parseDomain(field)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDomain(t *testing.T) {
+	assert := assert.New(t)
+
+	domain, err := parseDomain("Ads.Example.COM.")
+	assert.Nil(err)
+	assert.Equal(domain, "ads.example.com")
+
+	for _, text := range []string{"", ".", "ads..example.com", "ads example.com", "^ads\\.", "*.example.com"} {
+		_, err = parseDomain(text)
+		assert.NotNil(err, text)
+	}
+}
+
+func TestParseHostsLine(t *testing.T) {
+	assert := assert.New(t)
+
+	domains, err := parseHostsLine("0.0.0.0 ads.example.com  tracker.example.com # trackers")
+	assert.Nil(err)
+	assert.Equal(domains, []string{"ads.example.com", "tracker.example.com"})
+
+	domains, err = parseHostsLine("127.0.0.1\tlocalhost localhost.localdomain")
+	assert.Nil(err)
+	assert.Equal(len(domains), 0)
+
+	_, err = parseHostsLine("ads.example.com")
+	assert.NotNil(err)
+	_, err = parseHostsLine("0.0.0.0.1 ads.example.com")
+	assert.NotNil(err)
+}
+
+func TestDomainFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	cname := &FilterList{Path: "cname", CNAME: true}
+	noCNAME := &FilterList{Path: "nocname", CNAME: false}
+
+	var filter DomainFilter
+	assert.Equal(filter.insert(DomainRule{Domain: "ads.example.com", List: cname, Line: 1}), 0)
+	assert.Equal(filter.insert(DomainRule{Domain: "tracker.com", List: cname, Line: 2}), 0)
+
+	// subdomains only match on labels
+	assert.Equal(filter.match("ads.example.com", false).Line, 1)
+	assert.Equal(filter.match("www.ads.example.com", false).Line, 1)
+	assert.Nil(filter.match("badads.example.com", false))
+	assert.Nil(filter.match("example.com", false))
+	assert.Nil(filter.match("com", false))
+
+	// covered by a parent domain, or covering subdomains already there
+	assert.Equal(filter.insert(DomainRule{Domain: "www.tracker.com", List: cname, Line: 3}), 1)
+	assert.Equal(filter.insert(DomainRule{Domain: "example.com", List: cname, Line: 4}), 1)
+	assert.Equal(filter.match("www.ads.example.com", false).Line, 4)
+	assert.Equal(filter.len(), 2)
+	assert.True(filter.has("example.com"))
+	assert.False(filter.has("ads.example.com"))
+
+	// a parent domain of a list without CNAME checking doesn't shadow a subdomain of a list with CNAME checking
+	assert.Equal(filter.insert(DomainRule{Domain: "foo.com", List: noCNAME, Line: 5}), 0)
+	assert.Equal(filter.insert(DomainRule{Domain: "stats.foo.com", List: cname, Line: 6}), 0)
+	assert.Equal(filter.insert(DomainRule{Domain: "cdn.foo.com", List: noCNAME, Line: 7}), 1)
+	assert.Equal(filter.match("www.stats.foo.com", false).Line, 5)
+	assert.Equal(filter.match("www.stats.foo.com", true).Line, 6)
+	assert.Nil(filter.match("cdn.foo.com", true))
+
+	// the same domain with CNAME checking replaces the other one
+	assert.Equal(filter.insert(DomainRule{Domain: "foo.com", List: cname, Line: 8}), 2)
+	assert.Equal(filter.match("cdn.foo.com", true).Line, 8)
+	assert.Equal(filter.len(), 3)
+}
+
+func TestReadDomainList(t *testing.T) {
+	assert := assert.New(t)
+
+	var rf RegexpFilter
+	report := rf.readFilterList(&FilterList{Path: writeList(t, "# ads\nads.example.com\nwww.ads.example.com\nads.example.com\nbad domain\nexample.net\n"), Format: LIST_DOMAINS, CNAME: true}, DEFAULT_MAX_ERRORS)
+	assert.Nil(report.Err)
+	assert.Equal(report.Loaded, 3)
+	assert.Equal(report.Duplicates, 1)
+	assert.Equal(report.Shadowed, 1)
+	assert.Equal(report.Errors[0].Line, 5)
+
+	report = rf.readFilterList(&FilterList{Path: writeList(t, "127.0.0.1 localhost\n0.0.0.0 example.com\n0.0.0.0 example.net\n"), Format: LIST_HOSTS, CNAME: true}, DEFAULT_MAX_ERRORS)
+	assert.Nil(report.Err)
+	assert.Equal(report.Loaded, 1)
+	assert.Equal(report.Duplicates, 1)
+	assert.Equal(report.Shadowed, 1)
+	assert.Equal(rf.domains.len(), 2)
+
+	// matches are reported like the ones of regexes
+	assert.True(rf.IsMatch("www.ads.example.com", TYPE_A))
+	assert.True(rf.matchCNAME("www.example.net", TYPE_A))
+	assert.Equal(rf.firstMatch("www.ads.example.com", TYPE_A).Rule, "example.com")
+	assert.Equal(rf.firstMatch("www.ads.example.com", TYPE_A).Line, 2)
+
+	// globs are kept either in the tree or as regexes
+	report = rf.readFilterList(&FilterList{Path: writeList(t, "*.doubleclick.net\nads*.example.org\nads*.example.org\n*\n"), Format: LIST_DOMAINS, CNAME: true}, DEFAULT_MAX_ERRORS)
+	assert.Equal(report.Loaded, 2)
+	assert.Equal(report.Duplicates, 1)
+	assert.Equal(len(report.Errors), 1)
+	assert.Equal(rf.domains.len(), 3)
+	assert.Equal(len(rf.exprList), 1)
+	assert.False(rf.IsMatch("doubleclick.net", TYPE_A))
+	assert.True(rf.IsMatch("ad.doubleclick.net", TYPE_A))
+	assert.Equal(*rf.firstMatch("www.ads2.example.org", TYPE_A), RuleMatch{List: rf.lists[0], Line: 2, Rule: "ads*.example.org"})
+
+	report = rf.readFilterList(&FilterList{Path: "./tests/blacklist.1", Format: "adblock"}, DEFAULT_MAX_ERRORS)
+	assert.NotNil(report.Err)
+}
+
+func TestParseDomainPattern(t *testing.T) {
+	assert := assert.New(t)
+
+	domain, err := parseDomainPattern("*.DoubleClick.net.")
+	assert.Nil(err)
+	assert.Equal(domain, "*.doubleclick.net")
+
+	for _, text := range []string{"*", "*.*", "ads*..example.com", "ads*.exa mple.com"} {
+		_, err = parseDomainPattern(text)
+		assert.NotNil(err, text)
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	assert := assert.New(t)
+
+	// plain domains and subdomains only are kept in the tree
+	assert.Equal(globRegexp("example.com"), "")
+	assert.Equal(globRegexp("*.example.com"), "")
+
+	for glob, domains := range map[string]map[string]bool{
+		"ads*.example.com": {"ads.example.com": true, "ads2.example.com": true, "www.ads-eu.example.com": true,
+			"example.com": false, "bads.example.com": false, "ads.foo.example.com": false},
+		"ads.*.example.com": {"ads.eu.example.com": true, "www.ads.eu.example.com": true, "ads.example.com": false},
+		"*.ads*.net":        {"www.ads1.net": true, "ads1.net": false},
+		"*tracker*.com":     {"tracker.com": true, "mytrackers.com": true, "tracker.com.foo": false},
+	} {
+		re := regexp.MustCompile(globRegexp(glob))
+		for domain, match := range domains {
+			assert.Equal(re.MatchString(domain), match, glob+" "+domain)
+		}
+	}
+}
+
+func TestDomainFilterWildcard(t *testing.T) {
+	assert := assert.New(t)
+
+	list := &FilterList{Path: "list", CNAME: true}
+
+	var filter DomainFilter
+	assert.Equal(filter.insert(DomainRule{Domain: "www.example.com", List: list, Line: 1}), 0)
+	assert.Equal(filter.insert(DomainRule{Domain: "*.example.com", List: list, Line: 2}), 1)
+
+	// the apex is not matched
+	assert.Nil(filter.match("example.com", false))
+	assert.Equal(filter.match("www.example.com", false).Line, 2)
+	assert.Equal(filter.match("a.b.example.com", false).Line, 2)
+	assert.Equal(filter.match("www.example.com", false).Domain, "*.example.com")
+	assert.Nil(filter.match("badexample.com", false))
+
+	// covered by the wildcard, or covering it
+	assert.Equal(filter.insert(DomainRule{Domain: "ads.example.com", List: list, Line: 3}), 1)
+	assert.Equal(filter.insert(DomainRule{Domain: "*.example.com", List: list, Line: 4}), 1)
+	assert.Equal(filter.insert(DomainRule{Domain: "example.com", List: list, Line: 5}), 1)
+	assert.Equal(filter.match("example.com", false).Line, 5)
+	assert.Equal(filter.match("www.example.com", false).Line, 5)
+	assert.Equal(filter.len(), 1)
+}
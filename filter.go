@@ -2,64 +2,479 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"net"
 
 	//"fmt"
 	"log"
 	"os"
 	"regexp"
 	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// by default, a list is rejected when more than this number of lines are invalid
+const DEFAULT_MAX_ERRORS = 10
+
+// returned when parsing a rule already loaded, or a line without any rule
+var (
+	errDuplicateRule = errors.New("duplicate rule")
+	errIgnoredLine   = errors.New("ignored line")
 )
 
-// List of domains to accept or reject. White list is tested first
+// List of domains to accept or reject. White list is tested first.
+// IP ranges are tested against the addresses found in the resolver answer
 type FilteredDomains struct {
-	whiteList RegexpFilter
-	blackList RegexpFilter
+	whiteList   RegexpFilter
+	blackList   RegexpFilter
+	ipBlackList IPFilter
+	rewrites    RewriteRules  // domains answered with synthesized records, unless they're blocked
+	reports     []*ListReport // what was loaded from each list
 }
 
-// Allocate memory for slice of regexes
+// Allocate memory for slice of regexes. Everything loaded before is dropped
 func (fd *FilteredDomains) init() {
-	fd.whiteList.exprList = make([]*regexp.Regexp, 0)
-	fd.blackList.exprList = make([]*regexp.Regexp, 0)
+	fd.whiteList = RegexpFilter{exprList: make([]*regexp.Regexp, 0), lists: make([]*FilterList, 0)}
+	fd.blackList = RegexpFilter{exprList: make([]*regexp.Regexp, 0), lists: make([]*FilterList, 0)}
+	fd.ipBlackList = IPFilter{netList: make([]*net.IPNet, 0)}
+	fd.rewrites = RewriteRules{domains: make(map[string]*RewriteRule)}
+	fd.reports = make([]*ListReport, 0)
 }
 
-// test whether a domain has to be filtered or not
-func (domains *FilteredDomains) isFiltered(domain string) bool {
-	// try to match a domain in the whitelist first
-	for _, re := range domains.whiteList.exprList {
-		if re.MatchString(domain) {
-			return false
+// Read all the lists of the configuration file, keeping what was loaded from each one
+func (fd *FilteredDomains) readLists(settings *FiltersConfig) {
+	maxErrors := settings.maxErrors()
+	for i := range settings.Blacklist {
+		fd.reports = append(fd.reports, fd.blackList.readFilterList(&settings.Blacklist[i], maxErrors))
+	}
+	for i := range settings.Whitelist {
+		fd.reports = append(fd.reports, fd.whiteList.readFilterList(&settings.Whitelist[i], maxErrors))
+	}
+	for _, list := range settings.IPBlacklist {
+		fd.reports = append(fd.reports, fd.ipBlackList.readFilterList(list, maxErrors))
+	}
+	for i := range settings.Rewrite {
+		fd.reports = append(fd.reports, fd.rewrites.readRewriteList(&settings.Rewrite[i], maxErrors))
+	}
+}
+
+// A rule matching a domain, and where it's coming from
+type RuleMatch struct {
+	List *FilterList // list holding the rule
+	Line int         // line number of the rule in the list file, starting at 1
+	Rule string      // text of the rule
+}
+
+// Describe the rule and its origin, as used in logs
+func (match *RuleMatch) String() string {
+	return fmt.Sprintf("rule <%s> of list <%s> at line %d", match.Rule, match.List.Path, match.Line)
+}
+
+// Why a domain is blocked or not
+type FilterResult struct {
+	Blocked  bool       // decision
+	TypeOnly bool       // true if blocked only by rules limited to some query types, other types being allowed
+	Block    *RuleMatch // blacklist rule matching the domain, nil if none
+	Allow    *RuleMatch // whitelist rule matching the domain, nil if none. It overrides the blacklist one
+}
+
+// Describe the decision, as used in logs
+func (result FilterResult) String() string {
+	switch {
+	case result.Blocked:
+		return "blocked by " + result.Block.String()
+	case result.Allow != nil && result.Block != nil:
+		return "allowed by whitelist " + result.Allow.String() + ", overriding blacklist " + result.Block.String()
+	case result.Allow != nil:
+		return "allowed by whitelist " + result.Allow.String()
+	}
+	return "not blocked"
+}
+
+// Tell whether a query for a domain has to be filtered, and because of which rules. The blacklist is checked even
+// when the whitelist matches, to know whether a block was overridden
+func (domains *FilteredDomains) match(domain string, qtype uint16) FilterResult {
+	result := FilterResult{
+		Allow: domains.whiteList.firstMatch(domain, qtype),
+		Block: domains.blackList.firstMatch(domain, qtype),
+	}
+	result.Blocked = result.Allow == nil && result.Block != nil
+	result.TypeOnly = result.Blocked && qtype != 0 && domains.blackList.firstMatch(domain, 0) == nil
+	return result
+}
+
+// test whether an answer coming from the resolver holds an A or AAAA record in one of the blocked ranges.
+// Return the first matching address and its range, nil otherwise
+func (domains *FilteredDomains) isAnswerFiltered(msg *DNSMessage) (net.IP, *net.IPNet) {
+	for i := range msg.Answers {
+		ip := msg.Answers[i].ip()
+		if ip == nil {
+			continue
+		}
+		if ipNet := domains.ipBlackList.match(ip); ipNet != nil {
+			return ip, ipNet
 		}
 	}
+	return nil, nil
+}
 
-	// try then to match a domain in the blacklist
-	for _, re := range domains.blackList.exprList {
-		if re.MatchString(domain) {
-			fmt.Printf("domain <%s> matched <%s>\n", domain, re.String())
-			return true
+// test whether an answer coming from the resolver has to be filtered, because of a CNAME target matching the lists
+// (CNAME cloaking) or an A or AAAA record in one of the blocked ranges.
+// Return the reason why the answer is blocked, an empty string otherwise, and whether it's only blocked by rules
+// limited to some query types
+func (domains *FilteredDomains) isAnswerBlocked(msg *DNSMessage) (string, bool) {
+	var qtype uint16
+	if len(msg.Questions) != 0 {
+		qtype = msg.Questions[0].QType
+	}
+
+	// the whole CNAME chain is checked, whatever the case of the targets
+	for i := range msg.Answers {
+		if msg.Answers[i].Type != TYPE_CNAME {
+			continue
+		}
+		target := strings.ToLower(strings.TrimSuffix(msg.Answers[i].target(), "."))
+		if domains.isCNAMEFiltered(target, qtype) {
+			return fmt.Sprintf("blocked via CNAME <%s>", target), !domains.blackList.matchCNAME(target, 0)
 		}
 	}
 
-	return false
+	if ip, ipNet := domains.isAnswerFiltered(msg); ipNet != nil {
+		return fmt.Sprintf("address <%v> is in range <%v>", ip, ipNet), false
+	}
+
+	return "", false
+}
+
+// test whether a CNAME target found in the resolver answer has to be filtered or not.
+// Only rules coming from lists for which CNAME checking is enabled, and applying to the query type, are used
+func (domains *FilteredDomains) isCNAMEFiltered(target string, qtype uint16) bool {
+	return !domains.whiteList.matchCNAME(target, qtype) && domains.blackList.matchCNAME(target, qtype)
+}
+
+// Lists as found in the YAML configuration file
+type FiltersConfig struct {
+	Whitelist   []FilterList `yaml:"whitelist"`
+	Blacklist   []FilterList `yaml:"blacklist"`
+	IPBlacklist []string     `yaml:"ip_blacklist"`
+	Rewrite     []FilterList `yaml:"rewrite"`
+	MaxErrors   *int         `yaml:"max_errors"`
+	Snapshot    string       `yaml:"snapshot"`
+}
+
+// Number of invalid lines after which a list is rejected, unless set for the list itself
+func (settings *FiltersConfig) maxErrors() int {
+	if settings.MaxErrors != nil {
+		return *settings.MaxErrors
+	}
+	return DEFAULT_MAX_ERRORS
+}
+
+// A blocklist as found in the YAML configuration file. It's either a single path,
+// or a mapping with the "path" key and options (e.g.: "cname: false")
+type FilterList struct {
+	Path      string `yaml:"path"`       // path of the blocklist
+	Format    string `yaml:"format"`     // regex (default), domains or hosts
+	CNAME     bool   `yaml:"cname"`      // if true (default), CNAME targets in answers are matched against this list too
+	MaxErrors *int   `yaml:"max_errors"` // if set, overrides the number of invalid lines after which the list is rejected
+}
+
+// Decode a blocklist from the YAML configuration file, either as a scalar or a mapping
+func (list *FilterList) UnmarshalYAML(value *yaml.Node) error {
+	list.CNAME = true
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&list.Path)
+	}
+
+	// use another type to not recurse into this method
+	type plain FilterList
+	return value.Decode((*plain)(list))
 }
 
-// When reading a blocklist containing regexes, all data are kept here.
-// Each line is converted to a compiled regexp
+// When reading blocklists, all data are kept here. Each line of a regex list is converted to a compiled regexp,
+// domains coming from lists of domains or hosts files are kept in a tree
 type RegexpFilter struct {
 	exprList []*regexp.Regexp // list of compiled regexes coming from the blocklist
+	lists    []*FilterList    // list each regex is coming from, same index as exprList
+	lines    []int            // line number of each regex in its list, same index as exprList
+	globs    []string         // glob each regex was translated from, empty if written as a regex, same index as exprList
+	qtypes   [][]uint16       // query types each regex is limited to, nil for all of them, same index as exprList
+	rules    map[string]bool  // text of the regexes already loaded with their query types, to skip duplicates
+	domains  DomainFilter     // domains, matching their subdomains too
+	index    *literalIndex    // literals of the regexes, to only run the ones which might match
+}
+
+// Read a blocklist with one regex per file and create the RegexpFilter struct, using default options
+func (filter *RegexpFilter) readFilterFile(filterFile string) *ListReport {
+	return filter.readFilterList(&FilterList{Path: filterFile, CNAME: true}, DEFAULT_MAX_ERRORS)
+}
+
+// Read a blocklist and add its rules to the RegexpFilter struct, depending on its format. Invalid lines are
+// skipped, unless there are more than maxErrors of them: the list is then rejected as a whole
+func (filter *RegexpFilter) readFilterList(list *FilterList, maxErrors int) *ListReport {
+	if list.MaxErrors != nil {
+		maxErrors = *list.MaxErrors
+	}
+
+	switch strings.ToLower(list.Format) {
+	case "", LIST_REGEX:
+		return filter.readRegexList(list, maxErrors)
+	case LIST_DOMAINS, LIST_HOSTS:
+		return filter.readDomainList(list, maxErrors)
+	}
+	return &ListReport{Path: list.Path, Err: fmt.Errorf("unknown list format <%s>", list.Format)}
+}
+
+// Read a blocklist with one regex per line, possibly limited to some query types. Duplicates are skipped.
+// Lines which are not valid regexes but globs (e.g.: *.example.com) are translated to regexes, as in lists of
+// domains. Globs which are valid regexes too (e.g.: ads*.example.com) are taken as regexes
+func (filter *RegexpFilter) readRegexList(list *FilterList, maxErrors int) *ListReport {
+	if filter.rules == nil {
+		filter.rules = make(map[string]bool)
+	}
+
+	// regexes are only added once the whole list is read
+	var exprList []*regexp.Regexp
+	var globs []string
+	var qtypes [][]uint16
+	var lines []int
+	seen := make(map[string]bool)
+
+	report := readListFile(list.Path, maxErrors, func(line int, text string) error {
+		expr, types, err := parseQTypeModifier(text)
+		if err != nil {
+			return err
+		}
+		re, err := regexp.Compile(expr)
+		glob := ""
+		if err != nil {
+			domain, globErr := parseDomainPattern(expr)
+			if globErr != nil {
+				return err
+			}
+			if re, err = regexp.Compile(domainRegexp(domain)); err != nil {
+				return err
+			}
+			glob = domain
+		}
+		key := re.String() + qTypeModifier(types)
+		if filter.rules[key] || seen[key] {
+			return errDuplicateRule
+		}
+		seen[key] = true
+		exprList = append(exprList, re)
+		globs = append(globs, glob)
+		qtypes = append(qtypes, types)
+		lines = append(lines, line)
+		return nil
+	})
+	if report.Err != nil {
+		return report
+	}
+
+	for i, re := range exprList {
+		filter.addRegexp(re, globs[i], qtypes[i], list, lines[i])
+	}
+	filter.buildIndex()
+	return report
+}
+
+// Index the literals of the regexes, once they're all added
+func (filter *RegexpFilter) buildIndex() {
+	filter.index = newLiteralIndex(filter.exprList)
+}
+
+// Return the first regex kept by the function and matching the text, in the order of exprList, -1 if there's none.
+// Only the candidates given by the index are tried, unless it's not up to date
+func (filterList *RegexpFilter) find(text string, keep func(i int) bool) int {
+	if filterList.index == nil || filterList.index.count != len(filterList.exprList) {
+		for i, re := range filterList.exprList {
+			if keep(i) && re.MatchString(text) {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, i := range filterList.index.candidates(text) {
+		if keep(i) && filterList.exprList[i].MatchString(text) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add a compiled regex coming from the list, along with the glob it was translated from if any and the query
+// types it's limited to
+func (filter *RegexpFilter) addRegexp(re *regexp.Regexp, glob string, qtypes []uint16, list *FilterList, line int) {
+	if filter.rules == nil {
+		filter.rules = make(map[string]bool)
+	}
+	filter.exprList = append(filter.exprList, re)
+	filter.globs = append(filter.globs, glob)
+	filter.qtypes = append(filter.qtypes, qtypes)
+	filter.lists = append(filter.lists, list)
+	filter.lines = append(filter.lines, line)
+	filter.rules[re.String()+qTypeModifier(qtypes)] = true
+}
+
+// Text of a regex as written in its list: either the glob it was translated from, or the regex itself, followed
+// by the query types it's limited to
+func (filterList *RegexpFilter) ruleText(i int) string {
+	text := filterList.exprList[i].String()
+	if i < len(filterList.globs) && filterList.globs[i] != "" {
+		text = filterList.globs[i]
+	}
+	return text + qTypeModifier(filterList.qtypeList(i))
+}
+
+// Query types a regex is limited to, nil for all of them
+func (filterList *RegexpFilter) qtypeList(i int) []uint16 {
+	if i < len(filterList.qtypes) {
+		return filterList.qtypes[i]
+	}
+	return nil
+}
+
+// Read a blocklist with one domain or glob per line, or a hosts file. Duplicates and domains covered by a parent
+// domain are skipped, and domains already loaded which are covered by one of the list are removed. Globs which
+// can't be kept in the tree, and rules limited to some query types, are translated to regexes
+func (filter *RegexpFilter) readDomainList(list *FilterList, maxErrors int) *ListReport {
+	// domains and globs are only added once the whole list is read
+	var rules []DomainRule
+	var globExprs []*regexp.Regexp
+	var globs []string
+	var globQTypes [][]uint16
+	var globLines []int
+	seen := make(map[string]bool)
+
+	report := readListFile(list.Path, maxErrors, func(line int, text string) error {
+		domains := []string{}
+		if strings.ToLower(list.Format) == LIST_HOSTS {
+			var err error
+			if domains, err = parseHostsLine(text); err != nil {
+				return err
+			}
+			if len(domains) == 0 {
+				return errIgnoredLine
+			}
+		} else {
+			pattern, qtypes, err := parseQTypeModifier(text)
+			if err != nil {
+				return err
+			}
+			domain, err := parseDomainPattern(pattern)
+			if err != nil {
+				return err
+			}
+
+			// the tree only holds rules for all query types
+			expr := globRegexp(domain)
+			if qtypes != nil {
+				expr = domainRegexp(domain)
+			}
+			if expr != "" {
+				key := expr + qTypeModifier(qtypes)
+				if filter.rules[key] || seen[key] {
+					return errDuplicateRule
+				}
+				re, err := regexp.Compile(expr)
+				if err != nil {
+					return err
+				}
+				seen[key] = true
+				globExprs = append(globExprs, re)
+				globs = append(globs, domain)
+				globQTypes = append(globQTypes, qtypes)
+				globLines = append(globLines, line)
+				return nil
+			}
+			domains = append(domains, domain)
+		}
+
+		added := false
+		for _, domain := range domains {
+			if seen[domain] || filter.domains.has(domain) {
+				continue
+			}
+			seen[domain] = true
+			rules = append(rules, DomainRule{Domain: domain, List: list, Line: line})
+			added = true
+		}
+		if !added {
+			return errDuplicateRule
+		}
+		return nil
+	})
+	if report.Err != nil {
+		return report
+	}
+
+	for _, rule := range rules {
+		report.Shadowed += filter.domains.insert(rule)
+	}
+	for i, re := range globExprs {
+		filter.addRegexp(re, globs[i], globQTypes[i], list, globLines[i])
+	}
+	if len(globExprs) != 0 {
+		filter.buildIndex()
+	}
+	return report
 }
 
-// Read a blocklist with one regex per file and create the RegexpFilter struct
-// exit process if a regex doesn't compile
-func (filter *RegexpFilter) readFilterFile(filterFile string) {
-	fileHandle, err := os.Open(filterFile)
+// An invalid line of a list, skipped when loading it
+type LineError struct {
+	Line   int    // line number, starting at 1
+	Reason string // why the line is invalid
+}
+
+// What was loaded from a list
+type ListReport struct {
+	Path       string      // path of the list
+	Loaded     int         // number of rules loaded
+	Duplicates int         // number of rules skipped as already loaded
+	Shadowed   int         // number of domains removed as covered by a parent domain
+	Errors     []LineError // invalid lines, skipped
+	Err        error       // if not nil, the list is rejected and none of its rules are used
+}
+
+// Summarize what was loaded from the list
+func (report *ListReport) String() string {
+	if report.Err != nil {
+		return fmt.Sprintf("list <%s> rejected: %v", report.Path, report.Err)
+	}
+	return fmt.Sprintf("list <%s>: %d rules loaded, %d invalid lines skipped, %d duplicates skipped, %d shadowed domains removed",
+		report.Path, report.Loaded, len(report.Errors), report.Duplicates, report.Shadowed)
+}
+
+// Log the invalid lines of the list, and the summary
+func (report *ListReport) log() {
+	for _, lineErr := range report.Errors {
+		log.Printf("error: <%s> at line %d of list <%s>", lineErr.Reason, lineErr.Line, report.Path)
+	}
+	if report.Err != nil {
+		log.Printf("error: %v", report)
+		return
+	}
+	log.Print(report)
+}
+
+// Read a list with one rule per line, skipping comments and empty lines. Each rule is given to parse, which
+// returns an error if it's invalid, errDuplicateRule if it's already loaded or errIgnoredLine if there's nothing
+// to load. Reading stops when the file can't be read, or when more than maxErrors lines are invalid
+func readListFile(path string, maxErrors int, parse func(line int, text string) error) *ListReport {
+	report := &ListReport{Path: path}
+
+	fileHandle, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		report.Err = err
+		return report
 	}
 	defer fileHandle.Close()
 
 	scanner := bufio.NewScanner(fileHandle)
-	for scanner.Scan() {
+	for line := 1; scanner.Scan(); line++ {
 		// get rid of trailing spaces
 		text := strings.TrimSpace(scanner.Text())
 
@@ -68,28 +483,55 @@ func (filter *RegexpFilter) readFilterFile(filterFile string) {
 			continue
 		}
 
-		// compile the string regexp
-		re, err := regexp.Compile(text)
-		if err != nil {
-			log.Fatalf("regexp <%s> couldn't be compiled, error:<%v>", text, err)
+		switch err := parse(line, text); {
+		case err == nil:
+			report.Loaded++
+		case errors.Is(err, errDuplicateRule):
+			report.Duplicates++
+		case errors.Is(err, errIgnoredLine):
+		default:
+			report.Errors = append(report.Errors, LineError{Line: line, Reason: err.Error()})
+			if len(report.Errors) > maxErrors {
+				report.Err = fmt.Errorf("more than %d invalid lines", maxErrors)
+				return report
+			}
 		}
-
-		// add to our list
-		filter.exprList = append(filter.exprList, re)
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		report.Err = err
 	}
+	return report
 }
 
-// Return true if any of the regexes matches the text
+// Return true if any of the domains or regexes applying to the query type matches the text
 // false otherwise
-func (filterList *RegexpFilter) IsMatch(text string) bool {
-	for _, expr := range filterList.exprList {
-		if expr.MatchString(text) {
-			return true
-		}
+func (filterList *RegexpFilter) IsMatch(text string, qtype uint16) bool {
+	if filterList.domains.match(text, false) != nil {
+		return true
+	}
+	return filterList.find(text, func(i int) bool { return hasQType(filterList.qtypeList(i), qtype) }) != -1
+}
+
+// Return the first domain or regex applying to the query type and matching the text, with where it's coming from.
+// Nil is returned if none matches
+func (filterList *RegexpFilter) firstMatch(text string, qtype uint16) *RuleMatch {
+	if rule := filterList.domains.match(text, false); rule != nil {
+		return &RuleMatch{List: rule.List, Line: rule.Line, Rule: rule.Domain}
+	}
+	if i := filterList.find(text, func(i int) bool { return hasQType(filterList.qtypeList(i), qtype) }); i != -1 {
+		return &RuleMatch{List: filterList.lists[i], Line: filterList.lines[i], Rule: filterList.ruleText(i)}
+	}
+	return nil
+}
+
+// Return true if any of the domains or regexes coming from a list with CNAME checking enabled and applying to
+// the query type matches the text, false otherwise
+func (filterList *RegexpFilter) matchCNAME(text string, qtype uint16) bool {
+	if filterList.domains.match(text, true) != nil {
+		return true
 	}
-	return false
+	return filterList.find(text, func(i int) bool {
+		return filterList.lists[i].CNAME && hasQType(filterList.qtypeList(i), qtype)
+	}) != -1
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 func TestReadFilterFile(t *testing.T) {
@@ -15,16 +18,63 @@ func TestReadFilterFile(t *testing.T) {
 
 	rf.readFilterFile("./tests/blacklist.1")
 	assert.Equal(len(rf.exprList), 11)
-	assert.True(rf.IsMatch("adtracking.foo.com"))
-	assert.False(rf.IsMatch("foo.com"))
+	assert.True(rf.IsMatch("adtracking.foo.com", TYPE_A))
+	assert.False(rf.IsMatch("foo.com", TYPE_A))
 
 	rf.readFilterFile("./tests/blacklist.2")
 	assert.Equal(len(rf.exprList), 13)
-	assert.True(rf.IsMatch("www.yandex.ru"))
-	assert.False(rf.IsMatch("www.yandex.com"))
+	assert.True(rf.IsMatch("www.yandex.ru", TYPE_A))
+	assert.False(rf.IsMatch("www.yandex.com", TYPE_A))
 }
 
-func TestIsFiltered(t *testing.T) {
+// Write a list in a temporary directory, and return its path
+func writeList(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadFilterListErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	var rf RegexpFilter
+	path := writeList(t, "# comment\n^ads\\.\n(unclosed\n^ads\\.\n\n^track[\n\\.ru$\n")
+
+	// invalid lines are skipped and reported, as well as duplicates
+	report := rf.readFilterFile(path)
+	assert.Nil(report.Err)
+	assert.Equal(report.Loaded, 2)
+	assert.Equal(report.Duplicates, 1)
+	assert.Equal(len(report.Errors), 2)
+	assert.Equal(report.Errors[0].Line, 3)
+	assert.Equal(report.Errors[1].Line, 6)
+	assert.Contains(report.Errors[0].Reason, "missing closing )")
+	assert.Equal(report.String(), "list <"+path+">: 2 rules loaded, 2 invalid lines skipped, 1 duplicates skipped, 0 shadowed domains removed")
+	assert.Equal(rf.lines, []int{2, 7})
+	assert.True(rf.IsMatch("www.yandex.ru", TYPE_A))
+
+	// rules already loaded from another list are duplicates too
+	report = rf.readFilterFile(writeList(t, "\\.ru$\n"))
+	assert.Equal(report.Loaded, 0)
+	assert.Equal(report.Duplicates, 1)
+
+	// over the error budget, the whole list is rejected
+	maxErrors := 1
+	report = rf.readFilterList(&FilterList{Path: writeList(t, "^foo\\.\n(\n[\n"), MaxErrors: &maxErrors}, DEFAULT_MAX_ERRORS)
+	assert.NotNil(report.Err)
+	assert.Contains(report.String(), "rejected: more than 1 invalid lines")
+	assert.False(rf.IsMatch("foo.com", TYPE_A))
+	assert.Equal(len(rf.exprList), 2)
+
+	// missing file
+	report = rf.readFilterFile("./tests/no-such-list")
+	assert.NotNil(report.Err)
+	assert.Equal(len(rf.exprList), 2)
+}
+
+func TestMatchAnyType(t *testing.T) {
 	assert := assert.New(t)
 
 	var fd FilteredDomains
@@ -34,8 +84,165 @@ func TestIsFiltered(t *testing.T) {
 	fd.blackList.readFilterFile("./tests/blacklist.1")
 	fd.blackList.readFilterFile("./tests/blacklist.2")
 
-	assert.True(fd.isFiltered("adtracking.foo.com"))
-	assert.False(fd.isFiltered("foo.com"))
-	assert.False(fd.isFiltered("www.yandex.ru"))
-	assert.True(fd.isFiltered("www.foo.ru"))
+	assert.True(fd.match("adtracking.foo.com", 0).Blocked)
+	assert.False(fd.match("foo.com", 0).Blocked)
+	assert.False(fd.match("www.yandex.ru", 0).Blocked)
+	assert.True(fd.match("www.foo.ru", 0).Blocked)
+}
+
+func TestMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	var fd FilteredDomains
+	fd.init()
+
+	fd.whiteList.readFilterFile("./tests/whitelist.1")
+	fd.blackList.readFilterFile("./tests/blacklist.1")
+	fd.blackList.readFilterFile("./tests/blacklist.2")
+
+	// rule and line number are recorded
+	result := fd.match("www.foo.ru", TYPE_A)
+	assert.True(result.Blocked)
+	assert.Nil(result.Allow)
+	assert.Equal(*result.Block, RuleMatch{List: fd.blackList.lists[12], Line: 2, Rule: `\.ru$`})
+	assert.Equal(result.String(), `blocked by rule <\.ru$> of list <./tests/blacklist.2> at line 2`)
+
+	// whitelist overrides the blacklist
+	result = fd.match("www.yandex.ru", TYPE_A)
+	assert.False(result.Blocked)
+	assert.Equal(result.Allow.Rule, "yandex")
+	assert.Equal(result.Block.Rule, `\.ru$`)
+	assert.Contains(result.String(), "overriding blacklist")
+
+	result = fd.match("www.foo.com", TYPE_A)
+	assert.Equal(result, FilterResult{})
+	assert.Equal(result.String(), "not blocked")
+}
+
+func TestRegexListGlobs(t *testing.T) {
+	assert := assert.New(t)
+
+	// globs which are not valid regexes are translated, the other lines are regexes
+	var rf RegexpFilter
+	report := rf.readFilterList(&FilterList{Path: writeList(t, "*.doubleclick.net\n*.ads.*.com$qtype=AAAA\nads*.example.org\n*[\n"), CNAME: true}, DEFAULT_MAX_ERRORS)
+	assert.Equal(report.Loaded, 3)
+	assert.Equal(report.Errors[0].Line, 4)
+	assert.Equal(rf.firstMatch("stats.g.doubleclick.net", TYPE_A).Rule, "*.doubleclick.net")
+	assert.Nil(rf.firstMatch("doubleclick.net", TYPE_A))
+	assert.Nil(rf.firstMatch("mydoubleclick.net", TYPE_A))
+	assert.Equal(rf.firstMatch("x.ads.foo.com", TYPE_AAAA).Rule, "*.ads.*.com$qtype=AAAA")
+	assert.Nil(rf.firstMatch("x.ads.foo.com", TYPE_A))
+	assert.Equal(rf.firstMatch("adsss.example.org", TYPE_A).Rule, "ads*.example.org")
+
+	// the same glob in another list is a duplicate
+	report = rf.readFilterList(&FilterList{Path: writeList(t, "*.DoubleClick.net\n"), CNAME: true}, DEFAULT_MAX_ERRORS)
+	assert.Equal(report.Duplicates, 1)
+
+	// names are lowercased before being matched, whatever the case of the glob
+	var fd FilteredDomains
+	fd.init()
+	fd.blackList = rf
+	assert.True(fd.isCNAMEFiltered("stats.g.doubleclick.net", TYPE_A))
+	msg := &DNSMessage{Answers: []DNSResourceRecord{{Name: "metrics.foo.com", Type: TYPE_CNAME, Class: CLASS_IN, RData: encodeDomainName("X.DoubleClick.NET")}}}
+	reason, _ := fd.isAnswerBlocked(msg)
+	assert.Equal(reason, "blocked via CNAME <x.doubleclick.net>")
+}
+
+func TestQTypeRules(t *testing.T) {
+	assert := assert.New(t)
+
+	var rf RegexpFilter
+	report := rf.readFilterList(&FilterList{Path: writeList(t, "^ads\\.$qtype=AAAA,HTTPS\n^ads\\.$qtype=HTTPS,AAAA\n^ads\\.\n^foo\\.$qtype=NOTATYPE\n"), CNAME: true}, DEFAULT_MAX_ERRORS)
+	assert.Equal(report.Loaded, 2)
+	assert.Equal(report.Duplicates, 1)
+	assert.Equal(report.Errors[0].Line, 4)
+	assert.Equal(rf.firstMatch("ads.foo.com", TYPE_AAAA).Rule, `^ads\.$qtype=AAAA,HTTPS`)
+	assert.Equal(rf.firstMatch("ads.foo.com", TYPE_A).Rule, `^ads\.`)
+
+	// rules limited to some query types are kept as regexes
+	rf = RegexpFilter{}
+	report = rf.readFilterList(&FilterList{Path: writeList(t, "tracker.com$qtype=A\nads*.example.org$qtype=HTTPS\n"), Format: LIST_DOMAINS, CNAME: true}, DEFAULT_MAX_ERRORS)
+	assert.Equal(report.Loaded, 2)
+	assert.Equal(rf.domains.len(), 0)
+	assert.True(rf.IsMatch("www.tracker.com", TYPE_A))
+	assert.False(rf.IsMatch("www.tracker.com", TYPE_AAAA))
+	assert.False(rf.IsMatch("mytracker.com", TYPE_A))
+	assert.True(rf.matchCNAME("ads1.example.org", 65))
+	assert.Equal(rf.firstMatch("ads1.example.org", 65).Rule, "ads*.example.org$qtype=HTTPS")
+
+	// the query type of the question is used for CNAME targets
+	var fd FilteredDomains
+	fd.init()
+	fd.blackList = rf
+	assert.False(fd.match("www.tracker.com", 0).Blocked)
+	assert.True(fd.isCNAMEFiltered("www.tracker.com", TYPE_A))
+	assert.False(fd.isCNAMEFiltered("www.tracker.com", TYPE_AAAA))
+
+	// domains blocked only for some query types
+	result := fd.match("www.tracker.com", TYPE_A)
+	assert.True(result.Blocked)
+	assert.True(result.TypeOnly)
+	msg := &DNSMessage{
+		Questions: []DNSQuestion{{Domain: "metrics.foo.com", QType: TYPE_A, QClass: CLASS_IN}},
+		Answers:   []DNSResourceRecord{{Name: "metrics.foo.com", Type: TYPE_CNAME, Class: CLASS_IN, RData: encodeDomainName("www.tracker.com")}},
+	}
+	reason, typeOnly := fd.isAnswerBlocked(msg)
+	assert.Equal(reason, "blocked via CNAME <www.tracker.com>")
+	assert.True(typeOnly)
+
+	fd.blackList.readFilterList(&FilterList{Path: writeList(t, "tracker.com\n"), Format: LIST_DOMAINS, CNAME: true}, DEFAULT_MAX_ERRORS)
+	assert.False(fd.match("www.tracker.com", TYPE_A).TypeOnly)
+	_, typeOnly = fd.isAnswerBlocked(msg)
+	assert.False(typeOnly)
+}
+
+func TestFilterListYAML(t *testing.T) {
+	assert := assert.New(t)
+
+	var lists []FilterList
+	err := yaml.Unmarshal([]byte("- ./tests/blacklist.1\n- path: ./tests/blacklist.2\n  cname: false\n"), &lists)
+	assert.Nil(err)
+
+	assert.Equal(lists, []FilterList{{Path: "./tests/blacklist.1", CNAME: true}, {Path: "./tests/blacklist.2", CNAME: false}})
+
+	err = yaml.Unmarshal([]byte("- path: ./tests/blacklist.1\n  max_errors: 0\n"), &lists)
+	assert.Nil(err)
+	assert.Equal(*lists[0].MaxErrors, 0)
+}
+
+func TestIsCNAMEFiltered(t *testing.T) {
+	assert := assert.New(t)
+
+	var fd FilteredDomains
+	fd.init()
+
+	fd.whiteList.readFilterFile("./tests/whitelist.1")
+	fd.blackList.readFilterList(&FilterList{Path: "./tests/blacklist.1", CNAME: true}, DEFAULT_MAX_ERRORS)
+	fd.blackList.readFilterList(&FilterList{Path: "./tests/blacklist.2", CNAME: false}, DEFAULT_MAX_ERRORS)
+
+	assert.True(fd.isCNAMEFiltered("analytics.tracker.com", TYPE_A))
+	assert.False(fd.isCNAMEFiltered("analytics.yandex.com", TYPE_A))
+	assert.False(fd.isCNAMEFiltered("www.foo.ru", TYPE_A))
+	assert.True(fd.match("www.foo.ru", 0).Blocked)
+
+	// an alias to a tracker is blocked
+	msg := &DNSMessage{
+		Answers: []DNSResourceRecord{
+			{Name: "metrics.foo.com", Type: TYPE_CNAME, Class: CLASS_IN, RData: encodeDomainName("foo.cdn.com")},
+			{Name: "foo.cdn.com", Type: TYPE_CNAME, Class: CLASS_IN, RData: encodeDomainName("stats.tracker.com")},
+			{Name: "stats.tracker.com", Type: TYPE_A, Class: CLASS_IN, RData: []byte{1, 2, 3, 4}},
+		},
+	}
+	reason, typeOnly := fd.isAnswerBlocked(msg)
+	assert.Equal(reason, "blocked via CNAME <stats.tracker.com>")
+	assert.False(typeOnly)
+
+	msg.Answers[1].RData = encodeDomainName("www.tracker.com")
+	reason, _ = fd.isAnswerBlocked(msg)
+	assert.Equal(reason, "")
+
+	// whatever the case of the target
+	msg.Answers[1].RData = encodeDomainName("Stats.Tracker.COM")
+	reason, _ = fd.isAnswerBlocked(msg)
+	assert.Equal(reason, "blocked via CNAME <stats.tracker.com>")
 }
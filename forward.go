@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// A forwarding rule as found in the YAML configuration file. Suffix is either a domain (e.g.: corp.example.com)
+// or a network (e.g.: 10.0.0.0/8) which is converted to the corresponding reverse zone
+type ForwarderConfig struct {
+	Suffix    string           `yaml:"suffix"`
+	Resolvers []ResolverConfig `yaml:"resolvers"`
+}
+
+// Queries for domains ending with suffix are sent to the upstreams of the rule
+type ForwardRule struct {
+	suffix    string     // lowercase domain suffix, without trailing dot
+	upstreams []Upstream // resolvers, tried in order
+}
+
+// All forwarding rules, sorted from the longest suffix to the shortest
+type Forwarders struct {
+	rules []ForwardRule
+}
+
+// Build forwarding rules from the YAML configuration. On error, the upstreams of the rules already built
+// are closed
+func (forwarders *Forwarders) init(rules []ForwarderConfig) error {
+	forwarders.rules = make([]ForwardRule, 0, len(rules))
+	fail := func(err error) error {
+		closeUpstreams(forwarders.upstreams())
+		forwarders.rules = nil
+		return err
+	}
+
+	for _, rule := range rules {
+		suffix, err := forwardSuffix(rule.Suffix)
+		if err != nil {
+			return fail(err)
+		}
+		if len(rule.Resolvers) == 0 {
+			return fail(fmt.Errorf("no resolver defined for suffix <%s>", rule.Suffix))
+		}
+
+		upstreams, err := newUpstreams(rule.Resolvers)
+		if err != nil {
+			return fail(err)
+		}
+		forwarders.rules = append(forwarders.rules, ForwardRule{suffix: suffix, upstreams: upstreams})
+	}
+
+	// longest suffixes first, so the first match is the most specific one
+	sort.SliceStable(forwarders.rules, func(i, j int) bool {
+		return len(forwarders.rules[i].suffix) > len(forwarders.rules[j].suffix)
+	})
+
+	return nil
+}
+
+// Return the upstreams to which a query for the domain has to be sent, nil if no rule matches
+func (forwarders *Forwarders) match(domain string) []Upstream {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	for _, rule := range forwarders.rules {
+		if rule.suffix == "" || domain == rule.suffix || strings.HasSuffix(domain, "."+rule.suffix) {
+			return rule.upstreams
+		}
+	}
+	return nil
+}
+
+// Return the upstreams of all rules
+func (forwarders *Forwarders) upstreams() []Upstream {
+	upstreams := make([]Upstream, 0)
+	for _, rule := range forwarders.rules {
+		upstreams = append(upstreams, rule.upstreams...)
+	}
+	return upstreams
+}
+
+// Release the connections kept open by the upstreams
+func closeUpstreams(upstreams []Upstream) {
+	for _, upstream := range upstreams {
+		upstream.close()
+	}
+}
+
+// Build a list of upstreams from their specifications. On error, the upstreams already built are closed
+func newUpstreams(resolvers []ResolverConfig) ([]Upstream, error) {
+	upstreams := make([]Upstream, 0, len(resolvers))
+
+	for _, resolver := range resolvers {
+		upstream, err := newUpstream(resolver)
+		if err != nil {
+			closeUpstreams(upstreams)
+			return nil, fmt.Errorf("resolver <%s>: %v", resolver.Address, err)
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// Convert the suffix of a rule to a lowercase domain. Networks are converted to their reverse zone
+func forwardSuffix(suffix string) (string, error) {
+	if !strings.Contains(suffix, "/") {
+		return strings.ToLower(strings.Trim(suffix, ".")), nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(suffix)
+	if err != nil {
+		return "", err
+	}
+	return reverseZone(ipNet)
+}
+
+// Build the reverse zone of a network. Prefix length must be on an octet boundary for IPv4 (e.g.: 10.in-addr.arpa
+// for 10.0.0.0/8) and a nibble boundary for IPv6
+func reverseZone(ipNet *net.IPNet) (string, error) {
+	ones, bits := ipNet.Mask.Size()
+
+	// number of labels to remove from the reverse name of the network address
+	var labelSize int
+	if bits == 32 {
+		labelSize = 8
+	} else {
+		labelSize = 4
+	}
+	if ones%labelSize != 0 {
+		return "", fmt.Errorf("prefix length of <%v> is not a multiple of %d", ipNet, labelSize)
+	}
+
+	labels := strings.Split(reverseName(ipNet.IP), ".")
+	return strings.Join(labels[(bits-ones)/labelSize:], "."), nil
+}
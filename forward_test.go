@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwarders(t *testing.T) {
+	assert := assert.New(t)
+
+	var forwarders Forwarders
+	err := forwarders.init([]ForwarderConfig{
+		{Suffix: "example.com", Resolvers: []ResolverConfig{{Address: "192.0.2.1"}}},
+		{Suffix: "Corp.Example.com.", Resolvers: []ResolverConfig{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}}},
+		{Suffix: "10.0.0.0/8", Resolvers: []ResolverConfig{{Address: "10.0.0.53"}}},
+	})
+	assert.Nil(err)
+
+	assert.Equal(forwarders.match("www.corp.example.com")[0].String(), "10.0.0.1:53")
+	assert.Equal(len(forwarders.match("CORP.example.com.")), 2)
+	assert.Equal(forwarders.match("www.example.com")[0].String(), "192.0.2.1:53")
+	assert.Equal(forwarders.match("4.3.2.10.in-addr.arpa")[0].String(), "10.0.0.53:53")
+	assert.Nil(forwarders.match("www.notcorp.example.org"))
+	assert.Nil(forwarders.match("fooexample.com"))
+
+	err = forwarders.init([]ForwarderConfig{{Suffix: "example.com"}})
+	assert.NotNil(err)
+	err = forwarders.init([]ForwarderConfig{{Suffix: "10.0.0.0/12", Resolvers: []ResolverConfig{{Address: "10.0.0.53"}}}})
+	assert.NotNil(err)
+
+	// rules built before an invalid one are dropped
+	err = forwarders.init([]ForwarderConfig{
+		{Suffix: "example.com", Resolvers: []ResolverConfig{{Address: "192.0.2.1"}}},
+		{Suffix: "corp.example.com", Resolvers: []ResolverConfig{{Address: "10.0.0.1"}, {Address: "tls://10.0.0.2", CAFile: "./tests/foo.pem"}}},
+	})
+	assert.NotNil(err)
+	assert.Nil(forwarders.match("www.example.com"))
+}
+
+func TestReverseZone(t *testing.T) {
+	assert := assert.New(t)
+
+	for cidr, expected := range map[string]string{"10.0.0.0/8": "10.in-addr.arpa", "192.168.1.0/24": "1.168.192.in-addr.arpa", "0.0.0.0/0": "in-addr.arpa", "2001:db8::/32": "8.b.d.0.1.0.0.2.ip6.arpa"} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		zone, err := reverseZone(ipNet)
+		assert.Nil(err)
+		assert.Equal(zone, expected)
+	}
+}
+
+func TestQueryResolverForwarding(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := new(Config)
+	err := conf.forwarders.init([]ForwarderConfig{{Suffix: "corp.example.com", Resolvers: []ResolverConfig{{Address: startUDPStandIn(t, answerWith("10.1.1.1"))}}}})
+	assert.Nil(err)
+
+	// first default resolver is not reachable
+	conf.resolvers = []Upstream{newUDPUpstream("127.0.0.1:1"), newUDPUpstream(startUDPStandIn(t, answerWith("1.1.1.1")))}
+
+	answer, _, err := queryResolver(buildQuery("www.corp.example.com", TYPE_A), "www.corp.example.com", conf, nil, false)
+	assert.Nil(err)
+	assert.Equal(firstAddress(answer), "10.1.1.1")
+
+	answer, _, err = queryResolver(buildQuery("www.example.com", TYPE_A), "www.example.com", conf, nil, false)
+	assert.Nil(err)
+	assert.Equal(firstAddress(answer), "1.1.1.1")
+}
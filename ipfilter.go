@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// When reading an IP blocklist, each line is either a single IP address or a CIDR range.
+// Single addresses are kept as /32 or /128 networks
+type IPFilter struct {
+	netList []*net.IPNet    // list of networks coming from the blocklist
+	ranges  map[string]bool // networks already loaded, to skip duplicates
+}
+
+// Read a blocklist with one IP address or CIDR range per line, using the default error budget
+func (filter *IPFilter) readFilterFile(filterFile string) *ListReport {
+	return filter.readFilterList(filterFile, DEFAULT_MAX_ERRORS)
+}
+
+// Read a blocklist with one IP address or CIDR range per line and add them to the IPFilter struct. Invalid
+// lines are skipped, unless there are more than maxErrors of them: the list is then rejected as a whole
+func (filter *IPFilter) readFilterList(filterFile string, maxErrors int) *ListReport {
+	if filter.ranges == nil {
+		filter.ranges = make(map[string]bool)
+	}
+
+	// networks are only added once the whole list is read
+	var netList []*net.IPNet
+	seen := make(map[string]bool)
+
+	report := readListFile(filterFile, maxErrors, func(line int, text string) error {
+		ipNet, err := parseIPNet(text)
+		if err != nil {
+			return err
+		}
+		if filter.ranges[ipNet.String()] || seen[ipNet.String()] {
+			return errDuplicateRule
+		}
+		seen[ipNet.String()] = true
+		netList = append(netList, ipNet)
+		return nil
+	})
+	if report.Err != nil {
+		return report
+	}
+
+	for _, ipNet := range netList {
+		filter.netList = append(filter.netList, ipNet)
+		filter.ranges[ipNet.String()] = true
+	}
+	return report
+}
+
+// Return the network matching the IP address if any, nil otherwise
+func (filter *IPFilter) match(ip net.IP) *net.IPNet {
+	for _, ipNet := range filter.netList {
+		if ipNet.Contains(ip) {
+			return ipNet
+		}
+	}
+	return nil
+}
+
+// Convert either a CIDR range or a single IP address to a network
+func parseIPNet(text string) (*net.IPNet, error) {
+	if strings.Contains(text, "/") {
+		_, ipNet, err := net.ParseCIDR(text)
+		return ipNet, err
+	}
+
+	ip := net.ParseIP(text)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: text}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
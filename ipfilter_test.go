@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadIPFilterFile(t *testing.T) {
+	assert := assert.New(t)
+
+	var ipf IPFilter
+	report := ipf.readFilterFile("./tests/ipblacklist.1")
+	assert.Nil(report.Err)
+	assert.Equal(len(ipf.netList), 4)
+
+	assert.NotNil(ipf.match(net.ParseIP("0.0.0.0")))
+	assert.NotNil(ipf.match(net.ParseIP("10.66.12.1")))
+	assert.NotNil(ipf.match(net.ParseIP("192.0.2.1")))
+	assert.NotNil(ipf.match(net.ParseIP("2001:db8:bad:1::1")))
+	assert.Nil(ipf.match(net.ParseIP("192.0.2.2")))
+	assert.Nil(ipf.match(net.ParseIP("10.67.0.1")))
+	assert.Nil(ipf.match(net.ParseIP("2001:db8:bae::1")))
+}
+
+func TestReadIPFilterErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	var ipf IPFilter
+	report := ipf.readFilterFile(writeList(t, "10.0.0.0/8\n10.1.2.3/8\nnot-an-ip\n192.0.2.1\n"))
+	assert.Nil(report.Err)
+	assert.Equal(report.Loaded, 2)
+	assert.Equal(report.Duplicates, 1)
+	assert.Equal(report.Errors[0].Line, 3)
+
+	// no invalid line allowed
+	report = ipf.readFilterList(writeList(t, "198.51.100.0/24\n300.1.2.3\n"), 0)
+	assert.NotNil(report.Err)
+	assert.Equal(len(ipf.netList), 2)
+}
+
+func TestParseIPNet(t *testing.T) {
+	assert := assert.New(t)
+
+	ipNet, err := parseIPNet("1.2.3.4")
+	assert.Nil(err)
+	assert.Equal(ipNet.String(), "1.2.3.4/32")
+
+	ipNet, err = parseIPNet("::1")
+	assert.Nil(err)
+	assert.Equal(ipNet.String(), "::1/128")
+
+	ipNet, err = parseIPNet("10.1.2.3/8")
+	assert.Nil(err)
+	assert.Equal(ipNet.String(), "10.0.0.0/8")
+
+	_, err = parseIPNet("foo")
+	assert.NotNil(err)
+}
+
+func TestIsAnswerFiltered(t *testing.T) {
+	assert := assert.New(t)
+
+	var fd FilteredDomains
+	fd.init()
+	fd.ipBlackList.readFilterFile("./tests/ipblacklist.1")
+
+	msg := &DNSMessage{
+		Answers: []DNSResourceRecord{
+			{Name: "www.foo.com", Type: TYPE_CNAME, Class: CLASS_IN, RData: encodeDomainName("foo.tracker.com")},
+			{Name: "foo.tracker.com", Type: TYPE_A, Class: CLASS_IN, RData: []byte{10, 66, 1, 1}},
+		},
+	}
+	ip, ipNet := fd.isAnswerFiltered(msg)
+	assert.Equal(ip.String(), "10.66.1.1")
+	assert.Equal(ipNet.String(), "10.66.0.0/16")
+
+	msg.Answers[1].RData = []byte{10, 67, 1, 1}
+	_, ipNet = fd.isAnswerFiltered(msg)
+	assert.Nil(ipNet)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// literals shorter than this are found in too many domains to be worth indexing
+const MIN_LITERAL_LENGTH = 3
+
+// Literal substrings of the regexes of a list, indexed with an Aho-Corasick automaton
+// (https://en.wikipedia.org/wiki/Aho%E2%80%93Corasick_algorithm). A regex can only match a text containing one
+// of its literals, so only the regexes whose literals are found in a domain are run. Regexes without any
+// literal are always run
+type literalIndex struct {
+	nodes  []literalNode // states of the automaton, the first one being the root
+	always []int         // regexes without literals
+	count  int           // number of regexes indexed
+}
+
+// A state of the automaton
+type literalNode struct {
+	next   map[byte]int32 // transitions to the next states
+	fail   int32          // state of the longest suffix which is also in the automaton
+	output []int          // regexes having a literal ending in this state, or in a state of the failure chain
+}
+
+// Build the index of the literals of the regexes. Literals are kept in lower case, as domains are matched
+// in lower case
+func newLiteralIndex(exprList []*regexp.Regexp) *literalIndex {
+	index := &literalIndex{nodes: []literalNode{{}}, count: len(exprList)}
+
+	for i, expr := range exprList {
+		literals := regexpLiterals(expr)
+		if literals == nil {
+			index.always = append(index.always, i)
+			continue
+		}
+		for _, literal := range literals {
+			state := index.insert(strings.ToLower(literal))
+			if output := index.nodes[state].output; len(output) == 0 || output[len(output)-1] != i {
+				index.nodes[state].output = append(output, i)
+			}
+		}
+	}
+
+	// failure links are found breadth first, as they lead to shallower states
+	queue := []int32{}
+	for _, child := range index.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) != 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, child := range index.nodes[state].next {
+			fail := index.nodes[state].fail
+			for {
+				if next, found := index.nodes[fail].next[c]; found {
+					index.nodes[child].fail = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = index.nodes[fail].fail
+			}
+			index.nodes[child].output = append(index.nodes[child].output, index.nodes[index.nodes[child].fail].output...)
+			queue = append(queue, child)
+		}
+	}
+
+	return index
+}
+
+// Add a literal to the automaton, and return its last state
+func (index *literalIndex) insert(literal string) int32 {
+	state := int32(0)
+	for i := 0; i < len(literal); i++ {
+		next, found := index.nodes[state].next[literal[i]]
+		if !found {
+			index.nodes = append(index.nodes, literalNode{})
+			next = int32(len(index.nodes) - 1)
+			if index.nodes[state].next == nil {
+				index.nodes[state].next = make(map[byte]int32)
+			}
+			index.nodes[state].next[literal[i]] = next
+		}
+		state = next
+	}
+	return state
+}
+
+// Return the regexes which might match the text, in ascending order. All regexes are returned for texts which
+// are not ASCII, as case folding of other characters is not handled
+func (index *literalIndex) candidates(text string) []int {
+	found := append([]int{}, index.always...)
+
+	state := int32(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c >= 0x80 {
+			return allRegexps(index.count)
+		}
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		for {
+			if next, ok := index.nodes[state].next[c]; ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = index.nodes[state].fail
+		}
+		found = append(found, index.nodes[state].output...)
+	}
+
+	// remove duplicates, for each regex to be run once
+	sort.Ints(found)
+	unique := found[:0]
+	for i, n := range found {
+		if i == 0 || n != found[i-1] {
+			unique = append(unique, n)
+		}
+	}
+	return unique
+}
+
+// Return the indexes of all the regexes of a list
+func allRegexps(count int) []int {
+	all := make([]int, count)
+	for i := range all {
+		all[i] = i
+	}
+	return all
+}
+
+// Return literals such that any text matched by the regex contains at least one of them, nil if there's none
+// long enough to be indexed
+func regexpLiterals(expr *regexp.Regexp) []string {
+	re, err := syntax.Parse(expr.String(), syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	literals := requiredLiterals(re.Simplify())
+	for _, literal := range literals {
+		if len(literal) < MIN_LITERAL_LENGTH {
+			return nil
+		}
+	}
+	return literals
+}
+
+// Return literals such that any text matched by the parsed regex contains at least one of them, nil if
+// there's none
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		literal := string(re.Rune)
+		for _, c := range re.Rune {
+			if c >= 0x80 {
+				return nil
+			}
+		}
+		return []string{literal}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min == 0 {
+			return nil
+		}
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpConcat:
+		// each part is matched, so the literals of any of them are required: the longest ones are kept
+		var best []string
+		subs := flattenConcat(re)
+		for i := 0; i < len(subs); i++ {
+			sub := subs[i]
+
+			// consecutive literals, e.g. coming from a repeat, are a single one
+			if sub.Op == syntax.OpLiteral {
+				merged := &syntax.Regexp{Op: syntax.OpLiteral, Flags: sub.Flags, Rune: sub.Rune}
+				for ; i+1 < len(subs) && subs[i+1].Op == syntax.OpLiteral && subs[i+1].Flags&syntax.FoldCase == sub.Flags&syntax.FoldCase; i++ {
+					merged.Rune = append(merged.Rune[:len(merged.Rune):len(merged.Rune)], subs[i+1].Rune...)
+				}
+				sub = merged
+			}
+
+			if literals := requiredLiterals(sub); literals != nil && (best == nil || betterLiterals(literals, best)) {
+				best = literals
+			}
+		}
+		return best
+	case syntax.OpAlternate:
+		// any part might be matched, so they all need literals
+		all := []string{}
+		for _, sub := range re.Sub {
+			literals := requiredLiterals(sub)
+			if literals == nil {
+				return nil
+			}
+			all = append(all, literals...)
+		}
+		return all
+	}
+	return nil
+}
+
+// Return the parts of a concatenation, the ones of nested concatenations included
+func flattenConcat(re *syntax.Regexp) []*syntax.Regexp {
+	if re.Op != syntax.OpConcat {
+		return []*syntax.Regexp{re}
+	}
+	subs := []*syntax.Regexp{}
+	for _, sub := range re.Sub {
+		subs = append(subs, flattenConcat(sub)...)
+	}
+	return subs
+}
+
+// Return true if the first set of literals is more selective than the second one: its shortest literal is longer,
+// or it has fewer literals
+func betterLiterals(literals []string, than []string) bool {
+	shortest := func(literals []string) int {
+		length := len(literals[0])
+		for _, literal := range literals[1:] {
+			length = min(length, len(literal))
+		}
+		return length
+	}
+	if a, b := shortest(literals), shortest(than); a != b {
+		return a > b
+	}
+	return len(literals) < len(than)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegexpLiterals(t *testing.T) {
+	assert := assert.New(t)
+
+	for expr, literals := range map[string][]string{
+		`^ads\.`:                                 {"ads."},
+		`^advert(s|is(ing|ements?))?[0-9]*[_.-]`: {"advert"},
+		`\.google(adservices|apis)\.com$`:        {".google"},
+		`^(doubleclick|adnxs)\.`:                 {"doubleclick", "adnxs"},
+		`(?i)^TRACK(ing)?[0-9]+`:                 {"TRACK"},
+		`(metrics)+\.`:                           {"metrics"},
+		`x{2}yz`:                                 {"xxyz"},
+		`^ad[0-9]*\.`:                            nil,
+		`^(ads|x)\.`:                             nil,
+		`^.*$`:                                   nil,
+		`(tracker)?\.com$`:                       {".com"},
+	} {
+		assert.Equal(regexpLiterals(regexp.MustCompile(expr)), literals, expr)
+	}
+}
+
+func TestLiteralIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	exprList := []*regexp.Regexp{
+		regexp.MustCompile(`^ads\.`),
+		regexp.MustCompile(`^ad[0-9]*\.`),
+		regexp.MustCompile(`(?i)TRACKER`),
+		regexp.MustCompile(`\.google(adservices|apis)\.com$`),
+		regexp.MustCompile(`ker\.net$`),
+	}
+	index := newLiteralIndex(exprList)
+
+	assert.Equal(index.candidates("www.foo.com"), []int{1})
+	assert.Equal(index.candidates("ads.foo.com"), []int{0, 1})
+	assert.Equal(index.candidates("www.Tracker.net"), []int{1, 2, 4})
+	assert.Equal(index.candidates("www.googleapis.com"), []int{1, 3})
+
+	// not ASCII: the Kelvin sign matches k when case is ignored
+	assert.True(exprList[2].MatchString("www.trac\u212aer.com"))
+	assert.Equal(index.candidates("www.trac\u212aer.com"), []int{0, 1, 2, 3, 4})
+}
+
+func TestLiteralIndexSameMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	var rf RegexpFilter
+	rf.readFilterFile("./tests/ads.txt")
+	rf.readFilterFile("./tests/blacklist.1")
+	rf.readFilterFile("./tests/blacklist.2")
+	assert.Equal(rf.index.count, len(rf.exprList))
+
+	// same answer as when running all the regexes
+	linear := rf
+	linear.index = nil
+	for _, domain := range []string{"adtracking.foo.com", "www.foo.com", "stats.foo.com", "ads.googlesyndication.com", "ads.googleapis.com",
+		"www.foo.ru", "mads.example.org", "pixel-1.foo.com", "analytics_foo.com", "count2.foo.com", "counter.foo.com"} {
+		assert.Equal(rf.IsMatch(domain, TYPE_A), linear.IsMatch(domain, TYPE_A), domain)
+		assert.Equal(rf.firstMatch(domain, TYPE_A), linear.firstMatch(domain, TYPE_A), domain)
+		assert.Equal(rf.matchCNAME(domain, TYPE_A), linear.matchCNAME(domain, TYPE_A), domain)
+	}
+}
+
+// Build a list of regexes looking like the ones of real lists
+func generateRegexps(n int) *RegexpFilter {
+	random := rand.New(rand.NewSource(1))
+	words := []string{"ads", "track", "stats", "pixel", "banner", "metrics", "beacon", "click", "promo", "telemetry"}
+
+	filter := new(RegexpFilter)
+	list := &FilterList{Path: "generated", CNAME: true}
+	for i := 0; i < n; i++ {
+		word := words[random.Intn(len(words))]
+		var expr string
+		switch i % 4 {
+		case 0:
+			expr = fmt.Sprintf(`^%s[0-9]*\.site%d\.com$`, word, i)
+		case 1:
+			expr = fmt.Sprintf(`\.%s%d\.(net|org)$`, word, i)
+		case 2:
+			expr = fmt.Sprintf(`^(%s|%s)-cdn%d\.`, word, words[random.Intn(len(words))], i)
+		default:
+			expr = fmt.Sprintf(`%s%d[_.-]`, word, i)
+		}
+		filter.addRegexp(regexp.MustCompile(expr), "", nil, list, i+1)
+	}
+	return filter
+}
+
+func BenchmarkRegexpFilter(b *testing.B) {
+	filter := generateRegexps(10000)
+	domains := []string{"www.example.com", "ads.site4.com", "cdn.track9997.net", "static.images.foo.org", "promo-cdn10.foo.com"}
+
+	// all regexes are run
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			filter.IsMatch(domains[i%len(domains)], TYPE_A)
+		}
+	})
+
+	// only the regexes with literals found in the domain are run
+	b.Run("prefilter", func(b *testing.B) {
+		filter.buildIndex()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			filter.IsMatch(domains[i%len(domains)], TYPE_A)
+		}
+	})
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TTL used for local records when none is given
+	DEFAULT_LOCAL_TTL = 3600
+
+	// maximum number of CNAMEs followed when answering from local records
+	MAX_CNAME_CHAIN = 8
+)
+
+// A record as defined in the local_records section of the YAML configuration file
+type LocalRecordConfig struct {
+	Name  string `yaml:"name"`  // owner name (e.g.: nas.home)
+	Type  string `yaml:"type"`  // one of A, AAAA, CNAME, TXT, PTR, SRV, MX
+	Value string `yaml:"value"` // data as found in a zone file (e.g.: "10 mail.home" for MX)
+	TTL   uint32 `yaml:"ttl"`   // optional TTL
+}
+
+// All records for which dnswall is answering authoritatively, either defined in the YAML configuration file
+// or read from zone files
+type LocalRecords struct {
+	records map[string][]DNSResourceRecord // records indexed by lowercase owner name
+	names   []string                       // lowercase owner names, in the order they were first added
+	zones   map[string]DNSResourceRecord   // SOA record of each zone read from a zone file, indexed by origin
+}
+
+// Allocate memory for the records
+func (local *LocalRecords) init() {
+	local.records = make(map[string][]DNSResourceRecord)
+	local.names = make([]string, 0)
+	local.zones = make(map[string]DNSResourceRecord)
+}
+
+// Add a record to the list of local records
+func (local *LocalRecords) add(rr DNSResourceRecord) {
+	name := strings.ToLower(rr.Name)
+	if _, found := local.records[name]; !found {
+		local.names = append(local.names, name)
+	}
+	local.records[name] = append(local.records[name], rr)
+
+	if rr.Type == TYPE_SOA {
+		local.zones[name] = rr
+	}
+}
+
+// Add all the records defined in the YAML configuration file
+func (local *LocalRecords) addConfig(records []LocalRecordConfig) error {
+	for _, record := range records {
+		ttl := record.TTL
+		if ttl == 0 {
+			ttl = DEFAULT_LOCAL_TTL
+		}
+
+		// a TXT value is a single string, possibly with spaces
+		rrType := strings.ToUpper(record.Type)
+		fields := strings.Fields(record.Value)
+		if rrType == "TXT" {
+			fields = []string{record.Value}
+		}
+
+		rr, err := newLocalRecord(record.Name, rrType, fields, ttl, "")
+		if err != nil {
+			return fmt.Errorf("local record <%s %s %s>: %v", record.Name, record.Type, record.Value, err)
+		}
+		local.add(rr)
+	}
+	return nil
+}
+
+// For each A or AAAA record, add the corresponding PTR record unless one is already defined. Records are taken in
+// the order they were added, for the PTR record of an address shared by several names to always be the same
+func (local *LocalRecords) synthesizePTR() {
+	// collect first, to not update the map while iterating over it
+	ptrs := make([]DNSResourceRecord, 0)
+
+	for _, owner := range local.names {
+		for _, rr := range local.records[owner] {
+			ip := rr.ip()
+			if ip == nil {
+				continue
+			}
+
+			name := reverseName(ip)
+			if _, found := local.records[name]; found {
+				continue
+			}
+			ptrs = append(ptrs, DNSResourceRecord{Name: name, Type: TYPE_PTR, Class: CLASS_IN, TTL: rr.TTL, RData: encodeDomainName(rr.Name)})
+		}
+	}
+
+	for _, ptr := range ptrs {
+		// several names for the same address: keep the first one added only
+		if _, found := local.records[ptr.Name]; !found {
+			local.add(ptr)
+		}
+	}
+}
+
+// Return the zone the domain is belonging to, if any
+func (local *LocalRecords) zone(domain string) (DNSResourceRecord, bool) {
+	for {
+		if soa, found := local.zones[domain]; found {
+			return soa, true
+		}
+
+		// try the parent domain
+		i := strings.Index(domain, ".")
+		if i == -1 {
+			return DNSResourceRecord{}, false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// Build the answer to the query if the domain is found in the local records. Return nil if the query
+// has to go through filtering and forwarding
+func (local *LocalRecords) answer(buffer []byte) []byte {
+	if len(local.records) == 0 {
+		return nil
+	}
+
+	query := new(DNSMessage)
+	if err := query.fromNetworkBytes(buffer); err != nil || len(query.Questions) != 1 {
+		return nil
+	}
+	question := query.Questions[0]
+	domain := strings.ToLower(question.Domain)
+
+	records, found := local.records[domain]
+	soa, inZone := local.zone(domain)
+
+	// names not found in the local records are only ours if they are belonging to a zone
+	if !found && !inZone {
+		return nil
+	}
+
+	if !found {
+		response := newResponse(query, RCODE_NXDOMAIN)
+		response.Header.Flags |= FLAG_AA
+		response.Authorities = append(response.Authorities, soa)
+		return response.toNetworkBytes()
+	}
+
+	response := newResponse(query, RCODE_NOERROR)
+	response.Header.Flags |= FLAG_AA
+
+	// follow CNAMEs as long as the target is a local name
+	for i := 0; i < MAX_CNAME_CHAIN; i++ {
+		var cname *DNSResourceRecord
+
+		for j, rr := range records {
+			switch {
+			case rr.Type == question.QType || question.QType == TYPE_ANY:
+				response.Answers = append(response.Answers, rr)
+			case rr.Type == TYPE_CNAME:
+				cname = &records[j]
+			}
+		}
+
+		if cname == nil || question.QType == TYPE_CNAME {
+			break
+		}
+		response.Answers = append(response.Answers, *cname)
+
+		if records, found = local.records[strings.ToLower(cname.target())]; !found {
+			break
+		}
+	}
+
+	// no data for this type
+	if len(response.Answers) == 0 && inZone {
+		response.Authorities = append(response.Authorities, soa)
+	}
+
+	return response.toNetworkBytes()
+}
+
+// Build a resource record from its textual representation, as found in zone files. Relative names
+// are completed with the origin
+func newLocalRecord(name string, rrType string, fields []string, ttl uint32, origin string) (DNSResourceRecord, error) {
+	rr := DNSResourceRecord{Name: absoluteName(name, origin), Class: CLASS_IN, TTL: ttl}
+	buf := new(bytes.Buffer)
+	if err := checkDomainName(rr.Name); err != nil {
+		return rr, err
+	}
+
+	// names found in RDATA are completed with the origin too
+	writeName := func(text string) error {
+		name := absoluteName(text, origin)
+		if err := checkDomainName(name); err != nil {
+			return err
+		}
+		buf.Write(encodeDomainName(name))
+		return nil
+	}
+
+	// check the number of fields expected for each type
+	expected := map[string]int{"A": 1, "AAAA": 1, "CNAME": 1, "NS": 1, "PTR": 1, "MX": 2, "SRV": 4, "SOA": 7}
+	if n, ok := expected[rrType]; ok && len(fields) != n {
+		return rr, fmt.Errorf("%d values expected for type %s, found %d", n, rrType, len(fields))
+	}
+
+	switch rrType {
+	case "A":
+		rr.Type = TYPE_A
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil {
+			return rr, fmt.Errorf("invalid IPv4 address <%s>", fields[0])
+		}
+		buf.Write(ip)
+	case "AAAA":
+		rr.Type = TYPE_AAAA
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil {
+			return rr, fmt.Errorf("invalid IPv6 address <%s>", fields[0])
+		}
+		buf.Write(ip.To16())
+	case "CNAME", "NS", "PTR":
+		rr.Type = map[string]uint16{"CNAME": TYPE_CNAME, "NS": TYPE_NS, "PTR": TYPE_PTR}[rrType]
+		if err := writeName(fields[0]); err != nil {
+			return rr, err
+		}
+	case "TXT":
+		rr.Type = TYPE_TXT
+		if len(fields) == 0 {
+			return rr, fmt.Errorf("no text found for type TXT")
+		}
+		// each string is a <character-string>, limited to 255 bytes
+		for _, text := range fields {
+			for {
+				chunk := text
+				if len(chunk) > 255 {
+					chunk = chunk[:255]
+				}
+				buf.WriteByte(byte(len(chunk)))
+				buf.WriteString(chunk)
+
+				text = text[len(chunk):]
+				if text == "" {
+					break
+				}
+			}
+		}
+	case "MX":
+		rr.Type = TYPE_MX
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return rr, fmt.Errorf("invalid MX preference <%s>", fields[0])
+		}
+		binary.Write(buf, binary.BigEndian, uint16(preference))
+		if err := writeName(fields[1]); err != nil {
+			return rr, err
+		}
+	case "SRV":
+		rr.Type = TYPE_SRV
+		// priority, weight and port
+		for _, field := range fields[:3] {
+			value, err := strconv.ParseUint(field, 10, 16)
+			if err != nil {
+				return rr, fmt.Errorf("invalid SRV value <%s>", field)
+			}
+			binary.Write(buf, binary.BigEndian, uint16(value))
+		}
+		if err := writeName(fields[3]); err != nil {
+			return rr, err
+		}
+	case "SOA":
+		rr.Type = TYPE_SOA
+		for _, field := range fields[:2] {
+			if err := writeName(field); err != nil {
+				return rr, err
+			}
+		}
+		// serial, refresh, retry, expire, minimum
+		for _, field := range fields[2:] {
+			value, err := parseTTL(field)
+			if err != nil {
+				return rr, fmt.Errorf("invalid SOA value <%s>", field)
+			}
+			binary.Write(buf, binary.BigEndian, value)
+		}
+	default:
+		return rr, fmt.Errorf("unsupported type <%s>", rrType)
+	}
+
+	rr.RData = buf.Bytes()
+	return rr, nil
+}
+
+// Complete a relative name with the origin. Absolute names are ending with a dot, and "@" is the origin itself
+func absoluteName(name string, origin string) string {
+	switch {
+	case name == "@":
+		return strings.TrimSuffix(origin, ".")
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "" || origin == ".":
+		return name
+	}
+	return name + "." + strings.TrimSuffix(origin, ".")
+}
+
+// Build the name used for reverse lookups of an IP address (e.g.: 4.3.2.1.in-addr.arpa for 1.2.3.4)
+func reverseName(ip net.IP) string {
+	labels := make([]string, 0, 34)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip4[i])))
+		}
+		return strings.Join(append(labels, "in-addr", "arpa"), ".")
+	}
+
+	// IPv6 is using nibbles: https://datatracker.ietf.org/doc/html/rfc3596#section-2.5
+	ip6 := ip.To16()
+	for i := len(ip6) - 1; i >= 0; i-- {
+		labels = append(labels, strconv.FormatUint(uint64(ip6[i]&0xF), 16), strconv.FormatUint(uint64(ip6[i]>>4), 16))
+	}
+	return strings.Join(append(labels, "ip6", "arpa"), ".")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Build a query for a single question
+func buildQuery(domain string, qtype uint16) []byte {
+	query := DNSMessage{
+		Header:    DNSPacketHeader{Id: 0x1234, Flags: FLAG_RD},
+		Questions: []DNSQuestion{{Domain: domain, QType: qtype, QClass: CLASS_IN}},
+	}
+	return query.toNetworkBytes()
+}
+
+// Send a query to the local records and decode the answer
+func askLocal(local *LocalRecords, domain string, qtype uint16) *DNSMessage {
+	buffer := local.answer(buildQuery(domain, qtype))
+	if buffer == nil {
+		return nil
+	}
+
+	msg := new(DNSMessage)
+	msg.fromNetworkBytes(buffer)
+	return msg
+}
+
+func TestLocalRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	var local LocalRecords
+	local.init()
+
+	err := local.addConfig([]LocalRecordConfig{
+		{Name: "printer.lan", Type: "A", Value: "192.168.1.20"},
+		{Name: "printer.lan", Type: "aaaa", Value: "fd00::20", TTL: 60},
+		{Name: "www.lan", Type: "CNAME", Value: "printer.lan"},
+		{Name: "lan", Type: "TXT", Value: "v=spf1 -all"},
+		{Name: "lan", Type: "MX", Value: "10 mail.lan"},
+	})
+	assert.Nil(err)
+
+	err = local.addConfig([]LocalRecordConfig{{Name: "foo.lan", Type: "A", Value: "fd00::1"}})
+	assert.NotNil(err)
+	err = local.addConfig([]LocalRecordConfig{{Name: "foo.lan", Type: "MX", Value: "mail.lan"}})
+	assert.NotNil(err)
+	err = local.addConfig([]LocalRecordConfig{{Name: "foo.lan", Type: "HINFO", Value: "foo"}})
+	assert.NotNil(err)
+
+	// names which can't be encoded
+	err = local.addConfig([]LocalRecordConfig{{Name: "foo.lan", Type: "CNAME", Value: strings.Repeat("a", 64) + ".lan"}})
+	assert.NotNil(err)
+	err = local.addConfig([]LocalRecordConfig{{Name: "foo..lan", Type: "A", Value: "192.168.1.21"}})
+	assert.NotNil(err)
+
+	local.synthesizePTR()
+	assert.Equal(local.records["20.1.168.192.in-addr.arpa"][0].target(), "printer.lan")
+
+	// A
+	msg := askLocal(&local, "Printer.LAN", TYPE_A)
+	assert.NotNil(msg)
+	assert.Equal(msg.Header.Id, uint16(0x1234))
+	assert.Equal(msg.Header.Flags&FLAG_AA, FLAG_AA)
+	assert.Equal(msg.Header.Flags&0xF, uint16(RCODE_NOERROR))
+	assert.Equal(len(msg.Answers), 1)
+	assert.Equal(msg.Answers[0].ip().String(), "192.168.1.20")
+	assert.Equal(msg.Answers[0].TTL, uint32(DEFAULT_LOCAL_TTL))
+
+	// CNAME is followed
+	msg = askLocal(&local, "www.lan", TYPE_AAAA)
+	assert.Equal(len(msg.Answers), 2)
+	assert.Equal(msg.Answers[0].target(), "printer.lan")
+	assert.Equal(msg.Answers[1].ip().String(), "fd00::20")
+
+	// TXT is a single string
+	msg = askLocal(&local, "lan", TYPE_TXT)
+	assert.Equal(msg.Answers[0].RData, append([]byte{11}, []byte("v=spf1 -all")...))
+
+	// synthesized PTR
+	msg = askLocal(&local, "0.2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", TYPE_PTR)
+	assert.Equal(msg.Answers[0].target(), "printer.lan")
+
+	// no data
+	msg = askLocal(&local, "printer.lan", TYPE_MX)
+	assert.Equal(len(msg.Answers), 0)
+	assert.Equal(msg.Header.Flags&0xF, uint16(RCODE_NOERROR))
+
+	// not a local name
+	assert.Nil(askLocal(&local, "foo.lan", TYPE_A))
+}
+
+func TestSynthesizePTRSharedAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	// the first name of the configuration is always the one of the address, whatever the order of the map
+	for i := 0; i < 20; i++ {
+		var local LocalRecords
+		local.init()
+		err := local.addConfig([]LocalRecordConfig{
+			{Name: "nas.lan", Type: "A", Value: "192.168.1.30"},
+			{Name: "backup.lan", Type: "A", Value: "192.168.1.31"},
+			{Name: "files.lan", Type: "A", Value: "192.168.1.30"},
+			{Name: "media.lan", Type: "A", Value: "192.168.1.30"},
+		})
+		assert.Nil(err)
+		local.synthesizePTR()
+
+		msg := askLocal(&local, "30.1.168.192.in-addr.arpa", TYPE_PTR)
+		assert.Equal(len(msg.Answers), 1)
+		assert.Equal(msg.Answers[0].target(), "nas.lan")
+	}
+}
+
+func TestLocalZone(t *testing.T) {
+	assert := assert.New(t)
+
+	var local LocalRecords
+	local.init()
+	err := local.readZoneFile("./tests/home.zone")
+	assert.Nil(err)
+
+	// names in a zone are ours even if not existing
+	msg := askLocal(&local, "foo.home", TYPE_A)
+	assert.Equal(msg.Header.Flags&0xF, uint16(RCODE_NXDOMAIN))
+	assert.Equal(len(msg.Authorities), 1)
+	assert.Equal(msg.Authorities[0].Type, TYPE_SOA)
+
+	msg = askLocal(&local, "files.home", TYPE_A)
+	assert.Equal(len(msg.Answers), 2)
+	assert.Equal(msg.Answers[1].ip().String(), "192.168.1.10")
+
+	msg = askLocal(&local, "mail.home", TYPE_TXT)
+	assert.Equal(len(msg.Answers), 0)
+	assert.Equal(len(msg.Authorities), 1)
+
+	assert.Nil(askLocal(&local, "foo.lan", TYPE_A))
+}
+
+func TestReverseName(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(reverseName(net.ParseIP("192.168.1.20")), "20.1.168.192.in-addr.arpa")
+	assert.Equal(reverseName(net.ParseIP("2001:db8::567:89ab")), "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa")
+}
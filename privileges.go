@@ -0,0 +1,10 @@
+package main
+
+// Settings used to drop root privileges once all listeners are bound, as found at the top level of the YAML
+// configuration file
+type PrivilegesConfig struct {
+	User      string `yaml:"user"`       // user name or ID to switch to
+	Group     string `yaml:"group"`      // group name or ID to switch to, primary group of the user if not set
+	Chroot    string `yaml:"chroot"`     // directory to confine dnswall to, files read afterwards must be inside
+	AllowRoot bool   `yaml:"allow_root"` // if true, dnswall can keep running as root
+}
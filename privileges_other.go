@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// Users, groups and chroot are only supported on Unix systems
+func dropPrivileges(settings *PrivilegesConfig) error {
+	if settings.User != "" || settings.Group != "" || settings.Chroot != "" {
+		return errors.New("user, group and chroot settings are not supported on this system")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Switch to the configured user and group, after entering the chroot directory if any. Users and groups are
+// looked up first, as the system databases are usually not reachable from the chroot. Running as root is an
+// error unless explicitly allowed
+func dropPrivileges(settings *PrivilegesConfig) error {
+	uid, gid := -1, -1
+
+	if settings.User != "" {
+		u, err := lookupUser(settings.User)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if settings.Group != "" {
+		g, err := lookupGroup(settings.Group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if settings.Chroot != "" {
+		if err := syscall.Chroot(settings.Chroot); err != nil {
+			return fmt.Errorf("unable to chroot to <%s>: %v", settings.Chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+		log.Printf("chrooted to <%s>", settings.Chroot)
+	}
+
+	// group first, as it can't be changed once the user is no longer root
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("unable to set supplementary groups: %v", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("unable to switch to group %d: %v", gid, err)
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("unable to switch to user %d: %v", uid, err)
+		}
+
+		// make sure there's no way back
+		if uid != 0 && syscall.Setuid(0) == nil {
+			return errors.New("root privileges can be regained after switching user")
+		}
+	}
+
+	if os.Geteuid() == 0 && !settings.AllowRoot {
+		return errors.New("refusing to run as root: set user, or allow_root if it's really wanted")
+	}
+	if uid != -1 || gid != -1 {
+		log.Printf("running as user %d and group %d", os.Geteuid(), os.Getegid())
+	}
+	return nil
+}
+
+// Find a user by name, or by ID if numeric
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// Find a group by name, or by ID if numeric
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupGroupId(name)
+	}
+	return user.LookupGroup(name)
+}
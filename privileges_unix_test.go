@@ -0,0 +1,60 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Drop privileges in a child process, as it can't be undone, and return what it printed
+func runDropPrivileges(t *testing.T, settings string) string {
+	cmd := exec.Command(os.Args[0], "-test.run=TestDropPrivilegesHelper")
+	cmd.Env = append(os.Environ(), "DNSWALL_PRIVILEGES="+settings)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	return string(output)
+}
+
+// Not a real test: the child process started by runDropPrivileges
+func TestDropPrivilegesHelper(t *testing.T) {
+	settings := os.Getenv("DNSWALL_PRIVILEGES")
+	if settings == "" {
+		t.Skip("only run as a child process")
+	}
+
+	fields := strings.Split(settings, ":")
+	err := dropPrivileges(&PrivilegesConfig{User: fields[0], Group: fields[1], Chroot: fields[2]})
+	_, statErr := os.Stat("/etc/passwd")
+	fmt.Printf("uid=%d gid=%d err=%v passwd=%v\n", os.Geteuid(), os.Getegid(), err, statErr == nil)
+	os.Exit(0)
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	assert := assert.New(t)
+
+	// running as root is refused unless allowed
+	assert.NotNil(dropPrivileges(&PrivilegesConfig{}))
+	assert.Nil(dropPrivileges(&PrivilegesConfig{AllowRoot: true}))
+
+	// unknown users or groups
+	assert.NotNil(dropPrivileges(&PrivilegesConfig{User: "no-such-user-here"}))
+	assert.NotNil(dropPrivileges(&PrivilegesConfig{User: "nobody", Group: "no-such-group-here"}))
+
+	// user and its primary group, or by ID
+	assert.Contains(runDropPrivileges(t, "nobody::"), "uid=65534 gid=65534 err=<nil> passwd=true")
+	assert.Contains(runDropPrivileges(t, "65534:0:"), "uid=65534 gid=0 err=<nil> passwd=true")
+
+	// files outside of the chroot are no longer reachable
+	assert.Contains(runDropPrivileges(t, "nobody::"+t.TempDir()), "uid=65534 gid=65534 err=<nil> passwd=false")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// modifier limiting a rule to some query types, e.g.: "^ads\.$qtype=AAAA,HTTPS"
+const QTYPE_MODIFIER = "$qtype="
+
+// Query types blocked or filtered whatever the domain, as found in the YAML configuration file
+type QTypesConfig struct {
+	Blocked  []string `yaml:"blocked"`  // queries of these types are always blocked, e.g.: ANY
+	Filtered []string `yaml:"filtered"` // if set, only queries of these types are matched against the lists
+}
+
+// Query types blocked or filtered whatever the domain
+type QTypePolicy struct {
+	blocked  map[uint16]bool
+	filtered map[uint16]bool // nil if queries of all types are filtered
+}
+
+// Build the policy from the YAML configuration
+func newQTypePolicy(settings QTypesConfig) (QTypePolicy, error) {
+	var policy QTypePolicy
+
+	blocked, err := parseQTypes(settings.Blocked)
+	if err != nil {
+		return policy, err
+	}
+	policy.blocked = make(map[uint16]bool)
+	for _, qtype := range blocked {
+		policy.blocked[qtype] = true
+	}
+
+	if len(settings.Filtered) != 0 {
+		filtered, err := parseQTypes(settings.Filtered)
+		if err != nil {
+			return policy, err
+		}
+		policy.filtered = make(map[uint16]bool)
+		for _, qtype := range filtered {
+			policy.filtered[qtype] = true
+		}
+	}
+	return policy, nil
+}
+
+// Return true if queries of this type are always blocked
+func (policy *QTypePolicy) isBlocked(qtype uint16) bool {
+	return policy.blocked[qtype]
+}
+
+// Return true if queries of this type are matched against the lists
+func (policy *QTypePolicy) isFiltered(qtype uint16) bool {
+	return policy.filtered == nil || policy.filtered[qtype]
+}
+
+// Split a rule from the query types it's limited to, if any. Nil query types means the rule applies to all of them
+func parseQTypeModifier(text string) (string, []uint16, error) {
+	i := strings.LastIndex(text, QTYPE_MODIFIER)
+	if i == -1 {
+		return text, nil, nil
+	}
+	if i == 0 {
+		return "", nil, errors.New("missing rule before the query types")
+	}
+
+	qtypes, err := parseQTypes(strings.Split(text[i+len(QTYPE_MODIFIER):], ","))
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSpace(text[:i]), qtypes, nil
+}
+
+// Convert query type names (e.g.: AAAA, HTTPS or TYPE65) to their values, sorted and without duplicates
+func parseQTypes(names []string) ([]uint16, error) {
+	qtypes := []uint16{}
+	for _, name := range names {
+		qtype, found := qTypeValue(strings.TrimSpace(name))
+		if !found || qtype == 0 {
+			return nil, fmt.Errorf("unknown query type <%s>", name)
+		}
+		if !hasQType(qtypes, qtype) {
+			qtypes = append(qtypes, qtype)
+		}
+	}
+	sort.Slice(qtypes, func(i, j int) bool { return qtypes[i] < qtypes[j] })
+	return qtypes, nil
+}
+
+// Return true if the query type is one of the list, or if the list is nil meaning all query types
+func hasQType(qtypes []uint16, qtype uint16) bool {
+	if qtypes == nil {
+		return true
+	}
+	for _, t := range qtypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Write the modifier back, as found after the rule in a list. Empty if the rule applies to all query types
+func qTypeModifier(qtypes []uint16) string {
+	if qtypes == nil {
+		return ""
+	}
+	names := []string{}
+	for _, qtype := range qtypes {
+		name := qType(qtype)
+		if name == "" || name == "Unassigned" {
+			name = fmt.Sprintf("TYPE%d", qtype)
+		}
+		names = append(names, name)
+	}
+	return QTYPE_MODIFIER + strings.Join(names, ",")
+}
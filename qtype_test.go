@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQTypeModifier(t *testing.T) {
+	assert := assert.New(t)
+
+	rule, qtypes, err := parseQTypeModifier(`^ads\.$qtype=https,AAAA,aaaa`)
+	assert.Nil(err)
+	assert.Equal(rule, `^ads\.`)
+	assert.Equal(qtypes, []uint16{TYPE_AAAA, 65})
+	assert.Equal(qTypeModifier(qtypes), "$qtype=AAAA,HTTPS")
+
+	// a regex might end with a $
+	rule, qtypes, err = parseQTypeModifier(`\.ru$`)
+	assert.Nil(err)
+	assert.Equal(rule, `\.ru$`)
+	assert.Nil(qtypes)
+	assert.Equal(qTypeModifier(qtypes), "")
+
+	for _, text := range []string{"$qtype=A", "ads.example.com$qtype=", "ads.example.com$qtype=NOTATYPE", "ads.example.com$qtype=TYPE0"} {
+		_, _, err = parseQTypeModifier(text)
+		assert.NotNil(err, text)
+	}
+}
+
+func TestQTypePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	policy, err := newQTypePolicy(QTypesConfig{})
+	assert.Nil(err)
+	assert.False(policy.isBlocked(TYPE_ANY))
+	assert.True(policy.isFiltered(TYPE_TXT))
+
+	policy, err = newQTypePolicy(QTypesConfig{Blocked: []string{"ANY"}, Filtered: []string{"A", "AAAA", "HTTPS"}})
+	assert.Nil(err)
+	assert.True(policy.isBlocked(TYPE_ANY))
+	assert.False(policy.isBlocked(TYPE_A))
+	assert.True(policy.isFiltered(TYPE_AAAA))
+	assert.False(policy.isFiltered(TYPE_TXT))
+
+	_, err = newQTypePolicy(QTypesConfig{Blocked: []string{"NOTATYPE"}})
+	assert.NotNil(err)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// possible actions for queries over the limit
+	RATE_LIMIT_REFUSED = "refused" // query is answered with REFUSED
+	RATE_LIMIT_DROP    = "drop"    // query is silently dropped
+
+	// default prefix lengths used to group clients
+	DEFAULT_IPV4_PREFIX = 24
+	DEFAULT_IPV6_PREFIX = 56
+
+	// default number of seconds between two logs of the counters
+	DEFAULT_RATE_LIMIT_LOG_INTERVAL = 60
+
+	// number of clients listed in the counters log
+	RATE_LIMIT_TOP_CLIENTS = 10
+)
+
+// Settings of the rate limiting, as found in the YAML configuration file. Each client IP address has its own
+// token bucket, and so has each network prefix, to also catch clients spreading queries over many addresses
+type RateLimitConfig struct {
+	QPS         float64  `yaml:"qps"`          // queries per second allowed for a single address, 0 means no rate limiting
+	Burst       int      `yaml:"burst"`        // queries allowed at once for a single address, qps if not set
+	PrefixQPS   float64  `yaml:"prefix_qps"`   // queries per second allowed for a whole prefix, 0 means no limit per prefix
+	PrefixBurst int      `yaml:"prefix_burst"` // queries allowed at once for a whole prefix, prefix_qps if not set
+	IPv4Prefix  int      `yaml:"ipv4_prefix"`  // length of IPv4 prefixes, 24 by default
+	IPv6Prefix  int      `yaml:"ipv6_prefix"`  // length of IPv6 prefixes, 56 by default
+	Action      string   `yaml:"action"`       // refused (default) or drop
+	Exempt      []string `yaml:"exempt"`       // addresses or CIDR ranges never limited
+	LogInterval int      `yaml:"log_interval"` // number of seconds between two logs of the counters
+}
+
+// A token bucket: tokens are added at a constant rate, up to the burst, and each query takes one
+type tokenBucket struct {
+	tokens float64   // tokens left
+	last   time.Time // last time tokens were added
+}
+
+// Check the rate of queries of each client
+type RateLimiter struct {
+	settings    RateLimitConfig
+	exempt      IPFilter      // clients never limited
+	ipv4Mask    net.IPMask    // mask giving the prefix of an IPv4 address
+	ipv6Mask    net.IPMask    // mask giving the prefix of an IPv6 address
+	logInterval time.Duration // time between two logs of the counters
+
+	mu        sync.Mutex              // protects the fields below
+	clients   map[string]*tokenBucket // buckets of single addresses
+	prefixes  map[string]*tokenBucket // buckets of prefixes
+	lastSweep time.Time               // last time full buckets were removed
+	lastLog   time.Time               // last time counters were logged
+	allowed   uint64                  // number of queries allowed since the last log
+	limited   uint64                  // number of queries over the limit since the last log
+	offenders map[string]uint64       // number of queries over the limit per address since the last log
+}
+
+// Allocate a new rate limiter. Nil is returned if rate limiting is not configured
+func newRateLimiter(settings RateLimitConfig) (*RateLimiter, error) {
+	if settings.QPS <= 0 && settings.PrefixQPS <= 0 {
+		return nil, nil
+	}
+
+	// default values
+	settings.Action = strings.ToLower(settings.Action)
+	switch settings.Action {
+	case "":
+		settings.Action = RATE_LIMIT_REFUSED
+	case RATE_LIMIT_REFUSED, RATE_LIMIT_DROP:
+	default:
+		return nil, fmt.Errorf("unknown rate limit action <%s>", settings.Action)
+	}
+	// buckets hold at least one token, for queries to be allowed at all when the rate is below one per second
+	if settings.Burst <= 0 {
+		settings.Burst = max(1, int(settings.QPS+0.5))
+	}
+	if settings.PrefixBurst <= 0 {
+		settings.PrefixBurst = max(1, int(settings.PrefixQPS+0.5))
+	}
+	if settings.IPv4Prefix == 0 {
+		settings.IPv4Prefix = DEFAULT_IPV4_PREFIX
+	}
+	if settings.IPv6Prefix == 0 {
+		settings.IPv6Prefix = DEFAULT_IPV6_PREFIX
+	}
+	if settings.IPv4Prefix < 0 || settings.IPv4Prefix > 32 || settings.IPv6Prefix < 0 || settings.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid rate limit prefix lengths /%d and /%d", settings.IPv4Prefix, settings.IPv6Prefix)
+	}
+	if settings.LogInterval <= 0 {
+		settings.LogInterval = DEFAULT_RATE_LIMIT_LOG_INTERVAL
+	}
+
+	limiter := &RateLimiter{
+		settings:    settings,
+		ipv4Mask:    net.CIDRMask(settings.IPv4Prefix, 32),
+		ipv6Mask:    net.CIDRMask(settings.IPv6Prefix, 128),
+		logInterval: time.Duration(settings.LogInterval) * time.Second,
+		clients:     make(map[string]*tokenBucket),
+		prefixes:    make(map[string]*tokenBucket),
+		offenders:   make(map[string]uint64),
+		lastSweep:   time.Now(),
+		lastLog:     time.Now(),
+	}
+
+	for _, text := range settings.Exempt {
+		ipNet, err := parseIPNet(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exempt client <%s>: %v", text, err)
+		}
+		limiter.exempt.netList = append(limiter.exempt.netList, ipNet)
+	}
+
+	return limiter, nil
+}
+
+// Return true if the query from the requester is within the limits
+func (limiter *RateLimiter) allow(requesterAddress net.Addr) bool {
+	ip := addressIP(requesterAddress)
+	if ip == nil {
+		return true
+	}
+	return limiter.allowAt(ip, time.Now())
+}
+
+// Return true if a query from the IP address at the given time is within the limits. Both the address and
+// its prefix buckets must have a token left, but a token is only taken if the query is allowed
+func (limiter *RateLimiter) allowAt(ip net.IP, now time.Time) bool {
+	if limiter.exempt.match(ip) != nil {
+		return true
+	}
+
+	client := ip.String()
+	prefix := networkPrefix(ip, limiter.ipv4Mask, limiter.ipv6Mask)
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.sweep(now)
+	limiter.logCounters(now)
+
+	var clientBucket, prefixBucket *tokenBucket
+	if limiter.settings.QPS > 0 {
+		clientBucket = refill(limiter.clients, client, limiter.settings.QPS, limiter.settings.Burst, now)
+	}
+	if limiter.settings.PrefixQPS > 0 {
+		prefixBucket = refill(limiter.prefixes, prefix, limiter.settings.PrefixQPS, limiter.settings.PrefixBurst, now)
+	}
+
+	if (clientBucket != nil && clientBucket.tokens < 1) || (prefixBucket != nil && prefixBucket.tokens < 1) {
+		limiter.limited++
+		limiter.offenders[client]++
+		return false
+	}
+
+	if clientBucket != nil {
+		clientBucket.tokens--
+	}
+	if prefixBucket != nil {
+		prefixBucket.tokens--
+	}
+	limiter.allowed++
+	return true
+}
+
+// Return the bucket of the key after adding the tokens earned since its last use. New buckets are full
+func refill(buckets map[string]*tokenBucket, key string, qps float64, burst int, now time.Time) *tokenBucket {
+	bucket, found := buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		buckets[key] = bucket
+		return bucket
+	}
+
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * qps
+		if bucket.tokens > float64(burst) {
+			bucket.tokens = float64(burst)
+		}
+		bucket.last = now
+	}
+	return bucket
+}
+
+// Remove the buckets which would be full by now, as new ones are created full. It's done once per log
+// interval to keep the memory bounded
+func (limiter *RateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < limiter.logInterval {
+		return
+	}
+	limiter.lastSweep = now
+
+	for _, buckets := range []struct {
+		buckets map[string]*tokenBucket
+		qps     float64
+		burst   int
+	}{{limiter.clients, limiter.settings.QPS, limiter.settings.Burst}, {limiter.prefixes, limiter.settings.PrefixQPS, limiter.settings.PrefixBurst}} {
+		for key, bucket := range buckets.buckets {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*buckets.qps >= float64(buckets.burst) {
+				delete(buckets.buckets, key)
+			}
+		}
+	}
+}
+
+// Log the counters if some queries were limited during the last interval, then reset them
+func (limiter *RateLimiter) logCounters(now time.Time) {
+	if now.Sub(limiter.lastLog) < limiter.logInterval {
+		return
+	}
+
+	if limiter.limited != 0 {
+		log.Printf("rate limiting: %d queries allowed, %d %s during the last %v, most limited clients: %s",
+			limiter.allowed, limiter.limited, limiter.settings.Action, now.Sub(limiter.lastLog).Round(time.Second), limiter.topOffenders())
+	}
+
+	limiter.lastLog = now
+	limiter.allowed, limiter.limited = 0, 0
+	limiter.offenders = make(map[string]uint64)
+}
+
+// List the clients with the most limited queries, with their counter
+func (limiter *RateLimiter) topOffenders() string {
+	clients := make([]string, 0, len(limiter.offenders))
+	for client := range limiter.offenders {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if limiter.offenders[clients[i]] != limiter.offenders[clients[j]] {
+			return limiter.offenders[clients[i]] > limiter.offenders[clients[j]]
+		}
+		return clients[i] < clients[j]
+	})
+	if len(clients) > RATE_LIMIT_TOP_CLIENTS {
+		clients = clients[:RATE_LIMIT_TOP_CLIENTS]
+	}
+
+	list := make([]string, 0, len(clients))
+	for _, client := range clients {
+		list = append(list, fmt.Sprintf("%s (%d)", client, limiter.offenders[client]))
+	}
+	return strings.Join(list, ", ")
+}
+
+// Return the network of the IP address, as a CIDR range, using the mask matching its family
+func networkPrefix(ip net.IP, ipv4Mask net.IPMask, ipv6Mask net.IPMask) string {
+	mask := ipv6Mask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, ipv4Mask
+	}
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// Return the IP address of a requester, nil if unknown
+func addressIP(address net.Addr) net.IP {
+	switch addr := address.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter, err := newRateLimiter(RateLimitConfig{QPS: 2, Burst: 5, Exempt: []string{"192.168.1.0/24", "::1"}})
+	assert.Nil(err)
+
+	// burst is allowed at once, then tokens come back at the given rate
+	now := time.Now()
+	client := net.ParseIP("10.0.0.1")
+	for i := 0; i < 5; i++ {
+		assert.True(limiter.allowAt(client, now))
+	}
+	assert.False(limiter.allowAt(client, now))
+	assert.False(limiter.allowAt(client, now.Add(400*time.Millisecond)))
+	assert.True(limiter.allowAt(client, now.Add(500*time.Millisecond)))
+	assert.False(limiter.allowAt(client, now.Add(500*time.Millisecond)))
+
+	// no more than the burst after a long time
+	later := now.Add(time.Minute)
+	for i := 0; i < 5; i++ {
+		assert.True(limiter.allowAt(client, later))
+	}
+	assert.False(limiter.allowAt(client, later))
+
+	// other clients have their own bucket
+	assert.True(limiter.allowAt(net.ParseIP("10.0.0.2"), later))
+
+	// exempt clients
+	for i := 0; i < 20; i++ {
+		assert.True(limiter.allowAt(net.ParseIP("192.168.1.20"), later))
+		assert.True(limiter.allowAt(net.ParseIP("::1"), later))
+	}
+
+	// counters were reset when logged a minute later
+	assert.Equal(limiter.offenders["10.0.0.1"], uint64(1))
+	assert.Equal(limiter.topOffenders(), "10.0.0.1 (1)")
+}
+
+func TestRateLimiterPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter, err := newRateLimiter(RateLimitConfig{QPS: 10, PrefixQPS: 1, PrefixBurst: 3})
+	assert.Nil(err)
+
+	// clients of the same /24 share the prefix bucket
+	now := time.Now()
+	assert.True(limiter.allowAt(net.ParseIP("10.0.0.1"), now))
+	assert.True(limiter.allowAt(net.ParseIP("10.0.0.2"), now))
+	assert.True(limiter.allowAt(net.ParseIP("10.0.0.3"), now))
+	assert.False(limiter.allowAt(net.ParseIP("10.0.0.4"), now))
+	assert.True(limiter.allowAt(net.ParseIP("10.0.1.1"), now))
+
+	// same for a /56
+	assert.True(limiter.allowAt(net.ParseIP("2001:db8:0:1::1"), now))
+	assert.True(limiter.allowAt(net.ParseIP("2001:db8:0:2::1"), now))
+	assert.True(limiter.allowAt(net.ParseIP("2001:db8:0:ff::1"), now))
+	assert.False(limiter.allowAt(net.ParseIP("2001:db8:0:ff::2"), now))
+	assert.True(limiter.allowAt(net.ParseIP("2001:db8:0:100::1"), now))
+
+	// a limited query doesn't take a token from the client bucket
+	assert.Equal(limiter.clients["10.0.0.4"].tokens, float64(10))
+
+	// full buckets are forgotten
+	limiter.sweep(now.Add(2 * limiter.logInterval))
+	assert.Equal(len(limiter.clients), 0)
+	assert.Equal(len(limiter.prefixes), 0)
+}
+
+func TestRateLimiterConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter, err := newRateLimiter(RateLimitConfig{})
+	assert.Nil(err)
+	assert.Nil(limiter)
+
+	limiter, _ = newRateLimiter(RateLimitConfig{QPS: 20})
+	assert.Equal(limiter.settings.Burst, 20)
+	assert.Equal(limiter.settings.Action, RATE_LIMIT_REFUSED)
+	assert.Equal(limiter.settings.IPv4Prefix, DEFAULT_IPV4_PREFIX)
+	assert.Equal(limiter.settings.IPv6Prefix, DEFAULT_IPV6_PREFIX)
+
+	// a query every 5 seconds
+	limiter, _ = newRateLimiter(RateLimitConfig{QPS: 0.2, PrefixQPS: 0.2})
+	assert.Equal(limiter.settings.Burst, 1)
+	assert.Equal(limiter.settings.PrefixBurst, 1)
+	now := time.Now()
+	client := net.ParseIP("10.0.0.1")
+	assert.True(limiter.allowAt(client, now))
+	assert.False(limiter.allowAt(client, now.Add(time.Second)))
+	assert.True(limiter.allowAt(client, now.Add(6*time.Second)))
+
+	_, err = newRateLimiter(RateLimitConfig{QPS: 20, Action: "foo"})
+	assert.NotNil(err)
+	_, err = newRateLimiter(RateLimitConfig{QPS: 20, IPv4Prefix: 33})
+	assert.NotNil(err)
+	_, err = newRateLimiter(RateLimitConfig{QPS: 20, Exempt: []string{"foo"}})
+	assert.NotNil(err)
+}
+
+func TestHandleDNSRequestRateLimited(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := newTestConfig(t)
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5353}
+
+	for _, action := range []string{RATE_LIMIT_REFUSED, RATE_LIMIT_DROP} {
+		conf.rateLimiter, _ = newRateLimiter(RateLimitConfig{QPS: 1, Burst: 1, Action: action})
+
+		writer := new(bufferResponseWriter)
+		handleDNSRequest(writer, client, buildQuery("printer.lan", TYPE_A), conf)
+		assert.Equal(firstAddress(writer.buffer), "192.168.1.20")
+
+		writer = new(bufferResponseWriter)
+		handleDNSRequest(writer, client, buildQuery("printer.lan", TYPE_A), conf)
+		if action == RATE_LIMIT_REFUSED {
+			assert.Equal(rcode(writer.buffer), byte(RCODE_REFUSED))
+		} else {
+			assert.Nil(writer.buffer)
+		}
+	}
+}
@@ -1,19 +1,68 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"strings"
 )
 
 const (
 	DEFAULT_BUFFER_SIZE = 2048
+
+	// possible actions when a domain is blocked
+	BLOCK_NXDOMAIN = "nxdomain" // domain doesn't exist
+	BLOCK_REFUSED  = "refused"  // query is refused
+	BLOCK_NODATA   = "nodata"   // domain exists but without any record
+	BLOCK_NULL     = "null"     // domain resolves to 0.0.0.0 or ::
+
+	// TTL of the records sent back when using the null block action
+	BLOCK_TTL = 60
+
+	// Extended DNS Error sent back with blocked answers (https://datatracker.ietf.org/doc/html/rfc8914)
+	EDNS_OPTION_EDE = 15
+	EDE_BLOCKED     = 15
 )
 
-// This functions is call by the UDP server to server requests
-func handleDNSRequest(conn *net.UDPConn, requesterAddress net.Addr, buffer []byte, conf *Config) {
-	//defer conf.mu.Unlock()
+// Where answers are written back to requesters: the UDP server itself, or a wrapper around a connection
+// for the other transports
+type ResponseWriter interface {
+	WriteTo(buffer []byte, requesterAddress net.Addr) (int, error)
+}
+
+// This functions is call by the UDP, TCP, DoT and DoH servers to serve requests
+func handleDNSRequest(conn ResponseWriter, requesterAddress net.Addr, buffer []byte, conf *Config) {
+	// queries received once shutdown has started are ignored
+	if !conf.inflight.start() {
+		return
+	}
+	defer conf.inflight.done()
+
+	// the configuration is not replaced by a reload while the query is processed
+	conf.mu.RLock()
+	defer conf.mu.RUnlock()
+
+	// answers to UDP clients are rate limited, as their address can be spoofed
+	_, overUDP := conn.(*net.UDPConn)
+	if overUDP && conf.responseLimiter != nil {
+		conn = &rrlResponseWriter{conn: conn, limiter: conf.responseLimiter}
+	}
+
+	// clients sending too many queries are refused or ignored, before any other work is done
+	if conf.rateLimiter != nil && !conf.rateLimiter.allow(requesterAddress) {
+		if conf.debug {
+			log.Printf("query from <%v> is over the rate limit", requesterAddress)
+		}
+		if conf.rateLimiter.settings.Action == RATE_LIMIT_REFUSED {
+			if response, err := blockResponse(buffer, BLOCK_REFUSED, ""); err == nil {
+				conn.WriteTo(response, requesterAddress)
+			}
+		}
+		return
+	}
 
 	// get DNS question from initial request
 	question, err := getDomainQuestion(buffer, conf)
@@ -22,26 +71,100 @@ func handleDNSRequest(conn *net.UDPConn, requesterAddress net.Addr, buffer []byt
 	}
 	log.Printf("received request <%s> for domain: <%s> for requester: <%v>", qType(question.QType), question.Domain, requesterAddress)
 
+	// local records are answered first, whatever the filters
+	if response := conf.localRecords.answer(buffer); response != nil {
+		_, err = conn.WriteTo(response, requesterAddress)
+		if err != nil {
+			log.Printf("error: <%v> when writing local answer to DNS requester", err)
+			return
+		}
+		log.Printf("domain <%s> answered from local records", question.Domain)
+		return
+	}
+
+	// some query types (e.g.: ANY) are blocked whatever the domain
+	if conf.qtypes.isBlocked(question.QType) && !conf.dontFilter {
+		reason := fmt.Sprintf("query type %s is blocked", qType(question.QType))
+		err = rejectDomain(conn, buffer, requesterAddress, conf.blockActionFor(true), reason)
+		if err != nil {
+			return
+		}
+		log.Printf("domain <%s> is blacklisted: %s", question.Domain, reason)
+		return
+	}
+
+	// names are matched whatever their case, as resolvers answer them
+	domain := strings.ToLower(strings.TrimSuffix(question.Domain, "."))
+
+	// only queries of some types might be matched against the lists
+	filtering := !conf.dontFilter && conf.qtypes.isFiltered(question.QType)
+
 	// if domain name is in the whitelist => pass
 	// if not, if in blacklist => reject
 	// otherwise => pass
-	//conf.mu.Lock()
-	if conf.filters.isFiltered(question.Domain) && !conf.dontFilter {
-		err = rejectDomain(conn, buffer, requesterAddress)
+	if result := conf.filters.match(domain, question.QType); result.Blocked && filtering {
+		// the rule is given to the client, but not where it's coming from
+		err = rejectDomain(conn, buffer, requesterAddress, conf.blockActionFor(result.TypeOnly), "rule <"+result.Block.Rule+">")
 		if err != nil {
 			return
 		}
-		log.Printf("domain <%s> is blacklisted", question.Domain)
+		log.Printf("domain <%s> is blacklisted: %v", question.Domain, result)
+		return
+	} else if result.Allow != nil && result.Block != nil {
+		log.Printf("domain <%s> is %v", question.Domain, result)
+	}
+
+	// rewritten domains are answered with synthesized records instead of being forwarded, unless nothing is filtered
+	if rule := conf.filters.rewrites.match(domain); rule != nil && !conf.dontFilter {
+		response, err := rewriteResponse(buffer, rule, conf, requesterAddress, overUDP)
+		if err != nil {
+			log.Printf("error: <%v> when rewriting domain <%s>", err, question.Domain)
+			return
+		}
+
+		// the target might be blocked, or resolve into blocked ranges
+		if filtering && !conf.filters.whiteList.IsMatch(domain, question.QType) {
+			if reason, typeOnly := conf.filters.isAnswerBlocked(response); reason != "" {
+				err = rejectDomain(conn, buffer, requesterAddress, conf.blockActionFor(typeOnly), reason)
+				if err != nil {
+					return
+				}
+				log.Printf("domain <%s> is rewritten to <%s> by %v, but blacklisted: %s", question.Domain, rule.targets(), rule, reason)
+				return
+			}
+		}
+
+		_, err = conn.WriteTo(response.toNetworkBytes(), requesterAddress)
+		if err != nil {
+			log.Printf("error: <%v> when writing rewritten answer to DNS requester", err)
+			return
+		}
+		log.Printf("domain <%s> is rewritten to <%s> by %v", question.Domain, rule.targets(), rule)
 		return
 	}
-	//conf.mu.Unlock()
 
 	// send question to resolver and wait for its answer
-	answerBuffer, nbReadBytes, err := queryResolver(buffer, conf, requesterAddress)
+	answerBuffer, nbReadBytes, err := queryResolver(buffer, domain, conf, requesterAddress, overUDP)
 	if err != nil {
 		return
 	}
 
+	// domain might be an alias to a blocked domain or resolve into blocked IP ranges, unless it's whitelisted
+	if filtering && !conf.filters.whiteList.IsMatch(domain, question.QType) {
+		answer := new(DNSMessage)
+		err = answer.fromNetworkBytes(answerBuffer[:nbReadBytes])
+		if err != nil {
+			log.Printf("error: <%v> when converting resolver answer to DNS message", err)
+		} else if reason, typeOnly := conf.filters.isAnswerBlocked(answer); reason != "" {
+			err = rejectDomain(conn, buffer, requesterAddress, conf.blockActionFor(typeOnly), reason)
+			if err != nil {
+				return
+			}
+			log.Printf("domain <%s> is blacklisted: %s", question.Domain, reason)
+			return
+		}
+	}
+
 	// send back answer coming from resolver to requester
 	nbWrittenBytes, err := conn.WriteTo(answerBuffer[:nbReadBytes], requesterAddress)
 	if err != nil {
@@ -92,51 +215,140 @@ func getDomainQuestion(buffer []byte, conf *Config) (*DNSQuestion, error) {
 	return question, nil
 }
 
-// Send request to resolver and wait for request
-func queryResolver(buffer []byte, conf *Config, requesterAddress net.Addr) ([]byte, int, error) {
-	// open connection to DNS resolver
-	conn, err := net.Dial("udp", conf.resolverAddress)
-	if err != nil {
-		log.Printf("error: <%v> when connecting to DNS resolver: <%s>", conf.resolverAddress, err)
-		return nil, 0, err
+// Send request to the resolvers selected for the domain and wait for the answer. Resolvers are tried in order
+// until one of them answers. Truncated answers are sent again over TCP, unless the query came over UDP: the
+// client then retries over TCP itself
+func queryResolver(buffer []byte, domain string, conf *Config, requesterAddress net.Addr, overUDP bool) ([]byte, int, error) {
+	// forwarding rules take precedence over default resolvers
+	upstreams := conf.forwarders.match(domain)
+	if upstreams == nil {
+		upstreams = conf.resolvers
+	}
+	if len(upstreams) == 0 {
+		log.Printf("error: no DNS resolver for domain <%s>", domain)
+		return nil, 0, errors.New("no DNS resolver")
 	}
 
-	// forward DNS request coming from client to the resolver
-	nbWrittenBytes, err := conn.Write(buffer)
+	var err error
+	for _, upstream := range upstreams {
+		var answerBuffer []byte
+
+		// forward DNS request coming from client to the resolver and wait for its answer
+		answerBuffer, err = upstream.exchange(buffer)
+		if err != nil {
+			log.Printf("error: <%v> when querying DNS resolver: <%s>", err, upstream)
+			continue
+		}
+		if fallback, ok := upstream.(TCPFallbackUpstream); ok && !overUDP && binary.BigEndian.Uint16(answerBuffer[2:4])&FLAG_TC != 0 {
+			answerBuffer, err = fallback.exchangeTCP(buffer)
+			if err != nil {
+				log.Printf("error: <%v> when querying DNS resolver: <%s> over TCP", err, upstream)
+				continue
+			}
+		}
+		if conf.debug {
+			log.Printf("%v bytes read from resolver <%s> on behalf of <%s>", len(answerBuffer), upstream, requesterAddress)
+		}
+
+		return answerBuffer, len(answerBuffer), nil
+	}
+
+	return nil, 0, err
+}
+
+// Return the block action of a blocked query. When only its type is blocked, the domain exists for other types:
+// a NODATA is sent, as a NXDOMAIN would deny them all (https://datatracker.ietf.org/doc/html/rfc8020)
+func (conf *Config) blockActionFor(typeOnly bool) string {
+	if typeOnly {
+		return BLOCK_NODATA
+	}
+	return conf.blockAction
+}
+
+// Respond to the requester according to the block action, by default a NXDOMAIN to mean domain is not existing.
+// The reason is sent back as an Extended DNS Error to clients using EDNS
+func rejectDomain(conn ResponseWriter, buffer []byte, requesterAddress net.Addr, action string, reason string) error {
+	response, err := blockResponse(buffer, action, reason)
 	if err != nil {
-		log.Printf("error: <%v> when writing to DNS resolver", err)
-		return nil, 0, err
+		log.Printf("error: <%v> when building blocked response", err)
+		return err
 	}
-	if conf.debug {
-		log.Printf("%v bytes sent to resolver on behalf of <%s>", nbWrittenBytes, requesterAddress)
+
+	// send back answer to requester
+	_, err = conn.WriteTo(response, requesterAddress)
+	if err != nil {
+		log.Printf("error: <%v> when writing blocked response to DNS requester", err)
+		return err
 	}
+	return nil
+}
 
-	// wait for answer from resolver
-	answerBuffer := make([]byte, DEFAULT_BUFFER_SIZE)
-	nbReadBytes, err := bufio.NewReader(conn).Read(answerBuffer)
+// Build the response sent back for a blocked query, depending on the block action. If not empty, the reason
+// is added as the extra text of a "Blocked" Extended DNS Error when the client uses EDNS
+func blockResponse(buffer []byte, action string, reason string) ([]byte, error) {
+	query := new(DNSMessage)
+	err := query.fromNetworkBytes(buffer)
 	if err != nil {
-		log.Printf("error: <%v> when reading from DNS resolver", err)
-		return nil, 0, err
+		return nil, err
 	}
-	if conf.debug {
-		log.Printf("%v bytes read from resolver on behalf of <%s>", nbReadBytes, requesterAddress)
+
+	var response DNSMessage
+	switch action {
+	case BLOCK_REFUSED:
+		response = newResponse(query, RCODE_REFUSED)
+	case BLOCK_NODATA:
+		response = newResponse(query, RCODE_NOERROR)
+	case BLOCK_NULL:
+		response = newResponse(query, RCODE_NOERROR)
+
+		// answer with the unspecified address for A and AAAA questions, nothing for the others
+		for _, question := range query.Questions {
+			rr := DNSResourceRecord{Name: question.Domain, Type: question.QType, Class: question.QClass, TTL: BLOCK_TTL}
+			switch question.QType {
+			case TYPE_A:
+				rr.RData = net.IPv4zero.To4()
+			case TYPE_AAAA:
+				rr.RData = net.IPv6zero
+			default:
+				continue
+			}
+			response.Answers = append(response.Answers, rr)
+		}
+	default:
+		response = newResponse(query, RCODE_NXDOMAIN)
 	}
 
-	return answerBuffer, nbReadBytes, nil
+	for i := range response.Additionals {
+		if rr := &response.Additionals[i]; rr.Type == TYPE_OPT && reason != "" {
+			rr.RData = extendedError(EDE_BLOCKED, reason)
+		}
+	}
+
+	return response.toNetworkBytes(), nil
 }
 
-// Respond with a NXDOMAIN to the requester to mean domain is not existing
-func rejectDomain(conn *net.UDPConn, buffer []byte, requesterAddress net.Addr) error {
-	// set flags: QR =1 (it's a response) and RCODE to 3 = NXDOMAIN
-	// flags is at index 2 and 3 in the buffer
-	buffer[2] |= 0b1000_0000 // set QR = Response = 1
-	buffer[3] |= 0b1000_0011 // set RCODE = NXDOMAIN
+// Build an empty response to the query, with the question copied and the given RCODE
+func newResponse(query *DNSMessage, rcode uint16) DNSMessage {
+	// keep OpCode and RD from the query, set QR = Response = 1 and RA = 1
+	response := DNSMessage{Header: query.Header, Questions: query.Questions}
+	response.Header.Flags = query.Header.Flags&0b0111_1001_0000_0000 | FLAG_QR | FLAG_RA | rcode
 
-	// send back answer coming from resolver to requester
-	_, err := conn.WriteTo(buffer, requesterAddress)
-	if err != nil {
-		log.Printf("error: <%v> when writing NXDOMAIN DNS requester", err)
-		return err
+	// if client uses EDNS, answer with an OPT record too (https://datatracker.ietf.org/doc/html/rfc6891#section-7)
+	for _, rr := range query.Additionals {
+		if rr.Type == TYPE_OPT {
+			response.Additionals = append(response.Additionals, DNSResourceRecord{Type: TYPE_OPT, Class: DEFAULT_BUFFER_SIZE})
+			break
+		}
 	}
-	return nil
+
+	return response
+}
+
+// Build an Extended DNS Error option, as found in the RDATA of an OPT record
+func extendedError(infoCode uint16, text string) []byte {
+	option := make([]byte, 6, 6+len(text))
+	binary.BigEndian.PutUint16(option[0:], EDNS_OPTION_EDE)
+	binary.BigEndian.PutUint16(option[2:], uint16(2+len(text)))
+	binary.BigEndian.PutUint16(option[4:], infoCode)
+	return append(option, text...)
 }
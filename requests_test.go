@@ -3,6 +3,7 @@ package main
 import (
 	//"fmt"
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"testing"
@@ -30,12 +31,12 @@ func TestQueryResolver(t *testing.T) {
 	query := []byte{0xbd, 0x73, 0x01, 0x20, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x77, 0x77, 0x77, 0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00, 0x01, 0x00, 0x01}
 
 	options := new(Config)
-	options.resolverAddress = "8.8.8.8:53"
+	options.resolvers = []Upstream{newUDPUpstream("8.8.8.8:53")}
 	addr := net.UDPAddr{
 		IP: net.ParseIP("0.0.0.0"),
 	}
 
-	buffer, _, err := queryResolver(query, options, &addr)
+	buffer, _, err := queryResolver(query, "www.google.com", options, &addr, true)
 	assert.Nil(err)
 
 	// define a new reader
@@ -52,3 +53,128 @@ func TestQueryResolver(t *testing.T) {
 	assert.Equal(flags.RCODE, byte(0))
 
 }
+
+func TestBlockResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	// a query for www.google.com A with an EDNS OPT record
+	buffer := []byte{0x30, 0x5c, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x03, 0x77, 0x77, 0x77, 0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00, 0x01, 0x00, 0x01,
+		0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+	for action, rcode := range map[string]byte{BLOCK_NXDOMAIN: RCODE_NXDOMAIN, BLOCK_REFUSED: RCODE_REFUSED, BLOCK_NODATA: RCODE_NOERROR, BLOCK_NULL: RCODE_NOERROR} {
+		response, err := blockResponse(buffer, action, "")
+		assert.Nil(err)
+
+		msg := new(DNSMessage)
+		err = msg.fromNetworkBytes(response)
+		assert.Nil(err)
+
+		flags := new(DNSPacketFlags)
+		flags.fromNetworkBytes(msg.Header.Flags)
+		assert.Equal(msg.Header.Id, uint16(0x305c))
+		assert.Equal(flags.QR, byte(1))
+		assert.True(flags.RD)
+		assert.Equal(flags.RCODE, rcode, action)
+		assert.Equal(msg.Questions[0].Domain, "www.google.com")
+		assert.Equal(len(msg.Additionals), 1)
+		assert.Equal(msg.Additionals[0].Type, TYPE_OPT)
+
+		if action == BLOCK_NULL {
+			assert.Equal(len(msg.Answers), 1)
+			assert.Equal(msg.Answers[0].ip().String(), "0.0.0.0")
+		} else {
+			assert.Equal(len(msg.Answers), 0)
+		}
+	}
+}
+
+// A configuration for tests, with local records, blocklists and a local stand-in as resolver
+func newTestConfig(t *testing.T) *Config {
+	conf := new(Config)
+	conf.blockAction = BLOCK_NXDOMAIN
+	conf.filters.init()
+	conf.filters.blackList.readFilterFile("./tests/blacklist.1")
+	conf.localRecords.init()
+	conf.localRecords.addConfig([]LocalRecordConfig{{Name: "printer.lan", Type: "A", Value: "192.168.1.20"}})
+	conf.resolvers = []Upstream{newUDPUpstream(startUDPStandIn(t, answerWith("1.2.3.4")))}
+	return conf
+}
+
+// Decode the RCODE of an answer
+func rcode(buffer []byte) byte {
+	flags := new(DNSPacketFlags)
+	flags.fromNetworkBytes(binary.BigEndian.Uint16(buffer[2:4]))
+	return flags.RCODE
+}
+
+func TestBlockResponseExtendedError(t *testing.T) {
+	assert := assert.New(t)
+
+	// a query for www.google.com A with an EDNS OPT record
+	buffer := []byte{0x30, 0x5c, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x03, 0x77, 0x77, 0x77, 0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00, 0x01, 0x00, 0x01,
+		0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+	response, err := blockResponse(buffer, BLOCK_NXDOMAIN, "rule <google>")
+	assert.Nil(err)
+
+	msg := new(DNSMessage)
+	err = msg.fromNetworkBytes(response)
+	assert.Nil(err)
+	assert.Equal(msg.Additionals[0].RData, append([]byte{0x00, 0x0f, 0x00, 0x0f, 0x00, 0x0f}, "rule <google>"...))
+
+	// no OPT record in the query, no room for the reason
+	buffer[11] = 0
+	response, err = blockResponse(buffer[:32], BLOCK_NXDOMAIN, "rule <google>")
+	assert.Nil(err)
+	err = msg.fromNetworkBytes(response)
+	assert.Nil(err)
+	assert.Equal(len(msg.Additionals), 0)
+}
+
+func TestHandleDNSRequestExtendedError(t *testing.T) {
+	assert := assert.New(t)
+
+	query := new(DNSMessage)
+	query.fromNetworkBytes(buildQuery("adtracking.foo.com", TYPE_A))
+	query.Additionals = []DNSResourceRecord{{Type: TYPE_OPT, Class: DEFAULT_BUFFER_SIZE}}
+
+	writer := new(bufferResponseWriter)
+	handleDNSRequest(writer, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, query.toNetworkBytes(), newTestConfig(t))
+
+	// only the rule is sent, not the list it's coming from
+	msg := new(DNSMessage)
+	assert.Nil(msg.fromNetworkBytes(writer.buffer))
+	assert.Equal(msg.Additionals[0].RData, extendedError(EDE_BLOCKED, `rule <^adtrack(er|ing)?[0-9]*[_.-]>`))
+}
+
+func TestHandleDNSRequestCase(t *testing.T) {
+	assert := assert.New(t)
+
+	// names are matched against the lists whatever their case
+	writer := new(bufferResponseWriter)
+	handleDNSRequest(writer, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, buildQuery("ADTracking.Foo.COM", TYPE_A), newTestConfig(t))
+	assert.Equal(rcode(writer.buffer), byte(RCODE_NXDOMAIN))
+
+	// and so are CNAME targets in answers
+	conf := newTestConfig(t)
+	conf.resolvers = []Upstream{newUDPUpstream(startUDPStandIn(t, func(query []byte) []byte {
+		msg := new(DNSMessage)
+		msg.fromNetworkBytes(query)
+		response := newResponse(msg, RCODE_NOERROR)
+		response.Answers = []DNSResourceRecord{
+			{Name: msg.Questions[0].Domain, Type: TYPE_CNAME, Class: CLASS_IN, TTL: 60, RData: encodeDomainName("Stats.Tracker.COM")},
+			{Name: "Stats.Tracker.COM", Type: TYPE_A, Class: CLASS_IN, TTL: 60, RData: []byte{1, 2, 3, 4}},
+		}
+		return response.toNetworkBytes()
+	}))}
+	writer = new(bufferResponseWriter)
+	handleDNSRequest(writer, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, buildQuery("metrics.foo.com", TYPE_A), conf)
+	assert.Equal(rcode(writer.buffer), byte(RCODE_NXDOMAIN))
+
+	// globs of regex lists too, as names are lowercased before being matched
+	conf = newTestConfig(t)
+	conf.filters.blackList.readFilterFile(writeList(t, "*.doubleclick.net\n"))
+	writer = new(bufferResponseWriter)
+	handleDNSRequest(writer, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, buildQuery("X.DoubleClick.NET", TYPE_A), conf)
+	assert.Equal(rcode(writer.buffer), byte(RCODE_NXDOMAIN))
+}
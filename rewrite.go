@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TTL of the records synthesized for rewritten domains
+const REWRITE_TTL = 300
+
+// A domain rewritten either to another domain, through a CNAME record, or to fixed addresses
+type RewriteRule struct {
+	Domain string      // domain rewritten, "*.example.com" meaning all the subdomains of example.com
+	Target string      // domain the rewritten one is an alias of, empty if it's rewritten to addresses
+	IPs    []net.IP    // addresses the domain is rewritten to
+	List   *FilterList // list holding the rule
+	Line   int         // line number of the rule in the list file, starting at 1
+}
+
+// What the domain is rewritten to, as written in the list
+func (rule *RewriteRule) targets() string {
+	if rule.Target != "" {
+		return rule.Target
+	}
+	ips := []string{}
+	for _, ip := range rule.IPs {
+		ips = append(ips, ip.String())
+	}
+	return strings.Join(ips, " ")
+}
+
+// Describe the rule and its origin, as used in logs
+func (rule *RewriteRule) String() string {
+	match := RuleMatch{List: rule.List, Line: rule.Line, Rule: rule.Domain + " " + rule.targets()}
+	return match.String()
+}
+
+// Domains answered with synthesized records instead of being forwarded, read from lists with one rule per line:
+// either "DOMAIN TARGET" (e.g.: "www.youtube.com restrict.youtube.com") or "DOMAIN IP [IP...]"
+type RewriteRules struct {
+	rules   []*RewriteRule          // rules in the order they were read
+	domains map[string]*RewriteRule // rules indexed by domain
+}
+
+// Number of rules loaded
+func (rewrites *RewriteRules) len() int {
+	return len(rewrites.rules)
+}
+
+// Add a rule, once its list is read
+func (rewrites *RewriteRules) add(rule *RewriteRule) {
+	if rewrites.domains == nil {
+		rewrites.domains = make(map[string]*RewriteRule)
+	}
+	rewrites.rules = append(rewrites.rules, rule)
+	rewrites.domains[rule.Domain] = rule
+}
+
+// Read a list of rewrite rules. Addresses of a domain can be given on several lines. A domain already rewritten
+// by a previous list is skipped, as is a domain rewritten both to another domain and to addresses
+func (rewrites *RewriteRules) readRewriteList(list *FilterList, maxErrors int) *ListReport {
+	if list.MaxErrors != nil {
+		maxErrors = *list.MaxErrors
+	}
+
+	// rules are only added once the whole list is read
+	var rules []*RewriteRule
+	seen := make(map[string]*RewriteRule)
+
+	report := readListFile(list.Path, maxErrors, func(line int, text string) error {
+		domain, target, ips, err := parseRewriteLine(text)
+		if err != nil {
+			return err
+		}
+		if rewrites.domains[domain] != nil {
+			return errDuplicateRule
+		}
+
+		rule := seen[domain]
+		switch {
+		case rule == nil:
+			rule = &RewriteRule{Domain: domain, Target: target, IPs: ips, List: list, Line: line}
+			seen[domain] = rule
+			rules = append(rules, rule)
+			return nil
+		case rule.Target != target:
+			return fmt.Errorf("conflicting rewrite for <%s>, already rewritten at line %d", domain, rule.Line)
+		case target != "":
+			return errDuplicateRule
+		}
+
+		// more addresses for the same domain
+		added := false
+		for _, ip := range ips {
+			if !containsIP(rule.IPs, ip) {
+				rule.IPs = append(rule.IPs, ip)
+				added = true
+			}
+		}
+		if !added {
+			return errDuplicateRule
+		}
+		return nil
+	})
+	if report.Err != nil {
+		return report
+	}
+
+	for _, rule := range rules {
+		rewrites.add(rule)
+	}
+	return report
+}
+
+// Return the rule rewriting the domain, nil if there's none. A domain is matched by its own rule first, then by
+// the "*." rule of its closest parent domain
+func (rewrites *RewriteRules) match(domain string) *RewriteRule {
+	if len(rewrites.domains) == 0 {
+		return nil
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	rule := rewrites.domains[domain]
+	for parent := domain; rule == nil; {
+		i := strings.Index(parent, ".")
+		if i == -1 {
+			return nil
+		}
+		parent = parent[i+1:]
+		rule = rewrites.domains["*."+parent]
+	}
+
+	// the target of a "*." rule might be one of the subdomains, which is not rewritten to itself
+	if rule.Target == domain {
+		return nil
+	}
+	return rule
+}
+
+// Get the domain of a rewrite line and what it's rewritten to: either another domain, or addresses
+func parseRewriteLine(text string) (string, string, []net.IP, error) {
+	if i := strings.Index(text, "#"); i != -1 {
+		text = text[:i]
+	}
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return "", "", nil, fmt.Errorf("invalid rewrite line <%s>", text)
+	}
+
+	// a domain and its subdomains would be rewritten to the same target, so only "*." globs are accepted
+	domain, err := parseDomainPattern(fields[0])
+	if err != nil {
+		return "", "", nil, err
+	}
+	if globRegexp(domain) != "" {
+		return "", "", nil, fmt.Errorf("only domains and \"*.\" globs can be rewritten, found <%s>", fields[0])
+	}
+
+	if len(fields) == 2 && net.ParseIP(fields[1]) == nil {
+		target, err := parseDomain(fields[1])
+		if err != nil {
+			return "", "", nil, err
+		}
+		if target == domain {
+			return "", "", nil, fmt.Errorf("domain <%s> is rewritten to itself", domain)
+		}
+		return domain, target, nil, nil
+	}
+
+	ips := []net.IP{}
+	for _, field := range fields[1:] {
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return "", "", nil, &net.ParseError{Type: "IP address", Text: field}
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if !containsIP(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return domain, "", ips, nil
+}
+
+// Return true if the address is one of the list
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Build the answer to a query for a rewritten domain: either the addresses of the rule matching the query type,
+// or a CNAME record to the target followed by the answer of the resolvers for the target. It's filtered as
+// answers of the resolvers are
+func rewriteResponse(buffer []byte, rule *RewriteRule, conf *Config, requesterAddress net.Addr, overUDP bool) (*DNSMessage, error) {
+	query := new(DNSMessage)
+	if err := query.fromNetworkBytes(buffer); err != nil {
+		return nil, err
+	}
+	if len(query.Questions) != 1 {
+		return nil, errors.New("a single question is expected")
+	}
+	question := query.Questions[0]
+
+	// no data for other types than A and AAAA
+	if rule.Target == "" {
+		response := newResponse(query, RCODE_NOERROR)
+		for _, ip := range rule.IPs {
+			rr := DNSResourceRecord{Name: question.Domain, Type: TYPE_AAAA, Class: CLASS_IN, TTL: REWRITE_TTL, RData: ip.To16()}
+			if ip4 := ip.To4(); ip4 != nil {
+				rr.Type, rr.RData = TYPE_A, ip4
+			}
+			if rr.Type == question.QType || question.QType == TYPE_ANY {
+				response.Answers = append(response.Answers, rr)
+			}
+		}
+		return &response, nil
+	}
+
+	cname := DNSResourceRecord{Name: question.Domain, Type: TYPE_CNAME, Class: CLASS_IN, TTL: REWRITE_TTL, RData: encodeDomainName(rule.Target)}
+	if question.QType == TYPE_CNAME {
+		response := newResponse(query, RCODE_NOERROR)
+		response.Answers = append(response.Answers, cname)
+		return &response, nil
+	}
+
+	// the target is resolved as if it was the question of the client
+	targetQuery := *query
+	targetQuery.Questions = []DNSQuestion{{Domain: rule.Target, QType: question.QType, QClass: question.QClass}}
+	answerBuffer, nbReadBytes, err := queryResolver(targetQuery.toNetworkBytes(), rule.Target, conf, requesterAddress, overUDP)
+	if err != nil {
+		return nil, err
+	}
+	answer := new(DNSMessage)
+	if err := answer.fromNetworkBytes(answerBuffer[:nbReadBytes]); err != nil {
+		return nil, err
+	}
+
+	response := newResponse(query, answer.Header.Flags&0x000F)
+	response.Answers = append([]DNSResourceRecord{cname}, answer.Answers...)
+	response.Authorities = answer.Authorities
+	return &response, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRewriteLine(t *testing.T) {
+	assert := assert.New(t)
+
+	domain, target, ips, err := parseRewriteLine("WWW.YouTube.com. restrict.youtube.com # SafeSearch")
+	assert.Nil(err)
+	assert.Equal(domain, "www.youtube.com")
+	assert.Equal(target, "restrict.youtube.com")
+	assert.Nil(ips)
+
+	domain, target, ips, err = parseRewriteLine("*.dev.internal 10.0.0.6 2001:db8::6 10.0.0.6")
+	assert.Nil(err)
+	assert.Equal(domain, "*.dev.internal")
+	assert.Equal(target, "")
+	assert.Equal(ips, []net.IP{net.ParseIP("10.0.0.6").To4(), net.ParseIP("2001:db8::6")})
+
+	for _, text := range []string{"api.internal", "ads*.example.com 10.0.0.1", "api.internal 10.0.0.1 foo.com", "api.internal api.internal", "api.internal bad domain"} {
+		_, _, _, err = parseRewriteLine(text)
+		assert.NotNil(err, text)
+	}
+}
+
+func TestReadRewriteList(t *testing.T) {
+	assert := assert.New(t)
+
+	var rewrites RewriteRules
+	report := rewrites.readRewriteList(&FilterList{Path: "./tests/rewrite.1"}, DEFAULT_MAX_ERRORS)
+	assert.Nil(report.Err)
+	assert.Equal(report.Loaded, 8)
+	assert.Equal(rewrites.len(), 7)
+	assert.Equal(rewrites.match("api.internal").targets(), "10.0.0.5 2001:db8::5")
+	assert.Equal(rewrites.match("WWW.Google.com.").Target, "forcesafesearch.google.com")
+	assert.Equal(rewrites.match("www.youtube.com").String(), "rule <www.youtube.com restrict.youtube.com> of list <./tests/rewrite.1> at line 5")
+	assert.Nil(rewrites.match("google.com"))
+	assert.Nil(rewrites.match("restrict.youtube.com"))
+
+	// "*." rules only match subdomains
+	assert.Equal(rewrites.match("a.b.dev.internal").Line, 11)
+	assert.Nil(rewrites.match("dev.internal"))
+
+	// a domain rewritten by a previous list, or twice in the same list
+	report = rewrites.readRewriteList(&FilterList{Path: writeList(t, "api.internal 10.0.0.7\nfoo.internal foo.com\nfoo.internal 10.0.0.8\nfoo.internal foo.com\n")}, DEFAULT_MAX_ERRORS)
+	assert.Equal(report.Loaded, 1)
+	assert.Equal(report.Duplicates, 2)
+	assert.Equal(report.Errors[0].Line, 3)
+	assert.Equal(rewrites.match("api.internal").Line, 9)
+
+	// the target of a "*." rule is not rewritten to itself
+	report = rewrites.readRewriteList(&FilterList{Path: writeList(t, "*.example.com www.example.com\n")}, DEFAULT_MAX_ERRORS)
+	assert.Nil(report.Err)
+	assert.Equal(rewrites.match("foo.example.com").Target, "www.example.com")
+	assert.Nil(rewrites.match("www.example.com"))
+}
+
+func TestRewriteResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := newTestConfig(t)
+	conf.filters.rewrites.readRewriteList(&FilterList{Path: "./tests/rewrite.1"}, DEFAULT_MAX_ERRORS)
+	rewrite := func(domain string, qtype uint16) *DNSMessage {
+		response, err := rewriteResponse(buildQuery(domain, qtype), conf.filters.rewrites.match(domain), conf, nil, false)
+		assert.Nil(err)
+		msg := new(DNSMessage)
+		assert.Nil(msg.fromNetworkBytes(response.toNetworkBytes()))
+		return msg
+	}
+
+	// addresses of the type of the question
+	msg := rewrite("api.internal", TYPE_AAAA)
+	assert.Equal(msg.Header.Id, uint16(0x1234))
+	assert.Equal(len(msg.Answers), 1)
+	assert.Equal(msg.Answers[0].ip(), net.ParseIP("2001:db8::5"))
+	assert.Equal(len(rewrite("api.internal", TYPE_ANY).Answers), 2)
+	assert.Equal(len(rewrite("api.internal", TYPE_TXT).Answers), 0)
+
+	// CNAME to the target, resolved upstream
+	msg = rewrite("www.google.com", TYPE_A)
+	assert.Equal(len(msg.Answers), 2)
+	assert.Equal(msg.Answers[0].Name, "www.google.com")
+	assert.Equal(msg.Answers[0].target(), "forcesafesearch.google.com")
+	assert.Equal(msg.Answers[1].Name, "forcesafesearch.google.com")
+	assert.Equal(msg.Answers[1].ip().String(), "1.2.3.4")
+
+	msg = rewrite("www.google.com", TYPE_CNAME)
+	assert.Equal(len(msg.Answers), 1)
+}
@@ -3,12 +3,46 @@
 package main
 
 import (
-	//"bytes"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
 	"strings"
+)
 
-	//"fmt"
-	"io"
+const (
+	DNS_HEADER_SIZE = 12
+
+	// RR types used throughout the code. See qType() for the whole list
+	TYPE_A     uint16 = 1
+	TYPE_NS    uint16 = 2
+	TYPE_CNAME uint16 = 5
+	TYPE_SOA   uint16 = 6
+	TYPE_PTR   uint16 = 12
+	TYPE_MX    uint16 = 15
+	TYPE_TXT   uint16 = 16
+	TYPE_AAAA  uint16 = 28
+	TYPE_SRV   uint16 = 33
+	TYPE_OPT   uint16 = 41
+	TYPE_ANY   uint16 = 255
+
+	CLASS_IN uint16 = 1
+
+	// bits of the header flags
+	FLAG_QR uint16 = 0b1000_0000_0000_0000
+	FLAG_AA uint16 = 0b0000_0100_0000_0000
+	FLAG_TC uint16 = 0b0000_0010_0000_0000
+	FLAG_RD uint16 = 0b0000_0001_0000_0000
+	FLAG_RA uint16 = 0b0000_0000_1000_0000
+
+	// RCODE values
+	RCODE_NOERROR  = 0
+	RCODE_SERVFAIL = 2
+	RCODE_NXDOMAIN = 3
+	RCODE_REFUSED  = 5
 )
 
 // Utility function to convert a bool to an uint16: no standard conversion offered by Go
@@ -208,6 +242,374 @@ func (question *DNSQuestion) fromNetworkBytes(rdr io.Reader) error {
 	return nil
 }
 
+// Write a question to a buffer, in network order
+func (question *DNSQuestion) toNetworkBytes(buf *bytes.Buffer) {
+	buf.Write(encodeDomainName(question.Domain))
+	binary.Write(buf, binary.BigEndian, question.QType)
+	binary.Write(buf, binary.BigEndian, question.QClass)
+}
+
+// From RFC1035: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.3
+type DNSResourceRecord struct {
+	Name string // a domain name to which this resource record pertains.
+	Type uint16 // two octets containing one of the RR type codes.  This
+	//             field specifies the meaning of the data in the RDATA
+	//             field.
+	Class uint16 // two octets which specify the class of the data in the
+	//             RDATA field.
+	TTL uint32 // a 32 bit unsigned integer that specifies the time
+	//             interval (in seconds) that the resource record may be
+	//             cached before it should be discarded.
+	RData []byte // a variable length string of octets that describes the
+	//             resource.  Names found in RDATA are kept uncompressed.
+}
+
+// Write a resource record to a buffer, in network order. Names are not compressed
+func (rr *DNSResourceRecord) toNetworkBytes(buf *bytes.Buffer) {
+	buf.Write(encodeDomainName(rr.Name))
+	binary.Write(buf, binary.BigEndian, rr.Type)
+	binary.Write(buf, binary.BigEndian, rr.Class)
+	binary.Write(buf, binary.BigEndian, rr.TTL)
+	binary.Write(buf, binary.BigEndian, uint16(len(rr.RData)))
+	buf.Write(rr.RData)
+}
+
+// Return the IP address held by an A or AAAA record, nil for any other type
+func (rr *DNSResourceRecord) ip() net.IP {
+	switch {
+	case rr.Type == TYPE_A && len(rr.RData) == net.IPv4len:
+		return net.IP(rr.RData)
+	case rr.Type == TYPE_AAAA && len(rr.RData) == net.IPv6len:
+		return net.IP(rr.RData)
+	}
+	return nil
+}
+
+// Return the domain name held by a CNAME, NS or PTR record, empty string otherwise
+func (rr *DNSResourceRecord) target() string {
+	switch rr.Type {
+	case TYPE_CNAME, TYPE_NS, TYPE_PTR:
+		name, _, err := readDomainName(rr.RData, 0)
+		if err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// A whole DNS message as described in https://datatracker.ietf.org/doc/html/rfc1035#section-4.1
+type DNSMessage struct {
+	Header      DNSPacketHeader
+	Questions   []DNSQuestion
+	Answers     []DNSResourceRecord
+	Authorities []DNSResourceRecord
+	Additionals []DNSResourceRecord
+}
+
+// Decode a complete DNS message. Contrary to the header and question, the whole buffer is needed
+// because names can be compressed using pointers to previous occurrences in the message
+func (msg *DNSMessage) fromNetworkBytes(buffer []byte) error {
+	err := msg.Header.fromNetworkBytes(bytes.NewReader(buffer))
+	if err != nil {
+		return err
+	}
+	offset := DNS_HEADER_SIZE
+
+	// read questions
+	msg.Questions = make([]DNSQuestion, 0, msg.Header.Qd_count)
+	for i := 0; i < int(msg.Header.Qd_count); i++ {
+		var question DNSQuestion
+
+		question.Domain, offset, err = readDomainName(buffer, offset)
+		if err != nil {
+			return err
+		}
+		if offset+4 > len(buffer) {
+			return io.ErrUnexpectedEOF
+		}
+		question.QType = binary.BigEndian.Uint16(buffer[offset : offset+2])
+		question.QClass = binary.BigEndian.Uint16(buffer[offset+2 : offset+4])
+		offset += 4
+
+		msg.Questions = append(msg.Questions, question)
+	}
+
+	// then the 3 sections made of resource records
+	msg.Answers, offset, err = readResourceRecords(buffer, offset, msg.Header.An_count)
+	if err != nil {
+		return err
+	}
+	msg.Authorities, offset, err = readResourceRecords(buffer, offset, msg.Header.Ns_count)
+	if err != nil {
+		return err
+	}
+	msg.Additionals, _, err = readResourceRecords(buffer, offset, msg.Header.Ar_count)
+	return err
+}
+
+// Encode a DNS message. Section counts are computed from the slices
+func (msg *DNSMessage) toNetworkBytes() []byte {
+	buf := new(bytes.Buffer)
+
+	header := msg.Header
+	header.Qd_count = uint16(len(msg.Questions))
+	header.An_count = uint16(len(msg.Answers))
+	header.Ns_count = uint16(len(msg.Authorities))
+	header.Ar_count = uint16(len(msg.Additionals))
+	binary.Write(buf, binary.BigEndian, header)
+
+	for i := range msg.Questions {
+		msg.Questions[i].toNetworkBytes(buf)
+	}
+	for _, section := range [][]DNSResourceRecord{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			section[i].toNetworkBytes(buf)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// Return the lowest TTL of the answer and authority records, 0 if there's none
+func (msg *DNSMessage) minTTL() uint32 {
+	found := false
+	ttl := uint32(0)
+
+	for _, section := range [][]DNSResourceRecord{msg.Answers, msg.Authorities} {
+		for _, rr := range section {
+			if !found || rr.TTL < ttl {
+				ttl = rr.TTL
+				found = true
+			}
+		}
+	}
+	return ttl
+}
+
+// Read count resource records starting at offset, and return the offset of the byte following them
+func readResourceRecords(buffer []byte, offset int, count uint16) ([]DNSResourceRecord, int, error) {
+	records := make([]DNSResourceRecord, 0, count)
+
+	for i := 0; i < int(count); i++ {
+		var rr DNSResourceRecord
+		var err error
+
+		rr.Name, offset, err = readDomainName(buffer, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// TYPE, CLASS, TTL and RDLENGTH
+		if offset+10 > len(buffer) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		rr.Type = binary.BigEndian.Uint16(buffer[offset : offset+2])
+		rr.Class = binary.BigEndian.Uint16(buffer[offset+2 : offset+4])
+		rr.TTL = binary.BigEndian.Uint32(buffer[offset+4 : offset+8])
+		length := int(binary.BigEndian.Uint16(buffer[offset+8 : offset+10]))
+		offset += 10
+
+		if offset+length > len(buffer) {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		rr.RData, err = decompressRData(buffer, offset, length, rr.Type)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += length
+
+		records = append(records, rr)
+	}
+
+	return records, offset, nil
+}
+
+// Copy RDATA found at offset, expanding compressed names for the types which are known to hold names
+func decompressRData(buffer []byte, offset int, length int, rrType uint16) ([]byte, error) {
+	rdata := buffer[offset : offset+length]
+	buf := new(bytes.Buffer)
+
+	switch rrType {
+	case TYPE_CNAME, TYPE_NS, TYPE_PTR:
+		name, _, err := readDomainName(buffer, offset)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encodeDomainName(name))
+	case TYPE_MX:
+		if length < 2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		name, _, err := readDomainName(buffer, offset+2)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(rdata[:2])
+		buf.Write(encodeDomainName(name))
+	case TYPE_SOA:
+		mname, next, err := readDomainName(buffer, offset)
+		if err != nil {
+			return nil, err
+		}
+		rname, next, err := readDomainName(buffer, next)
+		if err != nil {
+			return nil, err
+		}
+		if next+20 > offset+length {
+			return nil, io.ErrUnexpectedEOF
+		}
+		buf.Write(encodeDomainName(mname))
+		buf.Write(encodeDomainName(rname))
+		buf.Write(buffer[next : next+20])
+	default:
+		buf.Write(rdata)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Read a domain name at offset, following compression pointers (https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.4).
+// The returned offset is the one following the name where it was first found, not where pointers lead to
+func readDomainName(buffer []byte, offset int) (string, int, error) {
+	labels := make([]string, 0)
+	next := -1
+
+	// a pointer can only point backwards, so the number of jumps is bounded by the buffer size
+	for jumps := 0; jumps <= len(buffer); {
+		if offset >= len(buffer) {
+			return "", 0, io.ErrUnexpectedEOF
+		}
+		size := int(buffer[offset])
+
+		switch {
+		// sentinel found
+		case size == 0:
+			if next == -1 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+
+		// a pointer is made of the 2 leading bits set to 1 and a 14 bit offset
+		case size&0b1100_0000 == 0b1100_0000:
+			if offset+1 >= len(buffer) {
+				return "", 0, io.ErrUnexpectedEOF
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			pointer := int(binary.BigEndian.Uint16(buffer[offset:offset+2]) & 0x3FFF)
+			if pointer >= offset {
+				return "", 0, errors.New("forward pointer in domain name")
+			}
+			offset = pointer
+			jumps++
+
+		// a regular label
+		default:
+			if size > 63 || offset+1+size > len(buffer) {
+				return "", 0, errors.New("invalid label in domain name")
+			}
+			labels = append(labels, string(buffer[offset+1:offset+1+size]))
+			offset += 1 + size
+		}
+	}
+
+	return "", 0, errors.New("too many pointers in domain name")
+}
+
+// Check that a domain name can be encoded: labels of 1 to 63 bytes, and at most 255 bytes once encoded
+func checkDomainName(domain string) error {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return nil
+	}
+	if len(domain)+2 > 255 {
+		return fmt.Errorf("domain name <%s> is too long", domain)
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid label <%s> in domain name <%s>", label, domain)
+		}
+	}
+	return nil
+}
+
+// Encode a domain name as a sequence of labels, without compression. The name is expected to be checked
+// by checkDomainName when it's not coming from a DNS message
+func encodeDomainName(domain string) []byte {
+	buf := new(bytes.Buffer)
+
+	domain = strings.TrimSuffix(domain, ".")
+	if domain != "" {
+		for _, label := range strings.Split(domain, ".") {
+			buf.WriteByte(byte(len(label)))
+			buf.WriteString(label)
+		}
+	}
+	buf.WriteByte(0)
+
+	return buf.Bytes()
+}
+
+// Textual representation of RDATA, as found in zone files. Unknown types use the generic
+// format of https://datatracker.ietf.org/doc/html/rfc3597#section-5
+func (rr *DNSResourceRecord) data() string {
+	rdata := rr.RData
+
+	switch rr.Type {
+	case TYPE_A, TYPE_AAAA:
+		if ip := rr.ip(); ip != nil {
+			return ip.String()
+		}
+	case TYPE_CNAME, TYPE_NS, TYPE_PTR:
+		if target := rr.target(); target != "" {
+			return target + "."
+		}
+	case TYPE_MX:
+		if len(rdata) > 2 {
+			if name, _, err := readDomainName(rdata, 2); err == nil {
+				return fmt.Sprintf("%d %s.", binary.BigEndian.Uint16(rdata), name)
+			}
+		}
+	case TYPE_SRV:
+		if len(rdata) > 6 {
+			if name, _, err := readDomainName(rdata, 6); err == nil {
+				return fmt.Sprintf("%d %d %d %s.", binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]), binary.BigEndian.Uint16(rdata[4:]), name)
+			}
+		}
+	case TYPE_SOA:
+		mname, next, err := readDomainName(rdata, 0)
+		if err != nil {
+			break
+		}
+		rname, next, err := readDomainName(rdata, next)
+		if err != nil || next+20 != len(rdata) {
+			break
+		}
+		values := make([]string, 0, 5)
+		for i := next; i < len(rdata); i += 4 {
+			values = append(values, fmt.Sprint(binary.BigEndian.Uint32(rdata[i:])))
+		}
+		return fmt.Sprintf("%s. %s. %s", mname, rname, strings.Join(values, " "))
+	case TYPE_TXT:
+		texts := make([]string, 0)
+		for i := 0; i < len(rdata); {
+			size := int(rdata[i])
+			if i+1+size > len(rdata) {
+				texts = nil
+				break
+			}
+			texts = append(texts, strconv.Quote(string(rdata[i+1:i+1+size])))
+			i += 1 + size
+		}
+		if texts != nil {
+			return strings.Join(texts, " ")
+		}
+	}
+
+	return fmt.Sprintf("\\# %d %x", len(rdata), rdata)
+}
+
 // Get the QType string from its numeric value
 // RR type codes: https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-4
 func qType(value uint16) string {
@@ -398,3 +800,28 @@ func qType(value uint16) string {
 	}
 	return ""
 }
+
+// Numeric values of the QType strings, built from qType()
+var qTypeValues = func() map[string]uint16 {
+	values := make(map[string]uint16)
+	for i := 1; i <= 32769; i++ {
+		if name := qType(uint16(i)); name != "" && name != "Unassigned" {
+			values[name] = uint16(i)
+		}
+	}
+	return values
+}()
+
+// Get the QType numeric value from its string (e.g.: AAAA), or its generic form (e.g.: TYPE28 or 28)
+func qTypeValue(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	if value, found := qTypeValues[name]; found {
+		return value, true
+	}
+
+	value, err := strconv.ParseUint(strings.TrimPrefix(name, "TYPE"), 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(value), true
+}
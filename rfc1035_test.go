@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -74,3 +75,92 @@ func TestDNSQuestion(t *testing.T) {
 	assert.Equal(question.QType, uint16(1))
 	assert.Equal(question.QClass, uint16(1))
 }
+
+func TestDNSMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	// answer to www.google.com A, with a compressed CNAME and A record
+	buffer := []byte{
+		0x30, 0x5c, 0x81, 0x80, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+		0x03, 0x77, 0x77, 0x77, 0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00, 0x00, 0x01, 0x00, 0x01,
+		// www.google.com CNAME foo.google.com
+		0xc0, 0x0c, 0x00, 0x05, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x06, 0x03, 0x66, 0x6f, 0x6f, 0xc0, 0x10,
+		// foo.google.com A 142.250.74.36
+		0xc0, 0x2c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x04, 0x8e, 0xfa, 0x4a, 0x24,
+	}
+	msg := new(DNSMessage)
+	err := msg.fromNetworkBytes(buffer)
+	assert.Nil(err)
+
+	assert.Equal(msg.Header.Id, uint16(0x305c))
+	assert.Equal(len(msg.Questions), 1)
+	assert.Equal(msg.Questions[0].Domain, "www.google.com")
+	assert.Equal(len(msg.Answers), 2)
+	assert.Equal(msg.Answers[0].Name, "www.google.com")
+	assert.Equal(msg.Answers[0].Type, TYPE_CNAME)
+	assert.Equal(msg.Answers[0].TTL, uint32(300))
+	assert.Equal(msg.Answers[0].target(), "foo.google.com")
+	assert.Equal(msg.Answers[1].Name, "foo.google.com")
+	assert.Equal(msg.Answers[1].ip().String(), "142.250.74.36")
+
+	// encoding back and decoding again gives the same message, without compression
+	other := new(DNSMessage)
+	err = other.fromNetworkBytes(msg.toNetworkBytes())
+	assert.Nil(err)
+	assert.Equal(other, msg)
+
+	// truncated buffer
+	err = msg.fromNetworkBytes(buffer[:len(buffer)-2])
+	assert.NotNil(err)
+
+	// pointer loop
+	_, _, err = readDomainName([]byte{0xc0, 0x00}, 0)
+	assert.NotNil(err)
+}
+
+func TestResourceRecordData(t *testing.T) {
+	assert := assert.New(t)
+
+	for value, expected := range map[string]string{
+		"A 192.168.1.1":                    "192.168.1.1",
+		"AAAA fd00::1":                     "fd00::1",
+		"CNAME www.foo.com.":               "www.foo.com.",
+		"MX 10 mail.foo.com.":              "10 mail.foo.com.",
+		"SRV 0 5 631 printer.lan.":         "0 5 631 printer.lan.",
+		"SOA ns.foo. admin.foo. 1 2 3 4 5": "ns.foo. admin.foo. 1 2 3 4 5",
+		"TXT v=spf1":                       `"v=spf1"`,
+	} {
+		fields := strings.Fields(value)
+		rr, err := newLocalRecord("foo", fields[0], fields[1:], 60, "")
+		assert.Nil(err)
+		assert.Equal(rr.data(), expected)
+	}
+
+	rr := DNSResourceRecord{Type: 99, RData: []byte{1, 2, 0xff}}
+	assert.Equal(rr.data(), `\# 3 0102ff`)
+}
+
+func TestQTypeValue(t *testing.T) {
+	assert := assert.New(t)
+
+	for name, expected := range map[string]uint16{"A": 1, "aaaa": 28, "HTTPS": 65, "ANY": 255, "TYPE65": 65, "12": 12} {
+		value, found := qTypeValue(name)
+		assert.True(found)
+		assert.Equal(value, expected, name)
+	}
+
+	_, found := qTypeValue("FOO")
+	assert.False(found)
+}
+
+func TestCheckDomainName(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(checkDomainName("www.example.com."))
+	assert.Nil(checkDomainName(""))
+	assert.Nil(checkDomainName(strings.Repeat("a", 63) + ".com"))
+
+	for _, domain := range []string{strings.Repeat("a", 64) + ".com", "www..example.com", ".com", strings.Repeat("abcdefg.", 32) + "com"} {
+		assert.NotNil(checkDomainName(domain), domain)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// default number of seconds over which rates are averaged
+	DEFAULT_RRL_WINDOW = 15
+
+	// by default, every second limited response is sent back truncated instead of being dropped
+	DEFAULT_RRL_SLIP = 2
+)
+
+// Settings of the response rate limiting, as found in the YAML configuration file. It's modeled after BIND
+// (https://bind9.readthedocs.io/en/latest/reference.html#response-rate-limiting): identical responses sent to
+// the same network prefix are limited, which makes dnswall useless as a reflection amplifier. Only UDP
+// answers are limited, as other transports can't be spoofed
+type RRLConfig struct {
+	ResponsesPerSecond float64  `yaml:"responses_per_second"` // identical non-empty answers per second, 0 means no limit
+	NodataPerSecond    float64  `yaml:"nodata_per_second"`    // empty answers per second, responses_per_second if not set
+	NxdomainsPerSecond float64  `yaml:"nxdomains_per_second"` // NXDOMAIN answers per second, responses_per_second if not set
+	ErrorsPerSecond    float64  `yaml:"errors_per_second"`    // error answers (SERVFAIL, REFUSED...) per second, responses_per_second if not set
+	Window             int      `yaml:"window"`               // number of seconds over which rates are averaged, 15 by default
+	Slip               *int     `yaml:"slip"`                 // every slip-th limited answer is sent truncated, others are dropped. 0 means always drop, 2 by default
+	IPv4Prefix         int      `yaml:"ipv4_prefix"`          // length of IPv4 prefixes, 24 by default
+	IPv6Prefix         int      `yaml:"ipv6_prefix"`          // length of IPv6 prefixes, 56 by default
+	LogOnly            bool     `yaml:"log_only"`             // if true, limited answers are only logged, but still sent
+	Exempt             []string `yaml:"exempt"`               // addresses or CIDR ranges never limited
+}
+
+// What to do with an answer
+type rrlAction int
+
+const (
+	RRL_SEND rrlAction = iota // answer is sent as is
+	RRL_DROP                  // answer is dropped
+	RRL_SLIP                  // an empty truncated answer is sent instead, for a legitimate client to retry over TCP
+)
+
+// Kind of answer, each one having its own rate
+type rrlClass int
+
+const (
+	RRL_RESPONSE rrlClass = iota
+	RRL_NODATA
+	RRL_NXDOMAIN
+	RRL_ERROR
+)
+
+var rrlClassNames = []string{"responses", "nodata", "nxdomains", "errors"}
+
+// Credit of identical answers sent to a prefix. It's earned at the rate of the class, up to one second worth
+// of answers, and can go negative down to the window worth of answers
+type rrlAccount struct {
+	balance float64   // answers which can still be sent
+	last    time.Time // last time the balance was updated
+	slipped int       // number of limited answers, to know which ones are truncated
+}
+
+// Limit the rate of answers sent to each prefix
+type ResponseLimiter struct {
+	settings RRLConfig
+	rates    [4]float64 // answers per second of each class
+	window   time.Duration
+	slip     int
+	exempt   IPFilter   // clients never limited
+	ipv4Mask net.IPMask // mask giving the prefix of an IPv4 address
+	ipv6Mask net.IPMask // mask giving the prefix of an IPv6 address
+
+	mu        sync.Mutex             // protects the fields below
+	accounts  map[string]*rrlAccount // accounts indexed by prefix, class and name
+	lastSweep time.Time              // last time idle accounts were removed
+}
+
+// Allocate a new response rate limiter. Nil is returned if it's not configured
+func newResponseLimiter(settings RRLConfig) (*ResponseLimiter, error) {
+	if settings.ResponsesPerSecond <= 0 {
+		return nil, nil
+	}
+
+	// default values
+	limiter := &ResponseLimiter{settings: settings, slip: DEFAULT_RRL_SLIP, window: DEFAULT_RRL_WINDOW * time.Second}
+	limiter.rates = [4]float64{settings.ResponsesPerSecond, settings.NodataPerSecond, settings.NxdomainsPerSecond, settings.ErrorsPerSecond}
+	for i := range limiter.rates {
+		if limiter.rates[i] <= 0 {
+			limiter.rates[i] = settings.ResponsesPerSecond
+		}
+	}
+	if settings.Window > 0 {
+		limiter.window = time.Duration(settings.Window) * time.Second
+	}
+	if settings.Slip != nil {
+		if *settings.Slip < 0 {
+			return nil, fmt.Errorf("invalid response rate limiting slip %d", *settings.Slip)
+		}
+		limiter.slip = *settings.Slip
+	}
+	if settings.IPv4Prefix == 0 {
+		settings.IPv4Prefix = DEFAULT_IPV4_PREFIX
+	}
+	if settings.IPv6Prefix == 0 {
+		settings.IPv6Prefix = DEFAULT_IPV6_PREFIX
+	}
+	if settings.IPv4Prefix < 0 || settings.IPv4Prefix > 32 || settings.IPv6Prefix < 0 || settings.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid response rate limiting prefix lengths /%d and /%d", settings.IPv4Prefix, settings.IPv6Prefix)
+	}
+	limiter.ipv4Mask = net.CIDRMask(settings.IPv4Prefix, 32)
+	limiter.ipv6Mask = net.CIDRMask(settings.IPv6Prefix, 128)
+
+	for _, text := range settings.Exempt {
+		ipNet, err := parseIPNet(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exempt client <%s>: %v", text, err)
+		}
+		limiter.exempt.netList = append(limiter.exempt.netList, ipNet)
+	}
+
+	limiter.accounts = make(map[string]*rrlAccount)
+	limiter.lastSweep = time.Now()
+	return limiter, nil
+}
+
+// Decide what to do with an answer about to be sent to the IP address at the given time
+func (limiter *ResponseLimiter) check(ip net.IP, answer []byte, now time.Time) rrlAction {
+	if limiter.exempt.match(ip) != nil {
+		return RRL_SEND
+	}
+
+	msg := new(DNSMessage)
+	if err := msg.fromNetworkBytes(answer); err != nil {
+		return RRL_SEND
+	}
+	class, name := rrlClassify(msg)
+	prefix := networkPrefix(ip, limiter.ipv4Mask, limiter.ipv6Mask)
+	key := prefix + " " + rrlClassNames[class] + " " + name
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.sweep(now)
+
+	rate := limiter.rates[class]
+	account, found := limiter.accounts[key]
+	if !found {
+		account = &rrlAccount{balance: rate, last: now}
+		limiter.accounts[key] = account
+	} else if elapsed := now.Sub(account.last).Seconds(); elapsed > 0 {
+		account.balance += elapsed * rate
+		if account.balance > rate {
+			account.balance = rate
+		}
+		account.last = now
+	}
+
+	account.balance--
+	if floor := -rate * limiter.window.Seconds(); account.balance < floor {
+		account.balance = floor
+	}
+	if account.balance >= 0 {
+		if account.slipped != 0 {
+			log.Printf("response rate limiting: stop limiting %s to %s for <%s>", rrlClassNames[class], prefix, name)
+			account.slipped = 0
+		}
+		return RRL_SEND
+	}
+
+	account.slipped++
+	if account.slipped == 1 {
+		action := "limit"
+		if limiter.settings.LogOnly {
+			action = "would limit"
+		}
+		log.Printf("response rate limiting: %s %s to %s for <%s>", action, rrlClassNames[class], prefix, name)
+	}
+
+	switch {
+	case limiter.settings.LogOnly:
+		return RRL_SEND
+	case limiter.slip > 0 && account.slipped%limiter.slip == 0:
+		return RRL_SLIP
+	default:
+		return RRL_DROP
+	}
+}
+
+// Give the class of an answer, and the name used to tell identical answers apart. Errors are only told
+// apart by prefix, and NXDOMAIN answers by zone when the SOA is given, to catch random subdomain floods
+func rrlClassify(msg *DNSMessage) (rrlClass, string) {
+	name := ""
+	if len(msg.Questions) != 0 {
+		name = strings.ToLower(msg.Questions[0].Domain) + " " + qType(msg.Questions[0].QType)
+	}
+
+	switch msg.Header.Flags & 0x000F {
+	case RCODE_NOERROR:
+		if len(msg.Answers) != 0 {
+			return RRL_RESPONSE, name
+		}
+		return RRL_NODATA, name
+	case RCODE_NXDOMAIN:
+		for _, rr := range msg.Authorities {
+			if rr.Type == TYPE_SOA {
+				return RRL_NXDOMAIN, strings.ToLower(rr.Name)
+			}
+		}
+		return RRL_NXDOMAIN, name
+	}
+	return RRL_ERROR, ""
+}
+
+// Remove the accounts which would have their full credit by now, as new ones are created with it. It's
+// done once per window to keep the memory bounded
+func (limiter *ResponseLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < limiter.window {
+		return
+	}
+	limiter.lastSweep = now
+
+	for key, account := range limiter.accounts {
+		if now.Sub(account.last) > limiter.window+time.Second {
+			delete(limiter.accounts, key)
+		}
+	}
+}
+
+// Build an empty truncated answer, keeping only the header, the question and the OPT record
+func truncatedResponse(answer []byte) ([]byte, error) {
+	msg := new(DNSMessage)
+	if err := msg.fromNetworkBytes(answer); err != nil {
+		return nil, err
+	}
+
+	truncated := DNSMessage{Header: msg.Header, Questions: msg.Questions}
+	truncated.Header.Flags |= FLAG_TC
+	for _, rr := range msg.Additionals {
+		if rr.Type == TYPE_OPT {
+			truncated.Additionals = append(truncated.Additionals, rr)
+		}
+	}
+	return truncated.toNetworkBytes(), nil
+}
+
+// Apply the response rate limiting to the answers written to UDP requesters
+type rrlResponseWriter struct {
+	conn    ResponseWriter
+	limiter *ResponseLimiter
+}
+
+// Send, truncate or drop the answer. Dropped answers are reported as written, as it's not an error
+func (writer *rrlResponseWriter) WriteTo(buffer []byte, requesterAddress net.Addr) (int, error) {
+	ip := addressIP(requesterAddress)
+	if ip == nil {
+		return writer.conn.WriteTo(buffer, requesterAddress)
+	}
+
+	switch writer.limiter.check(ip, buffer, time.Now()) {
+	case RRL_DROP:
+		return len(buffer), nil
+	case RRL_SLIP:
+		truncated, err := truncatedResponse(buffer)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := writer.conn.WriteTo(truncated, requesterAddress); err != nil {
+			return 0, err
+		}
+		return len(buffer), nil
+	}
+	return writer.conn.WriteTo(buffer, requesterAddress)
+}
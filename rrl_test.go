@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Build an answer with the rcode and number of A records
+func buildAnswer(domain string, rcode uint16, count int) []byte {
+	query := new(DNSMessage)
+	query.fromNetworkBytes(buildQuery(domain, TYPE_A))
+
+	answer := newResponse(query, rcode)
+	for i := 0; i < count; i++ {
+		answer.Answers = append(answer.Answers, DNSResourceRecord{Name: domain, Type: TYPE_A, Class: CLASS_IN, TTL: 60, RData: []byte{10, 0, 0, byte(i)}})
+	}
+	return answer.toNetworkBytes()
+}
+
+func TestResponseLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	slip := 3
+	limiter, err := newResponseLimiter(RRLConfig{ResponsesPerSecond: 2, NxdomainsPerSecond: 1, Window: 5, Slip: &slip, Exempt: []string{"10.1.0.0/16"}})
+	assert.Nil(err)
+
+	now := time.Now()
+	client := net.ParseIP("10.0.0.1")
+	answer := buildAnswer("www.foo.com", RCODE_NOERROR, 1)
+
+	// one second worth of identical answers, then every third limited answer is truncated
+	actions := []rrlAction{}
+	for i := 0; i < 8; i++ {
+		actions = append(actions, limiter.check(client, answer, now))
+	}
+	assert.Equal(actions, []rrlAction{RRL_SEND, RRL_SEND, RRL_DROP, RRL_DROP, RRL_SLIP, RRL_DROP, RRL_DROP, RRL_SLIP})
+
+	// the same prefix is limited, but not for other answers or prefixes
+	assert.Equal(limiter.check(net.ParseIP("10.0.0.2"), answer, now), RRL_DROP)
+	assert.Equal(limiter.check(client, buildAnswer("www.bar.com", RCODE_NOERROR, 1), now), RRL_SEND)
+	assert.Equal(limiter.check(net.ParseIP("10.0.1.1"), answer, now), RRL_SEND)
+	assert.Equal(limiter.check(net.ParseIP("10.1.0.1"), answer, now), RRL_SEND)
+
+	// the balance went negative, it takes some time to get credit back
+	assert.NotEqual(limiter.check(client, answer, now.Add(2*time.Second)), RRL_SEND)
+	assert.Equal(limiter.check(client, answer, now.Add(10*time.Second)), RRL_SEND)
+
+	// NXDOMAIN answers have their own rate, errors are counted whatever the name
+	nxdomain := buildAnswer("foo.bar.com", RCODE_NXDOMAIN, 0)
+	assert.Equal(limiter.check(client, nxdomain, now), RRL_SEND)
+	assert.NotEqual(limiter.check(client, nxdomain, now), RRL_SEND)
+	assert.Equal(limiter.check(client, buildAnswer("a.foo.com", RCODE_SERVFAIL, 0), now), RRL_SEND)
+	assert.Equal(limiter.check(client, buildAnswer("b.foo.com", RCODE_SERVFAIL, 0), now), RRL_SEND)
+	assert.NotEqual(limiter.check(client, buildAnswer("c.foo.com", RCODE_SERVFAIL, 0), now), RRL_SEND)
+
+	// idle accounts are forgotten
+	limiter.sweep(now.Add(time.Minute))
+	assert.Equal(len(limiter.accounts), 0)
+}
+
+func TestResponseLimiterConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter, err := newResponseLimiter(RRLConfig{})
+	assert.Nil(err)
+	assert.Nil(limiter)
+
+	limiter, _ = newResponseLimiter(RRLConfig{ResponsesPerSecond: 5, ErrorsPerSecond: 1})
+	assert.Equal(limiter.rates, [4]float64{5, 5, 5, 1})
+	assert.Equal(limiter.slip, DEFAULT_RRL_SLIP)
+	assert.Equal(limiter.window, DEFAULT_RRL_WINDOW*time.Second)
+
+	// log only mode never drops anything
+	limiter, _ = newResponseLimiter(RRLConfig{ResponsesPerSecond: 1, LogOnly: true})
+	answer := buildAnswer("www.foo.com", RCODE_NOERROR, 1)
+	for i := 0; i < 5; i++ {
+		assert.Equal(limiter.check(net.ParseIP("10.0.0.1"), answer, time.Now()), RRL_SEND)
+	}
+
+	slip := -1
+	_, err = newResponseLimiter(RRLConfig{ResponsesPerSecond: 5, Slip: &slip})
+	assert.NotNil(err)
+	_, err = newResponseLimiter(RRLConfig{ResponsesPerSecond: 5, IPv6Prefix: 129})
+	assert.NotNil(err)
+}
+
+func TestHandleDNSRequestRRL(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(err)
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(err)
+	defer client.Close()
+
+	slip := 1
+	conf := newTestConfig(t)
+	conf.responseLimiter, _ = newResponseLimiter(RRLConfig{ResponsesPerSecond: 1, Slip: &slip})
+
+	// first answer is sent, the next one is truncated
+	for _, truncated := range []bool{false, true} {
+		handleDNSRequest(server, client.LocalAddr(), buildQuery("printer.lan", TYPE_A), conf)
+
+		buffer := make([]byte, DEFAULT_BUFFER_SIZE)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buffer)
+		assert.Nil(err)
+
+		msg := new(DNSMessage)
+		assert.Nil(msg.fromNetworkBytes(buffer[:n]))
+		assert.Equal(msg.Header.Flags&FLAG_TC != 0, truncated)
+		assert.Equal(len(msg.Answers) == 0, truncated)
+	}
+
+	// other transports are not limited
+	for i := 0; i < 3; i++ {
+		writer := new(bufferResponseWriter)
+		handleDNSRequest(writer, client.LocalAddr(), buildQuery("printer.lan", TYPE_A), conf)
+		assert.Equal(firstAddress(writer.buffer), "192.168.1.20")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// default path of the DoH endpoint
+	DEFAULT_DOH_PATH = "/dns-query"
+
+	// media type of the JSON API
+	DNS_JSON_TYPE = "application/dns-json"
+)
+
+// Settings of the DNS over HTTPS listener (https://datatracker.ietf.org/doc/html/rfc8484), as found in the YAML
+// configuration file
+type HTTPSListenerConfig struct {
+	Address     string `yaml:"address"`      // local address to listen to (e.g.: 0.0.0.0:443)
+	Path        string `yaml:"path"`         // path of the endpoint, /dns-query by default
+	CertFile    string `yaml:"cert_file"`    // PEM certificate chain
+	KeyFile     string `yaml:"key_file"`     // PEM private key
+	IdleTimeout int    `yaml:"idle_timeout"` // keep-alive connections without any request during this number of seconds are closed
+	JSON        bool   `yaml:"json"`         // if true, the JSON API is also served
+}
+
+// Open the DoH listener, or use the socket passed by systemd. HTTP/2 is negotiated with clients supporting it
+func listenHTTPS(settings *HTTPSListenerConfig, sockets *activatedSockets) (net.Listener, error) {
+	reloader, err := newCertReloader(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	return listenStream(settings.Address, SD_NAME_DOH, sockets, tlsConfig)
+}
+
+// Serve DoH requests, until the listener is closed
+func serveHTTPS(listener net.Listener, conf *Config) {
+	path := conf.httpsListener.Path
+	if path == "" {
+		path = DEFAULT_DOH_PATH
+	}
+	idleTimeout := time.Duration(conf.httpsListener.IdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = DEFAULT_IDLE_TIMEOUT * time.Second
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, &dohHandler{conf: conf})
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: UPSTREAM_TIMEOUT,
+		IdleTimeout:       idleTimeout,
+	}
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("error: <%v> when serving DoH requests, stopping listener", err)
+	}
+}
+
+// HTTP handler of DoH requests, using the same pipeline as the UDP server
+type dohHandler struct {
+	conf *Config
+}
+
+// Decode the query from the HTTP request, process it and send back the answer
+func (handler *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	var err error
+	asJSON := false
+
+	switch r.Method {
+	case http.MethodGet:
+		switch {
+		case r.URL.Query().Get("dns") != "":
+			// base64url without padding, but be lenient with padding
+			query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+		case handler.conf.httpsListener.JSON && r.URL.Query().Get("name") != "":
+			query, err = jsonQuery(r.URL.Query().Get("name"), r.URL.Query().Get("type"))
+			asJSON = true
+		default:
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != DNS_MESSAGE_TYPE {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = ioutil.ReadAll(io.LimitReader(r.Body, 0xFFFF))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil || len(query) < DNS_HEADER_SIZE {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	// JSON output can also be asked for a wire format query
+	if handler.conf.httpsListener.JSON && strings.Contains(r.Header.Get("Accept"), DNS_JSON_TYPE) {
+		asJSON = true
+	}
+
+	// requester address is only used for logging
+	requesterAddress, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		requesterAddress = &net.TCPAddr{}
+	}
+
+	writer := new(bufferResponseWriter)
+	handleDNSRequest(writer, requesterAddress, query, handler.conf)
+	if writer.buffer == nil {
+		http.Error(w, "no answer from DNS resolver", http.StatusBadGateway)
+		return
+	}
+
+	answer := new(DNSMessage)
+	if err := answer.fromNetworkBytes(writer.buffer); err != nil {
+		http.Error(w, "invalid DNS answer", http.StatusBadGateway)
+		return
+	}
+
+	// answer can be cached as long as its records: https://datatracker.ietf.org/doc/html/rfc8484#section-5.1
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", answer.minTTL()))
+
+	if asJSON {
+		w.Header().Set("Content-Type", DNS_JSON_TYPE)
+		json.NewEncoder(w).Encode(newJSONMessage(answer))
+		return
+	}
+	w.Header().Set("Content-Type", DNS_MESSAGE_TYPE)
+	w.Write(writer.buffer)
+}
+
+// Keep the answer in memory instead of sending it to the requester
+type bufferResponseWriter struct {
+	buffer []byte
+}
+
+// Save the answer
+func (writer *bufferResponseWriter) WriteTo(buffer []byte, requesterAddress net.Addr) (int, error) {
+	writer.buffer = make([]byte, len(buffer))
+	copy(writer.buffer, buffer)
+	return len(buffer), nil
+}
+
+// Build a wire format query from the parameters of the JSON API. Type is A if not given
+func jsonQuery(name string, typeName string) ([]byte, error) {
+	qtype := TYPE_A
+	if typeName != "" {
+		var found bool
+		if qtype, found = qTypeValue(typeName); !found {
+			return nil, fmt.Errorf("unknown type <%s>", typeName)
+		}
+	}
+
+	if err := checkDomainName(name); err != nil {
+		return nil, err
+	}
+
+	query := DNSMessage{
+		Header:    DNSPacketHeader{Flags: FLAG_RD},
+		Questions: []DNSQuestion{{Domain: strings.TrimSuffix(name, "."), QType: qtype, QClass: CLASS_IN}},
+	}
+	return query.toNetworkBytes(), nil
+}
+
+// Answer of the JSON API, as used by the main public resolvers
+type JSONMessage struct {
+	Status    int
+	TC        bool
+	RD        bool
+	RA        bool
+	AD        bool
+	CD        bool
+	Question  []JSONQuestion
+	Answer    []JSONRecord `json:",omitempty"`
+	Authority []JSONRecord `json:",omitempty"`
+}
+
+// Question of the JSON API
+type JSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// Resource record of the JSON API, with its data in the format of zone files
+type JSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+// Convert a DNS message to its JSON representation
+func newJSONMessage(msg *DNSMessage) *JSONMessage {
+	flags := new(DNSPacketFlags)
+	flags.fromNetworkBytes(msg.Header.Flags)
+
+	jsonMsg := &JSONMessage{Status: int(flags.RCODE), TC: flags.TC, RD: flags.RD, RA: flags.RA, AD: flags.AD, CD: flags.CD}
+	for _, question := range msg.Questions {
+		jsonMsg.Question = append(jsonMsg.Question, JSONQuestion{Name: question.Domain + ".", Type: question.QType})
+	}
+	for i := range msg.Answers {
+		jsonMsg.Answer = append(jsonMsg.Answer, newJSONRecord(&msg.Answers[i]))
+	}
+	for i := range msg.Authorities {
+		jsonMsg.Authority = append(jsonMsg.Authority, newJSONRecord(&msg.Authorities[i]))
+	}
+	return jsonMsg
+}
+
+// Convert a resource record to its JSON representation
+func newJSONRecord(rr *DNSResourceRecord) JSONRecord {
+	return JSONRecord{Name: rr.Name + ".", Type: rr.Type, TTL: rr.TTL, Data: rr.data()}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoHHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := newTestConfig(t)
+	conf.httpsListener.JSON = true
+	handler := &dohHandler{conf: conf}
+	query := buildQuery("printer.lan", TYPE_A)
+
+	// GET
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil))
+	assert.Equal(w.Code, http.StatusOK)
+	assert.Equal(w.Header().Get("Content-Type"), DNS_MESSAGE_TYPE)
+	assert.Equal(w.Header().Get("Cache-Control"), "max-age=3600")
+	assert.Equal(firstAddress(w.Body.Bytes()), "192.168.1.20")
+
+	// POST
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(buildQuery("www.foo.com", TYPE_A)))
+	r.Header.Set("Content-Type", DNS_MESSAGE_TYPE)
+	handler.ServeHTTP(w, r)
+	assert.Equal(w.Code, http.StatusOK)
+	assert.Equal(firstAddress(w.Body.Bytes()), "1.2.3.4")
+
+	// blocked domain
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(buildQuery("adtracking.foo.com", TYPE_A)))
+	r.Header.Set("Content-Type", DNS_MESSAGE_TYPE)
+	handler.ServeHTTP(w, r)
+	assert.Equal(rcode(w.Body.Bytes()), byte(RCODE_NXDOMAIN))
+
+	// JSON API
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dns-query?name=printer.lan&type=A", nil))
+	assert.Equal(w.Header().Get("Content-Type"), DNS_JSON_TYPE)
+	var jsonMsg JSONMessage
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &jsonMsg))
+	assert.Equal(jsonMsg.Status, 0)
+	assert.Equal(jsonMsg.Question, []JSONQuestion{{Name: "printer.lan.", Type: TYPE_A}})
+	assert.Equal(jsonMsg.Answer, []JSONRecord{{Name: "printer.lan.", Type: TYPE_A, TTL: 3600, Data: "192.168.1.20"}})
+
+	// JSON output of a wire format query
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	r.Header.Set("Accept", DNS_JSON_TYPE)
+	handler.ServeHTTP(w, r)
+	assert.Equal(w.Header().Get("Content-Type"), DNS_JSON_TYPE)
+
+	// errors
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/dns-query", nil),
+		httptest.NewRequest(http.MethodGet, "/dns-query?dns=!!!", nil),
+		httptest.NewRequest(http.MethodGet, "/dns-query?name=printer.lan&type=FOO", nil),
+		httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(query)),
+		httptest.NewRequest(http.MethodPut, "/dns-query", bytes.NewReader(query)),
+	} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.NotEqual(w.Code, http.StatusOK, r.URL.String())
+	}
+
+	// JSON API disabled
+	conf.httpsListener.JSON = false
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dns-query?name=printer.lan", nil))
+	assert.Equal(w.Code, http.StatusBadRequest)
+}
+
+func TestServeHTTPS(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	certFile, keyFile := writeCertFiles(t, pki, t.TempDir(), time.Now())
+
+	conf := newTestConfig(t)
+	conf.httpsListener = HTTPSListenerConfig{Address: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile}
+	listener, err := listenHTTPS(&conf.httpsListener, new(activatedSockets))
+	assert.Nil(err)
+	defer listener.Close()
+	go serveHTTPS(listener, conf)
+
+	// our own DoH upstream is used as a client, over HTTP/2
+	client, err := newHTTPSUpstream("https://"+listener.Addr().String()+DEFAULT_DOH_PATH, nil, nil, pki.pool)
+	assert.Nil(err)
+	answer, err := client.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+	assert.Equal(firstAddress(answer), "1.2.3.4")
+
+	response, err := client.client.Get("https://" + listener.Addr().String() + "/foo")
+	assert.Nil(err)
+	assert.Equal(response.StatusCode, http.StatusNotFound)
+	assert.Equal(response.ProtoMajor, 2)
+	response.Body.Close()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Settings of the DNS over QUIC listener (https://datatracker.ietf.org/doc/html/rfc9250), as found in the YAML
+// configuration file
+type QUICListenerConfig struct {
+	Address     string `yaml:"address"`      // local address to listen to (e.g.: 0.0.0.0:853)
+	CertFile    string `yaml:"cert_file"`    // PEM certificate chain
+	KeyFile     string `yaml:"key_file"`     // PEM private key
+	IdleTimeout int    `yaml:"idle_timeout"` // connections without any query during this number of seconds are closed
+	Allow0RTT   bool   `yaml:"allow_0rtt"`   // if true, queries sent in 0-RTT data are accepted, even though they can be replayed
+}
+
+// Open the DoQ listener, or use the socket passed by systemd
+func listenQUIC(settings *QUICListenerConfig, sockets *activatedSockets) (*quic.EarlyListener, error) {
+	reloader, err := newCertReloader(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tls.VersionTLS13,
+		NextProtos:     []string{DOQ_ALPN},
+	}
+
+	idleTimeout := time.Duration(settings.IdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = DEFAULT_IDLE_TIMEOUT * time.Second
+	}
+	quicConfig := &quic.Config{
+		MaxIdleTimeout:     idleTimeout,
+		MaxIncomingStreams: MAX_PIPELINED_QUERIES,
+		Allow0RTT:          settings.Allow0RTT,
+	}
+
+	conn, err := sockets.packetConn(SD_NAME_DOQ)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return quic.ListenAddrEarly(settings.Address, tlsConfig, quicConfig)
+	}
+	return quic.ListenEarly(conn, tlsConfig, quicConfig)
+}
+
+// Accept connections from DoQ clients, until the listener is closed
+func serveQUIC(listener *quic.EarlyListener, conf *Config) {
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			if err != quic.ErrServerClosed {
+				log.Printf("error: <%v> when accepting DoQ connection, stopping listener", err)
+			}
+			return
+		}
+		go serveQUICConn(conn, conf)
+	}
+}
+
+// Accept the streams opened by a DoQ client, each one carrying a single query. The number of streams opened at
+// once is limited by the QUIC flow control
+func serveQUICConn(conn quic.EarlyConnection, conf *Config) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			if conf.debug {
+				log.Printf("DoQ connection from <%v> closed: <%v>", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		go serveQUICStream(conn, stream, conf)
+	}
+}
+
+// Read the query from the stream, and process it the same way as UDP ones
+func serveQUICStream(conn quic.EarlyConnection, stream quic.Stream, conf *Config) {
+	stream.SetReadDeadline(time.Now().Add(UPSTREAM_TIMEOUT))
+
+	query, err := readTCPMessage(stream)
+	if err != nil {
+		stream.CancelRead(DOQ_PROTOCOL_ERROR)
+		stream.CancelWrite(DOQ_PROTOCOL_ERROR)
+		return
+	}
+
+	// ID must be 0: https://datatracker.ietf.org/doc/html/rfc9250#section-4.2.1
+	if len(query) < DNS_HEADER_SIZE || binary.BigEndian.Uint16(query) != 0 {
+		log.Printf("error: invalid query from DoQ client <%v>", conn.RemoteAddr())
+		conn.CloseWithError(DOQ_PROTOCOL_ERROR, "invalid query")
+		return
+	}
+
+	writer := &quicResponseWriter{stream: stream}
+	handleDNSRequest(writer, conn.RemoteAddr(), query, conf)
+
+	// no answer was sent, e.g. when all resolvers failed
+	if !writer.written {
+		stream.CancelWrite(DOQ_INTERNAL_ERROR)
+	}
+}
+
+// Write the answer to a DoQ stream, and close it as no other message is sent on it
+type quicResponseWriter struct {
+	stream  quic.Stream
+	written bool // true once the answer is sent
+}
+
+// Write a DNS message. The address is not used as the stream is already bound to the requester
+func (writer *quicResponseWriter) WriteTo(buffer []byte, requesterAddress net.Addr) (int, error) {
+	if writer.written {
+		return 0, errors.New("DoQ answer already sent")
+	}
+	writer.written = true
+
+	message := make([]byte, 2+len(buffer))
+	binary.BigEndian.PutUint16(message, uint16(len(buffer)))
+	copy(message[2:], buffer)
+
+	writer.stream.SetWriteDeadline(time.Now().Add(UPSTREAM_TIMEOUT))
+	if _, err := writer.stream.Write(message); err != nil {
+		return 0, err
+	}
+	if err := writer.stream.Close(); err != nil {
+		return 0, err
+	}
+	return len(buffer), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Start a DoQ listener with the test configuration
+func startQUICListener(t *testing.T, pki *testPKI, allow0RTT bool) string {
+	certFile, keyFile := writeCertFiles(t, pki, t.TempDir(), time.Now())
+
+	conf := newTestConfig(t)
+	conf.quicListener = QUICListenerConfig{Address: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile, IdleTimeout: 1, Allow0RTT: allow0RTT}
+	listener, err := listenQUIC(&conf.quicListener, new(activatedSockets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveQUIC(listener, conf)
+
+	return listener.Addr().String()
+}
+
+func TestServeQUIC(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	address := startQUICListener(t, pki, false)
+
+	// concurrent queries on a single connection, going through the same path as UDP ones
+	client, _ := newQUICUpstream(address, "dns.test", nil, pki.pool, false)
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			switch i % 3 {
+			case 0:
+				answer, err := client.exchange(buildQuery("printer.lan", TYPE_A))
+				assert.Nil(err)
+				assert.Equal(firstAddress(answer), "192.168.1.20")
+			case 1:
+				answer, err := client.exchange(buildQuery("www.foo.com", TYPE_A))
+				assert.Nil(err)
+				assert.Equal(firstAddress(answer), "1.2.3.4")
+			case 2:
+				answer, err := client.exchange(buildQuery("adtracking.foo.com", TYPE_A))
+				assert.Nil(err)
+				assert.Equal(rcode(answer), byte(RCODE_NXDOMAIN))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// a query with a non-zero ID is a protocol error, closing the connection
+	tlsConfig := &tls.Config{RootCAs: pki.pool, ServerName: "dns.test", NextProtos: []string{DOQ_ALPN}}
+	conn, err := quic.DialAddr(context.Background(), address, tlsConfig, nil)
+	assert.Nil(err)
+	stream, _ := conn.OpenStreamSync(context.Background())
+	query := buildQuery("www.foo.com", TYPE_A)
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+	stream.Write(message)
+	stream.Close()
+
+	select {
+	case <-conn.Context().Done():
+		appErr, ok := context.Cause(conn.Context()).(*quic.ApplicationError)
+		assert.True(ok)
+		assert.Equal(appErr.ErrorCode, quic.ApplicationErrorCode(DOQ_PROTOCOL_ERROR))
+	case <-time.After(2 * time.Second):
+		t.Error("connection not closed")
+	}
+}
+
+func TestServeQUIC0RTT(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+
+	// both sides must allow 0-RTT for it to be used when resuming the session
+	for _, allowed := range []struct{ server, client, used bool }{{true, true, true}, {true, false, false}, {false, true, false}} {
+		address := startQUICListener(t, pki, allowed.server)
+		client, _ := newQUICUpstream(address, "dns.test", nil, pki.pool, allowed.client)
+
+		// first connection gets a session ticket
+		answer, err := client.exchange(buildQuery("www.foo.com", TYPE_A))
+		assert.Nil(err)
+		assert.Equal(firstAddress(answer), "1.2.3.4")
+		time.Sleep(50 * time.Millisecond)
+		client.release(client.conn)
+
+		answer, err = client.exchange(buildQuery("www.foo.com", TYPE_A))
+		assert.Nil(err)
+		assert.Equal(firstAddress(answer), "1.2.3.4")
+		assert.Equal(client.conn.ConnectionState().Used0RTT, allowed.used)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// idle timeout of plain TCP connections, in seconds. Clients mostly use TCP to retry a truncated answer,
+	// so connections are not kept long (https://datatracker.ietf.org/doc/html/rfc7766#section-6.2.3)
+	TCP_IDLE_TIMEOUT = 10
+)
+
+// Open the plain TCP listener on the address, or use the socket passed by systemd
+func listenTCP(address string, sockets *activatedSockets) (net.Listener, error) {
+	return listenStream(address, SD_NAME_DNS_TCP, sockets, nil)
+}
+
+// Accept connections from plain TCP clients, until the listener is closed
+func serveTCP(listener net.Listener, conf *Config) {
+	serveStream(listener, "TCP", TCP_IDLE_TIMEOUT*time.Second, conf)
+}
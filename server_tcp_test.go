@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeTCP(t *testing.T) {
+	assert := assert.New(t)
+
+	// every limited UDP answer is truncated
+	slip := 1
+	conf := newTestConfig(t)
+	conf.responseLimiter, _ = newResponseLimiter(RRLConfig{ResponsesPerSecond: 1, Slip: &slip})
+	server, _ := startUDPServer(t, conf)
+
+	listener, err := listenTCP(server.conn.LocalAddr().String(), new(activatedSockets))
+	assert.Nil(err)
+	defer listener.Close()
+	go serveTCP(listener, conf)
+
+	udpClient, err := net.Dial("udp", server.conn.LocalAddr().String())
+	assert.Nil(err)
+	defer udpClient.Close()
+
+	var msg *DNSMessage
+	for i := 0; i < 2; i++ {
+		udpClient.Write(buildQuery("printer.lan", TYPE_A))
+		udpClient.SetReadDeadline(time.Now().Add(time.Second))
+		buffer := make([]byte, DEFAULT_BUFFER_SIZE)
+		n, err := udpClient.Read(buffer)
+		assert.Nil(err)
+		msg = new(DNSMessage)
+		assert.Nil(msg.fromNetworkBytes(buffer[:n]))
+	}
+	assert.NotEqual(msg.Header.Flags&FLAG_TC, uint16(0))
+
+	// the truncated answer is retried over TCP, which is not rate limited
+	tcpClient, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(err)
+	defer tcpClient.Close()
+	for _, domain := range []string{"printer.lan", "printer.lan", "adtracking.foo.com"} {
+		query := buildQuery(domain, TYPE_A)
+		message := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(message, uint16(len(query)))
+		copy(message[2:], query)
+		_, err = tcpClient.Write(message)
+		assert.Nil(err)
+
+		tcpClient.SetReadDeadline(time.Now().Add(time.Second))
+		answer, err := readTCPMessage(tcpClient)
+		assert.Nil(err)
+		if domain == "printer.lan" {
+			assert.Equal(firstAddress(answer), "192.168.1.20")
+		} else {
+			assert.Equal(rcode(answer), byte(RCODE_NXDOMAIN))
+		}
+	}
+}
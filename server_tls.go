@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// default idle timeout of client connections, in seconds
+	DEFAULT_IDLE_TIMEOUT = 30
+
+	// maximum number of queries processed at once on a single connection
+	MAX_PIPELINED_QUERIES = 64
+)
+
+// Settings of the DNS over TLS listener (https://datatracker.ietf.org/doc/html/rfc7858), as found in the YAML
+// configuration file
+type TLSListenerConfig struct {
+	Address     string `yaml:"address"`      // local address to listen to (e.g.: 0.0.0.0:853)
+	CertFile    string `yaml:"cert_file"`    // PEM certificate chain
+	KeyFile     string `yaml:"key_file"`     // PEM private key
+	IdleTimeout int    `yaml:"idle_timeout"` // connections without any query during this number of seconds are closed
+}
+
+// Give the certificate to TLS handshakes, reloading it when the files are modified on disk
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex       // protects the fields below
+	cert    *tls.Certificate // last loaded certificate
+	modTime time.Time        // most recent modification time of both files when certificate was loaded
+}
+
+// Load the certificate and key for the first time
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := reloader.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Return the certificate, after reloading it if files have changed. If reloading fails, the previous
+// certificate is kept
+func (reloader *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	modTime := time.Time{}
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if reloader.cert != nil {
+				return reloader.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	if reloader.cert != nil && modTime.Equal(reloader.modTime) {
+		return reloader.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		if reloader.cert != nil {
+			log.Printf("error: <%v> when reloading certificate <%s>, keeping the previous one", err, reloader.certFile)
+			return reloader.cert, nil
+		}
+		return nil, err
+	}
+	if reloader.cert != nil {
+		log.Printf("certificate <%s> reloaded", reloader.certFile)
+	}
+
+	reloader.cert = &cert
+	reloader.modTime = modTime
+	return reloader.cert, nil
+}
+
+// Open the DoT listener, or use the socket passed by systemd
+func listenTLS(settings *TLSListenerConfig, sockets *activatedSockets) (net.Listener, error) {
+	reloader, err := newCertReloader(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"dot"},
+	}
+	return listenStream(settings.Address, SD_NAME_DOT, sockets, tlsConfig)
+}
+
+// Listen to TCP connections on the address, unless systemd passed a socket under the name. Connections are
+// wrapped in TLS, unless the TLS configuration is nil
+func listenStream(address string, name string, sockets *activatedSockets, tlsConfig *tls.Config) (net.Listener, error) {
+	listener, err := sockets.listener(name)
+	if err != nil {
+		return nil, err
+	}
+	if listener == nil {
+		if listener, err = net.Listen("tcp", address); err != nil {
+			return nil, err
+		}
+	}
+	if tlsConfig == nil {
+		return listener, nil
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// Accept connections from DoT clients, until the listener is closed
+func serveTLS(listener net.Listener, conf *Config) {
+	idleTimeout := time.Duration(conf.tlsListener.IdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = DEFAULT_IDLE_TIMEOUT * time.Second
+	}
+	serveStream(listener, "DoT", idleTimeout, conf)
+}
+
+// Accept connections from stream clients (TCP or TLS), until the listener is closed. The protocol is only
+// used in logs
+func serveStream(listener net.Listener, protocol string, idleTimeout time.Duration, conf *Config) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			log.Printf("error: <%v> when accepting %s connection, stopping listener", err, protocol)
+			return
+		}
+		go serveStreamConn(conn, protocol, idleTimeout, conf)
+	}
+}
+
+// Read queries from a stream connection, and process them concurrently. Answers are written back as soon as
+// they're ready, so in any order
+func serveStreamConn(conn net.Conn, protocol string, idleTimeout time.Duration, conf *Config) {
+	writer := &streamResponseWriter{conn: conn}
+
+	// wait for all queries to be answered before closing the connection
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		conn.Close()
+	}()
+
+	// limit the number of queries processed at once
+	slots := make(chan struct{}, MAX_PIPELINED_QUERIES)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			if conf.debug {
+				log.Printf("%s connection from <%v> closed: <%v>", protocol, conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(query) < DNS_HEADER_SIZE {
+			log.Printf("error: message too short from %s client <%v>", protocol, conn.RemoteAddr())
+			return
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handleDNSRequest(writer, conn.RemoteAddr(), query, conf)
+			<-slots
+		}()
+	}
+}
+
+// Write answers to a stream connection (TCP or TLS), prefixed with their length
+type streamResponseWriter struct {
+	conn net.Conn
+	mu   sync.Mutex // only one message written at once
+}
+
+// Write a DNS message. The address is not used as the connection is already bound to the requester
+func (writer *streamResponseWriter) WriteTo(buffer []byte, requesterAddress net.Addr) (int, error) {
+	message := make([]byte, 2+len(buffer))
+	binary.BigEndian.PutUint16(message, uint16(len(buffer)))
+	copy(message[2:], buffer)
+
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	writer.conn.SetWriteDeadline(time.Now().Add(UPSTREAM_TIMEOUT))
+	if _, err := writer.conn.Write(message); err != nil {
+		return 0, err
+	}
+	return len(buffer), nil
+}
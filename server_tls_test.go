@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Write the server certificate and key of the PKI to files, and set their modification time
+func writeCertFiles(t *testing.T, pki *testPKI, dir string, modTime time.Time) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pki.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pki.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	first := newTestPKI(t, "dns.test")
+	certFile, keyFile := writeCertFiles(t, first, dir, time.Now().Add(-time.Minute))
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	assert.Nil(err)
+	cert, _ := reloader.getCertificate(nil)
+	assert.Equal(cert.Certificate[0], first.cert.Certificate[0])
+
+	// files are replaced
+	second := newTestPKI(t, "dns.test")
+	writeCertFiles(t, second, dir, time.Now())
+	cert, _ = reloader.getCertificate(nil)
+	assert.Equal(cert.Certificate[0], second.cert.Certificate[0])
+
+	// invalid files: previous certificate is kept
+	ioutil.WriteFile(keyFile, []byte("foo"), 0600)
+	os.Chtimes(keyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	cert, err = reloader.getCertificate(nil)
+	assert.Nil(err)
+	assert.Equal(cert.Certificate[0], second.cert.Certificate[0])
+
+	_, err = newCertReloader(filepath.Join(dir, "foo.pem"), keyFile)
+	assert.NotNil(err)
+}
+
+func TestServeTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	certFile, keyFile := writeCertFiles(t, pki, t.TempDir(), time.Now())
+
+	conf := newTestConfig(t)
+	conf.tlsListener = TLSListenerConfig{Address: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile, IdleTimeout: 1}
+	listener, err := listenTLS(&conf.tlsListener, new(activatedSockets))
+	assert.Nil(err)
+	defer listener.Close()
+	go serveTLS(listener, conf)
+
+	// pipelined queries on a single connection, going through the same path as UDP ones
+	client, _ := newTLSUpstream(listener.Addr().String(), "dns.test", nil, pki.pool)
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			switch i % 3 {
+			case 0:
+				answer, err := client.exchange(buildQuery("printer.lan", TYPE_A))
+				assert.Nil(err)
+				assert.Equal(firstAddress(answer), "192.168.1.20")
+			case 1:
+				answer, err := client.exchange(buildQuery("www.foo.com", TYPE_A))
+				assert.Nil(err)
+				assert.Equal(firstAddress(answer), "1.2.3.4")
+			case 2:
+				answer, err := client.exchange(buildQuery("adtracking.foo.com", TYPE_A))
+				assert.Nil(err)
+				assert.Equal(rcode(answer), byte(RCODE_NXDOMAIN))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// idle connections are closed
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: pki.pool, ServerName: "dns.test"})
+	assert.Nil(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	start := time.Now()
+	_, err = readTCPMessage(conn)
+	assert.NotNil(err)
+	assert.True(time.Since(start) < 2*time.Second)
+}
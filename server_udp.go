@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// default number of queries processed at once by the UDP server
+	DEFAULT_UDP_WORKERS = 256
+
+	// default number of queries waiting for a worker, beyond which new ones are dropped
+	DEFAULT_UDP_QUEUE_SIZE = 1024
+
+	// default number of seconds between two logs of the metrics
+	DEFAULT_METRICS_INTERVAL = 60
+)
+
+// Settings of the UDP server worker pool, as found in the YAML configuration file
+type WorkerPoolConfig struct {
+	Workers         int `yaml:"workers"`          // number of queries processed at once
+	QueueSize       int `yaml:"queue_size"`       // number of queries waiting for a worker
+	MetricsInterval int `yaml:"metrics_interval"` // number of seconds between two logs of the metrics
+}
+
+// A query read from the UDP socket, waiting for a worker
+type udpRequest struct {
+	buffer           *[]byte // pooled buffer holding the query
+	length           int     // size of the query
+	requesterAddress net.Addr
+}
+
+// The UDP server: a single goroutine reads queries and hands them to a fixed number of workers through a
+// bounded queue. When the queue is full, queries are dropped instead of piling up
+type udpServer struct {
+	conn     *net.UDPConn
+	conf     *Config
+	settings WorkerPoolConfig
+	queue    chan udpRequest
+	buffers  sync.Pool // buffers reused for the queries
+
+	// metrics, updated atomically
+	received uint64 // queries read from the socket
+	dropped  uint64 // queries dropped because the queue was full
+	handled  uint64 // queries processed by a worker
+	busy     int64  // workers processing a query
+	maxQueue int64  // highest queue length since the last log
+
+	stopping int32 // set to 1 when the server is asked to stop reading queries
+}
+
+// Allocate a new UDP server, using default values for the missing settings
+func newUDPServer(conn *net.UDPConn, conf *Config) *udpServer {
+	settings := conf.workerPool
+	if settings.Workers <= 0 {
+		settings.Workers = DEFAULT_UDP_WORKERS
+	}
+	if settings.QueueSize <= 0 {
+		settings.QueueSize = DEFAULT_UDP_QUEUE_SIZE
+	}
+	if settings.MetricsInterval <= 0 {
+		settings.MetricsInterval = DEFAULT_METRICS_INTERVAL
+	}
+
+	server := &udpServer{conn: conn, conf: conf, settings: settings, queue: make(chan udpRequest, settings.QueueSize)}
+	server.buffers.New = func() interface{} {
+		buffer := make([]byte, DEFAULT_BUFFER_SIZE)
+		return &buffer
+	}
+	return server
+}
+
+// Serve UDP queries until the socket is closed or the server is stopped. Queries already queued are processed
+// before returning
+func (server *udpServer) serve() {
+	var wg sync.WaitGroup
+	for i := 0; i < server.settings.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.work()
+		}()
+	}
+
+	stopMetrics := make(chan struct{})
+	go server.logMetrics(stopMetrics)
+
+	for {
+		buffer := server.buffers.Get().(*[]byte)
+		nbBytes, clientAddr, err := server.conn.ReadFrom(*buffer)
+		if err != nil {
+			server.buffers.Put(buffer)
+			if atomic.LoadInt32(&server.stopping) == 1 {
+				break
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Printf("error: <%v> reading bytes from address: <%v>", err, clientAddr)
+				continue
+			}
+			break
+		}
+		atomic.AddUint64(&server.received, 1)
+
+		select {
+		case server.queue <- udpRequest{buffer: buffer, length: nbBytes, requesterAddress: clientAddr}:
+			if queued := int64(len(server.queue)); queued > atomic.LoadInt64(&server.maxQueue) {
+				atomic.StoreInt64(&server.maxQueue, queued)
+			}
+		default:
+			// all workers are busy and the queue is full: the client will retry
+			atomic.AddUint64(&server.dropped, 1)
+			server.buffers.Put(buffer)
+		}
+	}
+
+	close(server.queue)
+	wg.Wait()
+	close(stopMetrics)
+}
+
+// Stop reading queries, without closing the socket so that answers to queued ones can still be sent
+func (server *udpServer) stop() {
+	atomic.StoreInt32(&server.stopping, 1)
+	server.conn.SetReadDeadline(time.Now())
+}
+
+// Process queries from the queue until it's closed
+func (server *udpServer) work() {
+	for request := range server.queue {
+		atomic.AddInt64(&server.busy, 1)
+		if server.conf.debug {
+			log.Printf("%d bytes received from address: %v", request.length, request.requesterAddress)
+		}
+		handleDNSRequest(server.conn, request.requesterAddress, (*request.buffer)[:request.length], server.conf)
+		server.buffers.Put(request.buffer)
+		atomic.AddInt64(&server.busy, -1)
+		atomic.AddUint64(&server.handled, 1)
+	}
+}
+
+// Log the metrics regularly, if some queries were received during the interval, and a last time when stopped
+func (server *udpServer) logMetrics(stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(server.settings.MetricsInterval) * time.Second)
+	defer ticker.Stop()
+
+	var lastReceived, lastDropped, lastHandled uint64
+	for {
+		stopped := false
+		select {
+		case <-stop:
+			stopped = true
+		case <-ticker.C:
+		}
+
+		received, dropped, handled := atomic.LoadUint64(&server.received), atomic.LoadUint64(&server.dropped), atomic.LoadUint64(&server.handled)
+		maxQueue := atomic.SwapInt64(&server.maxQueue, 0)
+		if received != lastReceived {
+			log.Printf("UDP server: %d queries received, %d handled, %d dropped as queue was full, queue length up to %d/%d, %d/%d workers busy",
+				received-lastReceived, handled-lastHandled, dropped-lastDropped, maxQueue, server.settings.QueueSize, atomic.LoadInt64(&server.busy), server.settings.Workers)
+			lastReceived, lastDropped, lastHandled = received, dropped, handled
+		}
+
+		if stopped {
+			return
+		}
+	}
+}
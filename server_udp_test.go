@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Start the UDP server with the configuration, and return it with a function stopping it
+func startUDPServer(t *testing.T, conf *Config) (*udpServer, func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newUDPServer(conn, conf)
+	done := make(chan struct{})
+	go func() {
+		server.serve()
+		close(done)
+	}()
+
+	stop := func() {
+		conn.Close()
+		<-done
+	}
+	t.Cleanup(stop)
+	return server, stop
+}
+
+func TestUDPServer(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := newTestConfig(t)
+	conf.workerPool = WorkerPoolConfig{Workers: 2, QueueSize: 4}
+	server, stop := startUDPServer(t, conf)
+
+	client, err := net.Dial("udp", server.conn.LocalAddr().String())
+	assert.Nil(err)
+	defer client.Close()
+
+	for _, domain := range []string{"printer.lan", "www.foo.com", "printer.lan"} {
+		client.Write(buildQuery(domain, TYPE_A))
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		buffer := make([]byte, DEFAULT_BUFFER_SIZE)
+		n, err := client.Read(buffer)
+		assert.Nil(err)
+		assert.NotEqual(firstAddress(buffer[:n]), "")
+	}
+
+	// serve returns when the socket is closed, once all queries are handled
+	stop()
+	assert.Equal(atomic.LoadUint64(&server.received), uint64(3))
+	assert.Equal(atomic.LoadUint64(&server.handled), uint64(3))
+	assert.Equal(atomic.LoadUint64(&server.dropped), uint64(0))
+}
+
+func TestUDPServerFlood(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	assert := assert.New(t)
+
+	// a slow resolver, so that workers are always busy
+	conf := newTestConfig(t)
+	conf.resolvers = []Upstream{newUDPUpstream(startUDPStandIn(t, delayed(20*time.Millisecond, answerWith("1.2.3.4"))))}
+	conf.workerPool = WorkerPoolConfig{Workers: 8, QueueSize: 32}
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	baseGoroutines := runtime.NumGoroutine()
+
+	server, stop := startUDPServer(t, conf)
+
+	// sample the number of goroutines and the heap while the flood goes on
+	var maxGoroutines int
+	var maxHeap uint64
+	flooding := make(chan struct{})
+	var sampler sync.WaitGroup
+	sampler.Add(1)
+	go func() {
+		defer sampler.Done()
+		for {
+			if n := runtime.NumGoroutine(); n > maxGoroutines {
+				maxGoroutines = n
+			}
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > maxHeap {
+				maxHeap = stats.HeapInuse
+			}
+
+			select {
+			case <-flooding:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	// local generator
+	client, err := net.Dial("udp", server.conn.LocalAddr().String())
+	assert.Nil(err)
+	defer client.Close()
+	query := buildQuery("www.foo.com", TYPE_A)
+	for i := 0; i < 20000; i++ {
+		client.Write(query)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(flooding)
+	sampler.Wait()
+	stop()
+
+	received, handled, dropped := atomic.LoadUint64(&server.received), atomic.LoadUint64(&server.handled), atomic.LoadUint64(&server.dropped)
+	t.Logf("%d queries received, %d handled, %d dropped, up to %d goroutines, heap in use from %d to %d bytes", received, handled, dropped, maxGoroutines, before.HeapInuse, maxHeap)
+
+	// workers, the reader and those of the upstream sockets are the only goroutines added, and memory doesn't
+	// grow with the flood
+	assert.True(maxGoroutines <= baseGoroutines+conf.workerPool.Workers+UDP_UPSTREAM_SOCKETS+4)
+	assert.True(maxHeap < before.HeapInuse+32<<20)
+	assert.True(dropped > 0)
+	assert.Equal(received, handled+dropped)
+}
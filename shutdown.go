@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// default number of seconds queries being processed are given to complete on shutdown
+	DEFAULT_DRAIN_TIMEOUT = 10
+)
+
+// Keep track of the queries being processed, to let them complete on shutdown
+type inflightQueries struct {
+	wg sync.WaitGroup // one for each query being processed
+
+	mu       sync.Mutex // protects the field below
+	stopping bool       // set on shutdown: new queries are no longer processed
+}
+
+// Register a new query. False is returned if shutdown has started, and the query must be ignored
+func (inflight *inflightQueries) start() bool {
+	inflight.mu.Lock()
+	defer inflight.mu.Unlock()
+
+	if inflight.stopping {
+		return false
+	}
+	inflight.wg.Add(1)
+	return true
+}
+
+// Unregister a query once processed
+func (inflight *inflightQueries) done() {
+	inflight.wg.Done()
+}
+
+// Refuse new queries, and wait for the ones being processed. False is returned if some are still
+// running after the timeout
+func (inflight *inflightQueries) drain(timeout time.Duration) bool {
+	inflight.mu.Lock()
+	inflight.stopping = true
+	inflight.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		inflight.wg.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Stop accepting queries, wait for the ones being processed, and release everything. The exit status is
+// returned: 0 if all queries were answered in time, 1 otherwise
+func shutdown(conf *Config, server *udpServer, served chan struct{}, listeners []io.Closer, QUICServer *quic.EarlyListener) int {
+	timeout := time.Duration(conf.drainTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = DEFAULT_DRAIN_TIMEOUT * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	notifyState("STOPPING=1")
+
+	// new packets and connections are no longer accepted, but UDP queries already read are still processed
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	server.stop()
+
+	status := 0
+	select {
+	case <-served:
+	case <-time.After(time.Until(deadline)):
+		log.Printf("error: UDP queries still queued after %v", timeout)
+		status = 1
+	}
+	if !conf.inflight.drain(time.Until(deadline)) {
+		log.Printf("error: queries still being processed after %v", timeout)
+		status = 1
+	}
+
+	if QUICServer != nil {
+		QUICServer.Close()
+	}
+	server.conn.Close()
+	conf.closeUpstreams()
+
+	log.Printf("dnswall stopped")
+	if conf.logFileHAndle != nil {
+		conf.logFileHAndle.Sync()
+		conf.logFileHAndle.Close()
+	}
+	return status
+}
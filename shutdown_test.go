@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflightQueries(t *testing.T) {
+	assert := assert.New(t)
+
+	var inflight inflightQueries
+	assert.True(inflight.start())
+
+	// the query is given time to complete
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		inflight.done()
+	}()
+	assert.True(inflight.drain(time.Second))
+
+	// new queries are refused once draining
+	assert.False(inflight.start())
+
+	// a query still running makes draining fail
+	var stuck inflightQueries
+	assert.True(stuck.start())
+	assert.False(stuck.drain(50 * time.Millisecond))
+}
+
+func TestShutdown(t *testing.T) {
+	for _, test := range []struct {
+		delay  time.Duration // time taken by the resolver to answer
+		status int
+	}{{200 * time.Millisecond, 0}, {3 * time.Second, 1}} {
+		assert := assert.New(t)
+
+		conf := newTestConfig(t)
+		conf.resolvers = []Upstream{newUDPUpstream(startUDPStandIn(t, delayed(test.delay, answerWith("1.2.3.4"))))}
+		conf.drainTimeout = 1
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		assert.Nil(err)
+		server := newUDPServer(conn, conf)
+		served := make(chan struct{})
+		go func() {
+			server.serve()
+			close(served)
+		}()
+
+		client, err := net.Dial("udp", conn.LocalAddr().String())
+		assert.Nil(err)
+		defer client.Close()
+		client.Write(buildQuery("www.foo.com", TYPE_A))
+		time.Sleep(50 * time.Millisecond)
+
+		// the query being processed is answered before the socket is closed, unless it takes too long
+		assert.Equal(shutdown(conf, server, served, nil, nil), test.status)
+
+		buffer := make([]byte, DEFAULT_BUFFER_SIZE)
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := client.Read(buffer)
+		if test.status == 0 {
+			assert.Nil(err)
+			assert.Equal(firstAddress(buffer[:n]), "1.2.3.4")
+		} else {
+			assert.NotNil(err)
+		}
+
+		// new queries are ignored
+		writer := new(bufferResponseWriter)
+		handleDNSRequest(writer, client.LocalAddr(), buildQuery("printer.lan", TYPE_A), conf)
+		assert.Nil(writer.buffer)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const (
+	// a snapshot starts with this magic, followed by the version, the length of the payload and its CRC32
+	SNAPSHOT_MAGIC       = "DNSWALL\x00"
+	SNAPSHOT_VERSION     = 4
+	SNAPSHOT_HEADER_SIZE = len(SNAPSHOT_MAGIC) + 2 + 4 + 4
+
+	// kind of lists found in a snapshot
+	SNAPSHOT_BLACKLIST   = 0
+	SNAPSHOT_WHITELIST   = 1
+	SNAPSHOT_IPBLACKLIST = 2
+	SNAPSHOT_REWRITE     = 3
+)
+
+// A list the snapshot was compiled from. The snapshot is stale as soon as one of them changes
+type snapshotSource struct {
+	kind      byte
+	path      string
+	format    string
+	cname     bool
+	maxErrors int
+	size      int64
+	modTime   int64
+	list      *FilterList // list of the configuration file, nil for IP lists
+}
+
+// List the sources of a snapshot from the configuration file, in the order they're read
+func snapshotSources(settings *FiltersConfig) ([]snapshotSource, error) {
+	sources := []snapshotSource{}
+	add := func(kind byte, path string, list *FilterList) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		source := snapshotSource{kind: kind, path: path, maxErrors: settings.maxErrors(), size: info.Size(), modTime: info.ModTime().UnixNano(), list: list}
+		if list != nil {
+			source.format, source.cname = list.Format, list.CNAME
+			if list.MaxErrors != nil {
+				source.maxErrors = *list.MaxErrors
+			}
+		}
+		sources = append(sources, source)
+		return nil
+	}
+
+	for i := range settings.Blacklist {
+		if err := add(SNAPSHOT_BLACKLIST, settings.Blacklist[i].Path, &settings.Blacklist[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range settings.Whitelist {
+		if err := add(SNAPSHOT_WHITELIST, settings.Whitelist[i].Path, &settings.Whitelist[i]); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range settings.IPBlacklist {
+		if err := add(SNAPSHOT_IPBLACKLIST, path, nil); err != nil {
+			return nil, err
+		}
+	}
+	for i := range settings.Rewrite {
+		if err := add(SNAPSHOT_REWRITE, settings.Rewrite[i].Path, &settings.Rewrite[i]); err != nil {
+			return nil, err
+		}
+	}
+	return sources, nil
+}
+
+// Load the lists from the snapshot if it's up to date, from the lists themselves otherwise
+func (fd *FilteredDomains) load(settings *FiltersConfig) {
+	if settings.Snapshot != "" {
+		start := time.Now()
+		err := fd.readSnapshot(settings.Snapshot, settings)
+		if err == nil {
+			log.Printf("lists loaded from snapshot <%s> in %v", settings.Snapshot, time.Since(start))
+			return
+		}
+		log.Printf("error: <%v> when loading snapshot <%s>, reading lists instead", err, settings.Snapshot)
+		fd.init()
+	}
+	fd.readLists(settings)
+}
+
+// Write the rules in use to a snapshot file, along with the state of the lists they're coming from. Duplicates
+// and shadowed domains are not written. The file is replaced atomically
+func (fd *FilteredDomains) writeSnapshot(path string, settings *FiltersConfig) error {
+	sources, err := snapshotSources(settings)
+	if err != nil {
+		return err
+	}
+	if len(sources) != len(fd.reports) {
+		return errors.New("lists were not all read")
+	}
+	index := make(map[*FilterList]int)
+	for i := range sources {
+		if sources[i].list != nil {
+			index[sources[i].list] = i
+		}
+	}
+
+	var payload []byte
+	payload = binary.AppendUvarint(payload, uint64(len(sources)))
+	for i, source := range sources {
+		payload = append(payload, source.kind)
+		payload = appendString(payload, source.path)
+		payload = appendString(payload, source.format)
+		payload = appendBool(payload, source.cname)
+		payload = binary.AppendVarint(payload, int64(source.maxErrors))
+		payload = binary.AppendVarint(payload, source.size)
+		payload = binary.AppendVarint(payload, source.modTime)
+
+		// what was loaded from the list is kept, to be reported when loading the snapshot
+		report := fd.reports[i]
+		payload = binary.AppendUvarint(payload, uint64(report.Loaded))
+		payload = binary.AppendUvarint(payload, uint64(report.Duplicates))
+		payload = binary.AppendUvarint(payload, uint64(report.Shadowed))
+		payload = binary.AppendUvarint(payload, uint64(len(report.Errors)))
+		for _, lineErr := range report.Errors {
+			payload = binary.AppendUvarint(payload, uint64(lineErr.Line))
+			payload = appendString(payload, lineErr.Reason)
+		}
+		reportErr := ""
+		if report.Err != nil {
+			reportErr = report.Err.Error()
+		}
+		payload = appendString(payload, reportErr)
+	}
+
+	for _, filter := range []*RegexpFilter{&fd.blackList, &fd.whiteList} {
+		payload = binary.AppendUvarint(payload, uint64(len(filter.exprList)))
+		for i, re := range filter.exprList {
+			payload = binary.AppendUvarint(payload, uint64(index[filter.lists[i]]))
+			payload = binary.AppendUvarint(payload, uint64(filter.lines[i]))
+			payload = appendString(payload, re.String())
+			payload = appendString(payload, filter.globs[i])
+			payload = appendQTypes(payload, filter.qtypes[i])
+		}
+
+		payload = binary.AppendUvarint(payload, uint64(filter.domains.len()))
+		for _, rule := range filter.domains.rules {
+			if rule.shadowed {
+				continue
+			}
+			payload = binary.AppendUvarint(payload, uint64(index[rule.List]))
+			payload = binary.AppendUvarint(payload, uint64(rule.Line))
+			payload = appendString(payload, rule.Domain)
+		}
+	}
+
+	payload = binary.AppendUvarint(payload, uint64(len(fd.ipBlackList.netList)))
+	for _, ipNet := range fd.ipBlackList.netList {
+		payload = appendString(payload, ipNet.String())
+	}
+
+	payload = binary.AppendUvarint(payload, uint64(fd.rewrites.len()))
+	for _, rule := range fd.rewrites.rules {
+		payload = binary.AppendUvarint(payload, uint64(index[rule.List]))
+		payload = binary.AppendUvarint(payload, uint64(rule.Line))
+		payload = appendString(payload, rule.Domain+" "+rule.targets())
+	}
+
+	// header
+	snapshot := []byte(SNAPSHOT_MAGIC)
+	snapshot = binary.BigEndian.AppendUint16(snapshot, SNAPSHOT_VERSION)
+	snapshot = binary.BigEndian.AppendUint32(snapshot, uint32(len(payload)))
+	snapshot = binary.BigEndian.AppendUint32(snapshot, crc32.ChecksumIEEE(payload))
+	snapshot = append(snapshot, payload...)
+
+	// written aside first, for a snapshot being loaded to never be partially written
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load the rules from a snapshot file. An error is returned if the snapshot is corrupted, or stale: the lists
+// of the configuration file are not the ones it was compiled from, or one of them changed since
+func (fd *FilteredDomains) readSnapshot(path string, settings *FiltersConfig) error {
+	snapshot, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// check header
+	if len(snapshot) < SNAPSHOT_HEADER_SIZE || string(snapshot[:len(SNAPSHOT_MAGIC)]) != SNAPSHOT_MAGIC {
+		return errors.New("not a snapshot file")
+	}
+	header := snapshot[len(SNAPSHOT_MAGIC):]
+	if version := binary.BigEndian.Uint16(header); version != SNAPSHOT_VERSION {
+		return fmt.Errorf("snapshot version %d is not supported", version)
+	}
+	payload := snapshot[SNAPSHOT_HEADER_SIZE:]
+	if int(binary.BigEndian.Uint32(header[2:])) != len(payload) || binary.BigEndian.Uint32(header[6:]) != crc32.ChecksumIEEE(payload) {
+		return errors.New("snapshot is corrupted")
+	}
+
+	// the lists must be the ones of the configuration file, unchanged
+	sources, err := snapshotSources(settings)
+	if err != nil {
+		return fmt.Errorf("snapshot is stale: %v", err)
+	}
+	rdr := &snapshotReader{buffer: payload}
+	if int(rdr.uvarint()) != len(sources) {
+		return errors.New("snapshot is stale: lists are not the same")
+	}
+	reports := make([]*ListReport, 0, len(sources))
+	for _, source := range sources {
+		stored := snapshotSource{kind: rdr.byte(), path: rdr.string(), format: rdr.string(), cname: rdr.bool(),
+			maxErrors: int(rdr.varint()), size: rdr.varint(), modTime: rdr.varint(), list: source.list}
+		if rdr.err == nil && stored != source {
+			return fmt.Errorf("snapshot is stale: list <%s> changed", source.path)
+		}
+
+		report := &ListReport{Path: source.path, Loaded: int(rdr.uvarint()), Duplicates: int(rdr.uvarint()), Shadowed: int(rdr.uvarint())}
+		for n := rdr.uvarint(); n > 0 && rdr.err == nil; n-- {
+			report.Errors = append(report.Errors, LineError{Line: int(rdr.uvarint()), Reason: rdr.string()})
+		}
+		if reportErr := rdr.string(); reportErr != "" {
+			report.Err = errors.New(reportErr)
+		}
+		reports = append(reports, report)
+	}
+
+	// rules are read in the same order they were written
+	source := func() *FilterList {
+		i := rdr.uvarint()
+		if i >= uint64(len(sources)) || sources[i].list == nil {
+			rdr.fail()
+			return nil
+		}
+		return sources[i].list
+	}
+	for _, filter := range []*RegexpFilter{&fd.blackList, &fd.whiteList} {
+		for n := rdr.uvarint(); n > 0 && rdr.err == nil; n-- {
+			list, line, text, glob, qtypes := source(), int(rdr.uvarint()), rdr.string(), rdr.string(), rdr.qtypes()
+			re, err := regexp.Compile(text)
+			if err != nil {
+				return fmt.Errorf("snapshot is corrupted: %v", err)
+			}
+			filter.addRegexp(re, glob, qtypes, list, line)
+		}
+		for n := rdr.uvarint(); n > 0 && rdr.err == nil; n-- {
+			list, line, domain := source(), int(rdr.uvarint()), rdr.string()
+			if list != nil {
+				filter.domains.insert(DomainRule{Domain: domain, List: list, Line: line})
+			}
+		}
+	}
+	for n := rdr.uvarint(); n > 0 && rdr.err == nil; n-- {
+		ipNet, err := parseIPNet(rdr.string())
+		if err != nil {
+			return fmt.Errorf("snapshot is corrupted: %v", err)
+		}
+		fd.ipBlackList.netList = append(fd.ipBlackList.netList, ipNet)
+	}
+	for n := rdr.uvarint(); n > 0 && rdr.err == nil; n-- {
+		list, line, text := source(), int(rdr.uvarint()), rdr.string()
+		domain, target, ips, err := parseRewriteLine(text)
+		if err != nil {
+			return fmt.Errorf("snapshot is corrupted: %v", err)
+		}
+		fd.rewrites.add(&RewriteRule{Domain: domain, Target: target, IPs: ips, List: list, Line: line})
+	}
+
+	if rdr.err != nil {
+		return rdr.err
+	}
+	fd.blackList.buildIndex()
+	fd.whiteList.buildIndex()
+	fd.reports = reports
+	return nil
+}
+
+// Append a string, preceded by its length
+func appendString(buffer []byte, s string) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(s)))
+	return append(buffer, s...)
+}
+
+// Append a boolean as a single byte
+func appendBool(buffer []byte, b bool) []byte {
+	if b {
+		return append(buffer, 1)
+	}
+	return append(buffer, 0)
+}
+
+// Append the query types a rule is limited to, preceded by their number plus one, 0 meaning all of them
+func appendQTypes(buffer []byte, qtypes []uint16) []byte {
+	if qtypes == nil {
+		return binary.AppendUvarint(buffer, 0)
+	}
+	buffer = binary.AppendUvarint(buffer, uint64(len(qtypes)+1))
+	for _, qtype := range qtypes {
+		buffer = binary.AppendUvarint(buffer, uint64(qtype))
+	}
+	return buffer
+}
+
+// Decode the payload of a snapshot. Once an error is met, it's kept and zero values are returned
+type snapshotReader struct {
+	buffer []byte
+	err    error
+}
+
+// Record that the payload is not what's expected
+func (rdr *snapshotReader) fail() {
+	if rdr.err == nil {
+		rdr.err = errors.New("snapshot is corrupted")
+	}
+	rdr.buffer = nil
+}
+
+// Read an unsigned integer
+func (rdr *snapshotReader) uvarint() uint64 {
+	value, n := binary.Uvarint(rdr.buffer)
+	if n <= 0 {
+		rdr.fail()
+		return 0
+	}
+	rdr.buffer = rdr.buffer[n:]
+	return value
+}
+
+// Read a signed integer
+func (rdr *snapshotReader) varint() int64 {
+	value, n := binary.Varint(rdr.buffer)
+	if n <= 0 {
+		rdr.fail()
+		return 0
+	}
+	rdr.buffer = rdr.buffer[n:]
+	return value
+}
+
+// Read a single byte
+func (rdr *snapshotReader) byte() byte {
+	if len(rdr.buffer) == 0 {
+		rdr.fail()
+		return 0
+	}
+	b := rdr.buffer[0]
+	rdr.buffer = rdr.buffer[1:]
+	return b
+}
+
+// Read a boolean written by appendBool
+func (rdr *snapshotReader) bool() bool {
+	return rdr.byte() == 1
+}
+
+// Read a string written by appendString
+func (rdr *snapshotReader) string() string {
+	length := rdr.uvarint()
+	if length > uint64(len(rdr.buffer)) {
+		rdr.fail()
+		return ""
+	}
+	s := string(rdr.buffer[:length])
+	rdr.buffer = rdr.buffer[length:]
+	return s
+}
+
+// Read query types written by appendQTypes
+func (rdr *snapshotReader) qtypes() []uint16 {
+	n := rdr.uvarint()
+	if n == 0 {
+		return nil
+	}
+	if n-1 > uint64(len(rdr.buffer)) {
+		rdr.fail()
+		return nil
+	}
+	qtypes := make([]uint16, 0, n-1)
+	for ; n > 1; n-- {
+		qtype := rdr.uvarint()
+		if qtype == 0 || qtype > 0xffff {
+			rdr.fail()
+			return nil
+		}
+		qtypes = append(qtypes, uint16(qtype))
+	}
+	return qtypes
+}
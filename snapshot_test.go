@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Lists of all kinds, written in a temporary directory
+func snapshotSettings(t *testing.T) *FiltersConfig {
+	return &FiltersConfig{
+		Blacklist: []FilterList{
+			{Path: "./tests/blacklist.1", CNAME: true},
+			{Path: writeList(t, "ads.example.com\nexample.net\nwww.example.net\nads*.example.org\ntracker.org$qtype=AAAA\n"), Format: LIST_DOMAINS, CNAME: false},
+		},
+		Whitelist:   []FilterList{{Path: "./tests/whitelist.1", CNAME: true}},
+		IPBlacklist: []string{"./tests/ipblacklist.1"},
+		Rewrite:     []FilterList{{Path: "./tests/rewrite.1"}},
+		Snapshot:    filepath.Join(t.TempDir(), "dnswall.snapshot"),
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	settings := snapshotSettings(t)
+	var lists FilteredDomains
+	lists.init()
+	lists.readLists(settings)
+	assert.Nil(lists.writeSnapshot(settings.Snapshot, settings))
+
+	// same rules, coming from the same lines of the same lists
+	var fd FilteredDomains
+	fd.init()
+	assert.Nil(fd.readSnapshot(settings.Snapshot, settings))
+	assert.Equal(len(fd.blackList.exprList), 13)
+	assert.Equal(fd.blackList.domains.len(), 2)
+	assert.Equal(len(fd.ipBlackList.netList), 4)
+	assert.Equal(fd.rewrites.len(), 7)
+	assert.Equal(*fd.rewrites.match("api.internal"), *lists.rewrites.match("api.internal"))
+	assert.Same(fd.rewrites.match("www.google.com").List, &settings.Rewrite[0])
+	for _, domain := range []string{"adtracking.foo.com", "www.ads.example.com", "www.example.net", "www.yandex.com", "www.foo.com", "ads1.example.org"} {
+		assert.Equal(fd.match(domain, TYPE_A), lists.match(domain, TYPE_A), domain)
+	}
+	assert.Same(fd.match("www.example.net", TYPE_A).Block.List, &settings.Blacklist[1])
+	assert.Equal(fd.match("ads1.example.org", TYPE_A).Block.Rule, "ads*.example.org")
+	assert.Equal(fd.match("www.tracker.org", TYPE_AAAA).Block.Rule, "tracker.org$qtype=AAAA")
+	assert.False(fd.match("www.tracker.org", TYPE_A).Blocked)
+	assert.Equal(fd.reports[1].Shadowed, 1)
+	assert.False(fd.blackList.matchCNAME("www.example.net", TYPE_A))
+
+	// loaded at startup
+	fd.init()
+	fd.load(settings)
+	assert.Equal(fd.blackList.domains.len(), 2)
+
+	// stale once a list changes
+	later := time.Now().Add(time.Minute)
+	assert.Nil(os.Chtimes(settings.Blacklist[1].Path, later, later))
+	fd.init()
+	assert.ErrorContains(fd.readSnapshot(settings.Snapshot, settings), "stale")
+
+	// or when lists or their options are not the same
+	settings = snapshotSettings(t)
+	assert.Nil(lists.writeSnapshot(settings.Snapshot, settings))
+	settings.Whitelist[0].CNAME = false
+	assert.ErrorContains(fd.readSnapshot(settings.Snapshot, settings), "stale")
+	settings.Whitelist = nil
+	assert.ErrorContains(fd.readSnapshot(settings.Snapshot, settings), "stale")
+
+	// lists are read when the snapshot can't be used
+	fd.init()
+	fd.load(settings)
+	assert.Equal(len(fd.reports), 4)
+	assert.Equal(len(fd.whiteList.exprList), 0)
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	assert := assert.New(t)
+
+	settings := snapshotSettings(t)
+	var lists FilteredDomains
+	lists.init()
+	lists.readLists(settings)
+	assert.Nil(lists.writeSnapshot(settings.Snapshot, settings))
+	snapshot, err := os.ReadFile(settings.Snapshot)
+	assert.Nil(err)
+
+	var fd FilteredDomains
+	write := func(content []byte) error {
+		assert.Nil(os.WriteFile(settings.Snapshot, content, 0o600))
+		fd.init()
+		return fd.readSnapshot(settings.Snapshot, settings)
+	}
+
+	corrupted := append([]byte{}, snapshot...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	assert.ErrorContains(write(corrupted), "corrupted")
+	assert.ErrorContains(write(snapshot[:len(snapshot)-1]), "corrupted")
+
+	corrupted = append([]byte{}, snapshot...)
+	corrupted[len(SNAPSHOT_MAGIC)+1] = SNAPSHOT_VERSION + 1
+	assert.ErrorContains(write(corrupted), "version")
+
+	assert.ErrorContains(write([]byte("^ads\\.\n")), "not a snapshot")
+	assert.Nil(write(snapshot))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// first file descriptor passed by systemd: https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+	SD_LISTEN_FDS_START = 3
+
+	// names of the sockets passed by systemd (FileDescriptorName= in the socket unit), one for each listener
+	SD_NAME_DNS     = "dns"     // plain DNS over UDP
+	SD_NAME_DNS_TCP = "dns-tcp" // plain DNS over TCP
+	SD_NAME_DOT     = "dot"     // DNS over TLS
+	SD_NAME_DOH     = "doh"     // DNS over HTTPS
+	SD_NAME_DOQ     = "doq"     // DNS over QUIC
+	SD_NAME_NONE    = "unknown"
+)
+
+// Sockets opened by systemd and passed to dnswall (socket activation), indexed by name
+type activatedSockets struct {
+	files map[string]*os.File
+}
+
+// Get the sockets passed by systemd, if any, from the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment
+// variables. These variables are then removed, so that they're not inherited by child processes. A single
+// socket is the one of plain DNS, unless it's named after another listener: systemd names it after the socket
+// unit (e.g.: dnswall.socket) when FileDescriptorName= is not set
+func listenFDs() (*activatedSockets, error) {
+	sockets := &activatedSockets{files: make(map[string]*os.File)}
+
+	pid, count, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// sockets are meant for another process
+	if count == "" || pid != strconv.Itoa(os.Getpid()) {
+		return sockets, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS <%s>", count)
+	}
+	nameList := []string{}
+	if names != "" {
+		nameList = strings.Split(names, ":")
+	}
+
+	for i := 0; i < n; i++ {
+		name := SD_NAME_NONE
+		if i < len(nameList) && nameList[i] != "" {
+			name = nameList[i]
+		}
+		if n == 1 && !knownSocketName(name) {
+			name = SD_NAME_DNS
+		}
+		if _, found := sockets.files[name]; found {
+			return nil, fmt.Errorf("several sockets passed by systemd are named <%s>", name)
+		}
+
+		fd := SD_LISTEN_FDS_START + i
+		closeOnExec(fd)
+		sockets.files[name] = os.NewFile(uintptr(fd), name)
+	}
+
+	return sockets, nil
+}
+
+// Return true if the name is the one of a listener
+func knownSocketName(name string) bool {
+	switch name {
+	case SD_NAME_DNS, SD_NAME_DNS_TCP, SD_NAME_DOT, SD_NAME_DOH, SD_NAME_DOQ:
+		return true
+	}
+	return false
+}
+
+// Return the stream listener passed under the name, nil if none
+func (sockets *activatedSockets) listener(name string) (net.Listener, error) {
+	file := sockets.take(name)
+	if file == nil {
+		return nil, nil
+	}
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("socket <%s> passed by systemd: %v", name, err)
+	}
+	return listener, nil
+}
+
+// Return the UDP socket passed under the name, nil if none
+func (sockets *activatedSockets) packetConn(name string) (*net.UDPConn, error) {
+	file := sockets.take(name)
+	if file == nil {
+		return nil, nil
+	}
+	defer file.Close()
+
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, fmt.Errorf("socket <%s> passed by systemd: %v", name, err)
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("socket <%s> passed by systemd is not a UDP socket", name)
+	}
+	return udpConn, nil
+}
+
+// Return true if a socket was passed under the name, and is not used yet
+func (sockets *activatedSockets) has(name string) bool {
+	_, found := sockets.files[name]
+	return found
+}
+
+// Remove the socket passed under the name from the list, to be used
+func (sockets *activatedSockets) take(name string) *os.File {
+	file := sockets.files[name]
+	delete(sockets.files, name)
+	return file
+}
+
+// Close the sockets which were not used by any listener
+func (sockets *activatedSockets) closeUnused() {
+	for name, file := range sockets.files {
+		log.Printf("error: socket <%s> passed by systemd is not used by any listener", name)
+		file.Close()
+	}
+	sockets.files = make(map[string]*os.File)
+}
+
+// Send a state to the service manager over the socket given by NOTIFY_SOCKET
+// (https://www.freedesktop.org/software/systemd/man/sd_notify.html). Nothing is done if it's not set
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// abstract socket
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Report a state change to the service manager, logging errors
+func notifyState(state string) {
+	if err := sdNotify(state); err != nil {
+		log.Printf("error: <%v> when notifying systemd of <%s>", err, state)
+	}
+}
+
+// Report that the configuration is being reloaded. The monotonic time is required for Type=notify-reload services
+func notifyReloading() {
+	state := "RELOADING=1"
+	if usec := monotonicUsec(); usec != 0 {
+		state += fmt.Sprintf("\nMONOTONIC_USEC=%d", usec)
+	}
+	notifyState(state)
+}
+
+// Return the interval between two watchdog pings: half the timeout given by systemd in WATCHDOG_USEC, 0 if
+// the watchdog is not enabled for this process
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// Ping the systemd watchdog regularly, until stopped
+func watchdog(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			notifyState("WATCHDOG=1")
+		}
+	}
+}
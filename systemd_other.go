@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+// File descriptors are not passed by systemd on this system
+func closeOnExec(fd int) {
+}
+
+// The monotonic clock used by systemd is not available
+func monotonicUsec() int64 {
+	return 0
+}
@@ -0,0 +1,171 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Stand in for systemd: listen to notifications on a unix datagram socket, and return them as they come
+func startNotifySocket(t *testing.T, socketPath string) chan string {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if strings.HasPrefix(socketPath, "\x00") {
+		socketPath = "@" + socketPath[1:]
+	}
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+
+	states := make(chan string, 16)
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			states <- string(buffer[:n])
+		}
+	}()
+	return states
+}
+
+// Wait for the next notification
+func nextState(t *testing.T, states chan string) string {
+	select {
+	case state := <-states:
+		return state
+	case <-time.After(time.Second):
+		t.Fatal("no notification received")
+	}
+	return ""
+}
+
+func TestSdNotify(t *testing.T) {
+	assert := assert.New(t)
+
+	// not run by systemd
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.Nil(sdNotify("READY=1"))
+
+	states := startNotifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	notifyState("READY=1")
+	assert.Equal(nextState(t, states), "READY=1")
+	notifyReloading()
+	assert.Regexp(`^RELOADING=1\nMONOTONIC_USEC=\d+$`, nextState(t, states))
+
+	// abstract socket
+	states = startNotifySocket(t, fmt.Sprintf("\x00dnswall-test-%d", os.Getpid()))
+	notifyState("STOPPING=1")
+	assert.Equal(nextState(t, states), "STOPPING=1")
+}
+
+func TestWatchdog(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("WATCHDOG_USEC", "")
+	assert.Equal(watchdogInterval(), time.Duration(0))
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", "1")
+	assert.Equal(watchdogInterval(), time.Duration(0))
+	t.Setenv("WATCHDOG_PID", fmt.Sprint(os.Getpid()))
+	assert.Equal(watchdogInterval(), 50*time.Millisecond)
+
+	states := startNotifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	stop := make(chan struct{})
+	go watchdog(watchdogInterval(), stop)
+	assert.Equal(nextState(t, states), "WATCHDOG=1")
+	assert.Equal(nextState(t, states), "WATCHDOG=1")
+	close(stop)
+}
+
+// Not a real test: the child process started by TestListenFDs, getting sockets as if started by systemd
+func TestListenFDsHelper(t *testing.T) {
+	if os.Getenv("DNSWALL_LISTEN_FDS") == "" {
+		t.Skip("only run as a child process")
+	}
+
+	// process ID is only known once started
+	os.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()))
+	os.Setenv("LISTEN_FDS", os.Getenv("DNSWALL_LISTEN_FDS"))
+
+	sockets, err := listenFDs()
+	if err != nil {
+		fmt.Printf("err=%v\n", err)
+		os.Exit(0)
+	}
+	udp, err := sockets.packetConn(SD_NAME_DNS)
+	if err != nil {
+		fmt.Printf("err=%v\n", err)
+		os.Exit(0)
+	}
+	if udp != nil {
+		fmt.Printf("dns=%v\n", udp.LocalAddr())
+	}
+	tcp, _ := sockets.listener(SD_NAME_DOT)
+	if tcp != nil {
+		fmt.Printf("dot=%v\n", tcp.Addr())
+	}
+	fmt.Printf("env=%q\n", os.Getenv("LISTEN_FDS")+os.Getenv("LISTEN_PID")+os.Getenv("LISTEN_FDNAMES"))
+	os.Exit(0)
+}
+
+func TestListenFDs(t *testing.T) {
+	assert := assert.New(t)
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(err)
+	defer udp.Close()
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(err)
+	defer tcp.Close()
+	udpFile, _ := udp.File()
+	defer udpFile.Close()
+	tcpFile, _ := tcp.File()
+	defer tcpFile.Close()
+
+	run := func(count string, names string, files ...*os.File) string {
+		cmd := exec.Command(os.Args[0], "-test.run=TestListenFDsHelper")
+		cmd.Env = append(os.Environ(), "DNSWALL_LISTEN_FDS="+count, "LISTEN_FDNAMES="+names)
+		cmd.ExtraFiles = files
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, output)
+		}
+		return string(output)
+	}
+
+	// sockets are found by name, and variables are removed
+	output := run("2", "dot:dns", tcpFile, udpFile)
+	assert.Contains(output, "dns="+udp.LocalAddr().String())
+	assert.Contains(output, "dot="+tcp.Addr().String())
+	assert.Contains(output, `env=""`)
+
+	// a single socket without name is the plain DNS one
+	output = run("1", "", udpFile)
+	assert.Contains(output, "dns="+udp.LocalAddr().String())
+
+	// systemd names it after the socket unit by default
+	output = run("1", "dnswall.socket", udpFile)
+	assert.Contains(output, "dns="+udp.LocalAddr().String())
+
+	// unless it's named after another listener
+	output = run("1", "dot", tcpFile)
+	assert.Contains(output, "dot="+tcp.Addr().String())
+	assert.NotContains(output, "dns=")
+
+	// wrong kind of socket
+	assert.Contains(run("1", "dns", tcpFile), "err=")
+}
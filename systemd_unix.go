@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Don't let the file descriptor be inherited by child processes
+func closeOnExec(fd int) {
+	unix.CloseOnExec(fd)
+}
+
+// Return the time of the monotonic clock, in microseconds, as used by systemd
+func monotonicUsec() int64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return ts.Nano() / 1000
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	// "bufio"
-	"fmt"
-	// "log"
-	// "os"
+// "bufio"
+// "fmt"
+// "log"
+// "os"
 )
 
 // //-----------------------------------------------------------
@@ -40,6 +40,7 @@ import (
 type Node struct {
 	data     rune
 	children []*Node
+	value    int // set on the last node of an inserted string, 0 if no string ends here
 }
 
 // Allocate a new node
@@ -74,18 +75,18 @@ func (n *Node) addNode(char rune) *Node {
 		return node
 	}
 
+	// the char is already there: just reuse its node
 	if nref := n.getNode(char); nref != nil {
-		nref.children = append(n.children, node)
-	} else {
-		// if not, just append it
-		n.children = append(n.children, node)
+		return nref
 	}
 
+	// if not, just append it
+	n.children = append(n.children, node)
 	return node
 }
 
-// Insert a whole string in the tree
-func (n *Node) Insert(domain string) {
+// Insert a whole string in the tree, and return the node of its last char
+func (n *Node) Insert(domain string) *Node {
 
 	// we'll loop using this node
 	currentNode := n
@@ -96,10 +97,20 @@ func (n *Node) Insert(domain string) {
 		// create a new Node pointer based a char pointed by the c variable
 		node := currentNode.addNode(c)
 
-		fmt.Printf("c=%c, length=%d\n", c, len(currentNode.children))
-
 		currentNode = node
 	}
+
+	return currentNode
+}
+
+// Call f for each node of the tree holding a value, starting from this one
+func (n *Node) walk(f func(node *Node)) {
+	if n.value != 0 {
+		f(n)
+	}
+	for _, c := range n.children {
+		c.walk(f)
+	}
 }
 
 // // Output a tree as a graphviz .dot
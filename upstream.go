@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// how long we wait for an upstream resolver to answer before trying the next one
+	UPSTREAM_TIMEOUT = 5 * time.Second
+)
+
+// An upstream resolver to which non-blocked queries are forwarded
+type Upstream interface {
+	exchange(query []byte) ([]byte, error) // send the query and wait for the answer
+	close()                                // release the connections kept open, on shutdown
+	String() string                        // address used in logs
+}
+
+// An upstream truncating the answers too large for its transport, which can send the query again over TCP
+type TCPFallbackUpstream interface {
+	exchangeTCP(query []byte) ([]byte, error) // send the query over TCP and wait for the whole answer
+}
+
+// Error returned for queries sent to an upstream which has been closed
+var errUpstreamClosed = errors.New("upstream closed")
+
+// A resolver as found in the YAML configuration file. It's either a single address, or a mapping
+// with the "address" key and options. The address scheme gives the protocol:
+//
+//	1.1.1.1 or udp://1.1.1.1:53             plain DNS over UDP
+//	tls://1.1.1.1:853#cloudflare-dns.com    DNS over TLS, server name after the #
+//	https://cloudflare-dns.com/dns-query    DNS over HTTPS
+//	quic://dns.adguard-dns.com:853          DNS over QUIC, server name after the # as for TLS
+//	sdns://AQcAAAAAAAAA...                  DNSCrypt, resolver and provider key given by the DNS stamp
+type ResolverConfig struct {
+	Address   string   `yaml:"address"`    // resolver address, including the scheme
+	SPKIPins  []string `yaml:"spki_pins"`  // base64 SHA-256 digests of the accepted public keys (TLS, HTTPS and QUIC only)
+	CAFile    string   `yaml:"ca_file"`    // PEM file of the CA certificates used instead of the system ones (TLS, HTTPS and QUIC only)
+	Bootstrap []string `yaml:"bootstrap"`  // IP addresses of the resolver host, to not resolve it through dnswall (HTTPS only)
+	Allow0RTT bool     `yaml:"allow_0rtt"` // send queries in 0-RTT data when resuming a session, even though they can be replayed (QUIC only)
+}
+
+// Decode a resolver from the YAML configuration file, either as a scalar or a mapping
+func (resolver *ResolverConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&resolver.Address)
+	}
+
+	// use another type to not recurse into this method
+	type plain ResolverConfig
+	return value.Decode((*plain)(resolver))
+}
+
+// Build an upstream resolver from its specification in the configuration
+func newUpstream(resolver ResolverConfig) (Upstream, error) {
+	switch {
+	case strings.HasPrefix(resolver.Address, "tls://"):
+		address, serverName := splitServerName(strings.TrimPrefix(resolver.Address, "tls://"))
+
+		rootCAs, err := readCAFile(resolver.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		return newTLSUpstream(withDefaultPort(address, "853"), serverName, resolver.SPKIPins, rootCAs)
+
+	case strings.HasPrefix(resolver.Address, "https://"):
+		rootCAs, err := readCAFile(resolver.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		return newHTTPSUpstream(resolver.Address, resolver.Bootstrap, resolver.SPKIPins, rootCAs)
+
+	case strings.HasPrefix(resolver.Address, "quic://"):
+		address, serverName := splitServerName(strings.TrimPrefix(resolver.Address, "quic://"))
+
+		rootCAs, err := readCAFile(resolver.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		return newQUICUpstream(withDefaultPort(address, "853"), serverName, resolver.SPKIPins, rootCAs, resolver.Allow0RTT)
+
+	case strings.HasPrefix(resolver.Address, "sdns://"):
+		return newDNSCryptUpstream(resolver.Address)
+	}
+
+	return newUDPUpstream(withDefaultPort(strings.TrimPrefix(resolver.Address, "udp://"), "53")), nil
+}
+
+// Split an address like 1.1.1.1:853#cloudflare-dns.com into the address and the server name. If no server name
+// is given, the host is used
+func splitServerName(address string) (string, string) {
+	if i := strings.Index(address, "#"); i != -1 {
+		return address[:i], address[i+1:]
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return address, strings.Trim(host, "[]")
+}
+
+// Read a PEM file holding CA certificates. An empty file name means system CAs are used
+func readCAFile(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in <%s>", caFile)
+	}
+	return pool, nil
+}
+
+// Add a port to an address if missing. IPv6 addresses can be given without brackets
+func withDefaultPort(address string, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
+
+// Return a random DNS message ID
+func randomID() uint16 {
+	var buffer [2]byte
+	rand.Read(buffer[:])
+	return binary.BigEndian.Uint16(buffer[:])
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+const (
+	// first bytes of a certificate, and of an answer: https://dnscrypt.info/protocol
+	DNSCRYPT_CERT_MAGIC     = "DNSC"
+	DNSCRYPT_RESOLVER_MAGIC = "r6fnvWj8"
+
+	// encryption systems, as found in certificates
+	DNSCRYPT_XSALSA20POLY1305  uint16 = 1
+	DNSCRYPT_XCHACHA20POLY1305 uint16 = 2
+
+	// size of a certificate without extensions
+	DNSCRYPT_CERT_SIZE = 124
+
+	// queries are padded to a multiple of the block size, and at least to the minimum size over UDP
+	DNSCRYPT_PADDING_BLOCK  = 64
+	DNSCRYPT_MIN_QUERY_SIZE = 256
+
+	// certificates are fetched again at least this often, to know about rotations before the current one expires
+	DNSCRYPT_CERT_REFRESH = time.Hour
+
+	// default port of DNSCrypt resolvers
+	DNSCRYPT_DEFAULT_PORT = "443"
+)
+
+// DNSCrypt version 2, as described in https://dnscrypt.info/protocol. The resolver is given by a DNS stamp
+// (https://dnscrypt.info/stamps-specifications), and its certificate is fetched using plain DNS then checked
+// against the provider public key. Queries are sent over UDP, and over TCP when the answer is truncated
+type DNSCryptUpstream struct {
+	address      string            // resolver address including port (e.g.: 51.15.124.208:8443)
+	providerName string            // name of the provider, used to fetch the certificate (e.g.: 2.dnscrypt-cert.scaleway-fr)
+	providerPK   ed25519.PublicKey // key used to sign the certificates
+
+	mu      sync.Mutex       // protects session
+	session *dnscryptSession // keys derived from the current certificate, nil if not fetched yet
+}
+
+// A resolver certificate, once its signature is verified
+type dnscryptCert struct {
+	esVersion   uint16    // encryption system
+	resolverPK  [32]byte  // short-term X25519 public key of the resolver
+	clientMagic [8]byte   // first bytes of queries using this certificate
+	serial      uint32    // the highest serial wins when several certificates are valid
+	notBefore   time.Time // validity period
+	notAfter    time.Time
+}
+
+// Keys used to encrypt queries with a certificate
+type dnscryptSession struct {
+	cert      *dnscryptCert
+	clientPK  [32]byte  // our public key, sent with each query
+	sharedKey [32]byte  // computed from our private key and the resolver public key
+	refreshAt time.Time // when the certificate should be fetched again
+}
+
+// Allocate a new DNSCrypt upstream from its stamp (sdns://...). Certificate is only fetched on the first query
+func newDNSCryptUpstream(stamp string) (*DNSCryptUpstream, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimPrefix(stamp, "sdns://"), "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp <%s>: %v", stamp, err)
+	}
+
+	// protocol (1 byte), properties (8 bytes), then length-prefixed address, provider public key and provider name
+	if len(data) < 9 || data[0] != 0x01 {
+		return nil, fmt.Errorf("stamp <%s> is not a DNSCrypt stamp", stamp)
+	}
+	fields := make([][]byte, 0, 3)
+	for offset := 9; len(fields) < 3; {
+		if offset >= len(data) || offset+1+int(data[offset]) > len(data) {
+			return nil, fmt.Errorf("stamp <%s> is truncated", stamp)
+		}
+		fields = append(fields, data[offset+1:offset+1+int(data[offset])])
+		offset += 1 + int(data[offset])
+	}
+
+	if len(fields[1]) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid provider public key in stamp <%s>", stamp)
+	}
+	if len(fields[2]) == 0 {
+		return nil, fmt.Errorf("no provider name in stamp <%s>", stamp)
+	}
+
+	return &DNSCryptUpstream{
+		address:      withDefaultPort(string(fields[0]), DNSCRYPT_DEFAULT_PORT),
+		providerPK:   ed25519.PublicKey(fields[1]),
+		providerName: strings.TrimSuffix(string(fields[2]), "."),
+	}, nil
+}
+
+// Encrypt the query, send it and decrypt the answer
+func (upstream *DNSCryptUpstream) exchange(query []byte) ([]byte, error) {
+	session, err := upstream.currentSession()
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := session.exchange(upstream.address, "udp", query)
+	if err == nil && len(answer) >= DNS_HEADER_SIZE && binary.BigEndian.Uint16(answer[2:4])&FLAG_TC != 0 {
+		answer, err = session.exchange(upstream.address, "tcp", query)
+	}
+
+	// the certificate might have been revoked: fetch it again for the next query
+	if err == errDNSCryptDecrypt {
+		upstream.mu.Lock()
+		if upstream.session == session {
+			upstream.session = nil
+		}
+		upstream.mu.Unlock()
+	}
+	return answer, err
+}
+
+// Return the keys of the current certificate, fetching it when it's time to
+func (upstream *DNSCryptUpstream) currentSession() (*dnscryptSession, error) {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	if upstream.session != nil && time.Now().Before(upstream.session.refreshAt) {
+		return upstream.session, nil
+	}
+
+	cert, err := upstream.fetchCert()
+	if err != nil {
+		// keep using the previous certificate while it's valid
+		if upstream.session != nil && time.Now().Before(upstream.session.cert.notAfter) {
+			log.Printf("error: <%v> when fetching certificate of DNSCrypt resolver <%s>, keeping the previous one", err, upstream)
+			return upstream.session, nil
+		}
+		return nil, err
+	}
+
+	if upstream.session != nil && upstream.session.cert.serial != cert.serial {
+		log.Printf("DNSCrypt resolver <%s> certificate rotated, serial %d", upstream, cert.serial)
+	}
+	if upstream.session, err = newDNSCryptSession(cert); err != nil {
+		return nil, err
+	}
+	return upstream.session, nil
+}
+
+// Ask the resolver for its certificates using a TXT query, and keep the valid one with the highest serial
+func (upstream *DNSCryptUpstream) fetchCert() (*dnscryptCert, error) {
+	query := DNSMessage{
+		Header:    DNSPacketHeader{Id: randomID(), Flags: FLAG_RD},
+		Questions: []DNSQuestion{{Domain: upstream.providerName, QType: TYPE_TXT, QClass: CLASS_IN}},
+	}
+	udp := newUDPUpstream(upstream.address)
+	defer udp.close()
+	buffer, err := udp.exchange(query.toNetworkBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	answer := new(DNSMessage)
+	if err := answer.fromNetworkBytes(buffer); err != nil {
+		return nil, err
+	}
+
+	var best *dnscryptCert
+	now := time.Now()
+	for _, rr := range answer.Answers {
+		if rr.Type != TYPE_TXT {
+			continue
+		}
+		cert, err := parseDNSCryptCert(txtData(rr.RData), upstream.providerPK)
+		if err != nil {
+			log.Printf("error: <%v> in certificate of DNSCrypt resolver <%s>", err, upstream)
+			continue
+		}
+		if now.Before(cert.notBefore) || now.After(cert.notAfter) {
+			continue
+		}
+		if best == nil || cert.serial > best.serial || (cert.serial == best.serial && cert.esVersion > best.esVersion) {
+			best = cert
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no valid certificate for DNSCrypt resolver <%s>", upstream)
+	}
+	return best, nil
+}
+
+// Nothing is kept open: each query uses its own socket
+func (upstream *DNSCryptUpstream) close() {
+}
+
+// Upstream address used in logs
+func (upstream *DNSCryptUpstream) String() string {
+	return "dnscrypt://" + upstream.address + "#" + upstream.providerName
+}
+
+// Decode a certificate and check its signature. Validity period is not checked here
+func parseDNSCryptCert(data []byte, providerPK ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(data) < DNSCRYPT_CERT_SIZE || string(data[0:4]) != DNSCRYPT_CERT_MAGIC {
+		return nil, errors.New("not a DNSCrypt certificate")
+	}
+
+	// signature covers everything after it, including extensions
+	if !ed25519.Verify(providerPK, data[72:], data[8:72]) {
+		return nil, errors.New("invalid certificate signature")
+	}
+
+	cert := &dnscryptCert{esVersion: binary.BigEndian.Uint16(data[4:6])}
+	if cert.esVersion != DNSCRYPT_XSALSA20POLY1305 && cert.esVersion != DNSCRYPT_XCHACHA20POLY1305 {
+		return nil, fmt.Errorf("unsupported encryption system %d", cert.esVersion)
+	}
+	copy(cert.resolverPK[:], data[72:104])
+	copy(cert.clientMagic[:], data[104:112])
+	cert.serial = binary.BigEndian.Uint32(data[112:116])
+	cert.notBefore = time.Unix(int64(binary.BigEndian.Uint32(data[116:120])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(data[120:124])), 0)
+
+	return cert, nil
+}
+
+// Concatenate the character strings of a TXT record
+func txtData(rdata []byte) []byte {
+	var data []byte
+	for len(rdata) > 0 && 1+int(rdata[0]) <= len(rdata) {
+		data = append(data, rdata[1:1+int(rdata[0])]...)
+		rdata = rdata[1+int(rdata[0]):]
+	}
+	return data
+}
+
+// Generate our key pair for a certificate, and compute the shared key
+func newDNSCryptSession(cert *dnscryptCert) (*dnscryptSession, error) {
+	var clientSK [32]byte
+	if _, err := rand.Read(clientSK[:]); err != nil {
+		return nil, err
+	}
+
+	session := &dnscryptSession{cert: cert, refreshAt: time.Now().Add(DNSCRYPT_CERT_REFRESH)}
+	if cert.notAfter.Before(session.refreshAt) {
+		session.refreshAt = cert.notAfter
+	}
+
+	clientPK, err := curve25519.X25519(clientSK[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(session.clientPK[:], clientPK)
+
+	session.sharedKey, err = dnscryptSharedKey(cert.esVersion, &clientSK, &cert.resolverPK)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Send an encrypted query over UDP or TCP and decrypt the answer
+func (session *dnscryptSession) exchange(address string, network string, query []byte) ([]byte, error) {
+	minSize := 0
+	if network == "udp" {
+		minSize = DNSCRYPT_MIN_QUERY_SIZE
+	}
+	packet, clientNonce, err := session.encrypt(query, minSize)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout(network, address, UPSTREAM_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(UPSTREAM_TIMEOUT))
+
+	var response []byte
+	if network == "udp" {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buffer := make([]byte, 0xFFFF)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		response = buffer[:n]
+	} else {
+		message := make([]byte, 2+len(packet))
+		binary.BigEndian.PutUint16(message, uint16(len(packet)))
+		copy(message[2:], packet)
+		if _, err := conn.Write(message); err != nil {
+			return nil, err
+		}
+		if response, err = readTCPMessage(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	return session.decrypt(response, clientNonce)
+}
+
+// Build an encrypted query: client magic, client public key, client nonce and the padded query in a box
+func (session *dnscryptSession) encrypt(query []byte, minSize int) ([]byte, []byte, error) {
+	clientNonce := make([]byte, 12)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, nil, err
+	}
+
+	// box nonce is the client nonce followed by zeros
+	var nonce [24]byte
+	copy(nonce[:], clientNonce)
+
+	packet := make([]byte, 0, 52+len(query)+DNSCRYPT_PADDING_BLOCK+secretbox.Overhead)
+	packet = append(packet, session.cert.clientMagic[:]...)
+	packet = append(packet, session.clientPK[:]...)
+	packet = append(packet, clientNonce...)
+	packet = dnscryptSeal(session.cert.esVersion, packet, dnscryptPad(query, minSize-len(packet)-secretbox.Overhead), &nonce, &session.sharedKey)
+
+	return packet, clientNonce, nil
+}
+
+// Error returned when an answer can't be decrypted
+var errDNSCryptDecrypt = errors.New("unable to decrypt DNSCrypt answer")
+
+// Decrypt an answer: resolver magic, nonce starting with the client nonce, and the padded answer in a box
+func (session *dnscryptSession) decrypt(response []byte, clientNonce []byte) ([]byte, error) {
+	if len(response) < 32+secretbox.Overhead || string(response[0:8]) != DNSCRYPT_RESOLVER_MAGIC || !bytes.Equal(response[8:20], clientNonce) {
+		return nil, errDNSCryptDecrypt
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], response[8:32])
+
+	padded, ok := dnscryptOpen(session.cert.esVersion, response[32:], &nonce, &session.sharedKey)
+	if !ok {
+		return nil, errDNSCryptDecrypt
+	}
+	answer, ok := dnscryptUnpad(padded)
+	if !ok || len(answer) < DNS_HEADER_SIZE {
+		return nil, errDNSCryptDecrypt
+	}
+	return answer, nil
+}
+
+// Pad a message with 0x80 followed by zeros, up to a multiple of the block size and at least minSize
+func dnscryptPad(message []byte, minSize int) []byte {
+	size := (len(message) + 1 + DNSCRYPT_PADDING_BLOCK - 1) / DNSCRYPT_PADDING_BLOCK * DNSCRYPT_PADDING_BLOCK
+	for size < minSize {
+		size += DNSCRYPT_PADDING_BLOCK
+	}
+
+	padded := make([]byte, size)
+	copy(padded, message)
+	padded[len(message)] = 0x80
+	return padded
+}
+
+// Remove the padding of a message
+func dnscryptUnpad(padded []byte) ([]byte, bool) {
+	i := len(padded) - 1
+	for i >= 0 && padded[i] == 0 {
+		i--
+	}
+	if i == -1 || padded[i] != 0x80 {
+		return nil, false
+	}
+	return padded[:i], true
+}
+
+// Compute the key shared with the resolver, depending on the encryption system
+func dnscryptSharedKey(esVersion uint16, secretKey *[32]byte, publicKey *[32]byte) ([32]byte, error) {
+	var sharedKey [32]byte
+
+	if esVersion == DNSCRYPT_XSALSA20POLY1305 {
+		box.Precompute(&sharedKey, publicKey, secretKey)
+		return sharedKey, nil
+	}
+
+	// X25519 then HChaCha20 with a zero nonce, as libsodium does for XChaCha20 boxes
+	dhKey, err := curve25519.X25519(secretKey[:], publicKey[:])
+	if err != nil {
+		return sharedKey, err
+	}
+	key, err := chacha20.HChaCha20(dhKey, make([]byte, 16))
+	if err != nil {
+		return sharedKey, err
+	}
+	copy(sharedKey[:], key)
+	return sharedKey, nil
+}
+
+// Encrypt and authenticate a message, appending the result to out
+func dnscryptSeal(esVersion uint16, out []byte, message []byte, nonce *[24]byte, key *[32]byte) []byte {
+	if esVersion == DNSCRYPT_XSALSA20POLY1305 {
+		return secretbox.Seal(out, message, nonce, key)
+	}
+
+	// same layout as secretbox, with XChaCha20 instead of XSalsa20: the tag is put before the ciphertext
+	ciphertext := make([]byte, len(message))
+	polyKey := xchachaXOR(key, nonce, ciphertext, message)
+
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, ciphertext, &polyKey)
+
+	out = append(out, tag[:]...)
+	return append(out, ciphertext...)
+}
+
+// Check and decrypt a message sealed with dnscryptSeal
+func dnscryptOpen(esVersion uint16, sealed []byte, nonce *[24]byte, key *[32]byte) ([]byte, bool) {
+	if esVersion == DNSCRYPT_XSALSA20POLY1305 {
+		return secretbox.Open(nil, sealed, nonce, key)
+	}
+
+	if len(sealed) < poly1305.TagSize {
+		return nil, false
+	}
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], sealed)
+
+	message := make([]byte, len(sealed)-poly1305.TagSize)
+	polyKey := xchachaXOR(key, nonce, message, sealed[poly1305.TagSize:])
+	if !poly1305.Verify(&tag, sealed[poly1305.TagSize:], &polyKey) {
+		return nil, false
+	}
+	return message, true
+}
+
+// Encrypt or decrypt with XChaCha20, and return the Poly1305 key. As for secretbox, the first half of the
+// first block of the key stream is the Poly1305 key, and the message starts at its second half
+func xchachaXOR(key *[32]byte, nonce *[24]byte, dst []byte, src []byte) [32]byte {
+	cipher, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var firstBlock [64]byte
+	cipher.XORKeyStream(firstBlock[:], firstBlock[:])
+
+	n := len(src)
+	if n > 32 {
+		n = 32
+	}
+	for i := 0; i < n; i++ {
+		dst[i] = src[i] ^ firstBlock[32+i]
+	}
+	cipher.XORKeyStream(dst[n:], src[n:])
+
+	var polyKey [32]byte
+	copy(polyKey[:], firstBlock[:32])
+	return polyKey
+}
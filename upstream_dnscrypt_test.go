@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+)
+
+// A local DNSCrypt resolver, answering certificate queries in plain DNS and encrypted queries with the handler
+type dnscryptStandIn struct {
+	address    string
+	providerPK ed25519.PublicKey
+	providerSK ed25519.PrivateKey
+	handler    func(query []byte) []byte
+	tcpQueries int32 // number of queries received over TCP
+
+	mu    sync.Mutex
+	certs [][]byte                       // certificates given to clients
+	keys  map[[8]byte]dnscryptStandInKey // resolver keys, indexed by client magic
+}
+
+type dnscryptStandInKey struct {
+	esVersion uint16
+	secretKey [32]byte
+}
+
+// Start the stand-in on a UDP and a TCP socket sharing the same port
+func startDNSCryptStandIn(t *testing.T, handler func(query []byte) []byte) *dnscryptStandIn {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcpListener.Close() })
+
+	standIn := &dnscryptStandIn{address: udpConn.LocalAddr().String(), handler: handler, keys: make(map[[8]byte]dnscryptStandInKey)}
+	standIn.providerPK, standIn.providerSK, _ = ed25519.GenerateKey(rand.Reader)
+
+	go func() {
+		buffer := make([]byte, 0xFFFF)
+		for {
+			n, addr, err := udpConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if answer := standIn.answer(buffer[:n], true); answer != nil {
+				udpConn.WriteTo(answer, addr)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				packet, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&standIn.tcpQueries, 1)
+				if answer := standIn.answer(packet, false); answer != nil {
+					message := make([]byte, 2+len(answer))
+					binary.BigEndian.PutUint16(message, uint16(len(answer)))
+					copy(message[2:], answer)
+					conn.Write(message)
+				}
+			}()
+		}
+	}()
+
+	return standIn
+}
+
+// DNS stamp of the stand-in
+func (standIn *dnscryptStandIn) stamp() string {
+	data := []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0}
+	for _, field := range [][]byte{[]byte(standIn.address), standIn.providerPK, []byte("2.dnscrypt-cert.test")} {
+		data = append(data, byte(len(field)))
+		data = append(data, field...)
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Generate a new resolver key pair and its certificate, signed by the signer
+func (standIn *dnscryptStandIn) addCert(esVersion uint16, serial uint32, notBefore time.Time, notAfter time.Time, signer ed25519.PrivateKey) {
+	key := dnscryptStandInKey{esVersion: esVersion}
+	rand.Read(key.secretKey[:])
+	publicKey, _ := curve25519.X25519(key.secretKey[:], curve25519.Basepoint)
+	var clientMagic [8]byte
+	rand.Read(clientMagic[:])
+
+	cert := make([]byte, DNSCRYPT_CERT_SIZE)
+	copy(cert, DNSCRYPT_CERT_MAGIC)
+	binary.BigEndian.PutUint16(cert[4:], esVersion)
+	copy(cert[72:], publicKey)
+	copy(cert[104:], clientMagic[:])
+	binary.BigEndian.PutUint32(cert[112:], serial)
+	binary.BigEndian.PutUint32(cert[116:], uint32(notBefore.Unix()))
+	binary.BigEndian.PutUint32(cert[120:], uint32(notAfter.Unix()))
+	copy(cert[8:72], ed25519.Sign(signer, cert[72:]))
+
+	standIn.mu.Lock()
+	standIn.certs = append(standIn.certs, cert)
+	standIn.keys[clientMagic] = key
+	standIn.mu.Unlock()
+}
+
+// Answer a packet, either a certificate query or an encrypted query
+func (standIn *dnscryptStandIn) answer(packet []byte, overUDP bool) []byte {
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+
+	var clientMagic [8]byte
+	copy(clientMagic[:], packet)
+	key, found := standIn.keys[clientMagic]
+	if !found || len(packet) < 52 {
+		// plain DNS query for the certificates
+		msg := new(DNSMessage)
+		if err := msg.fromNetworkBytes(packet); err != nil || len(msg.Questions) == 0 || msg.Questions[0].QType != TYPE_TXT {
+			return nil
+		}
+		response := newResponse(msg, RCODE_NOERROR)
+		for _, cert := range standIn.certs {
+			rdata := append([]byte{byte(len(cert))}, cert...)
+			response.Answers = append(response.Answers, DNSResourceRecord{Name: msg.Questions[0].Domain, Type: TYPE_TXT, Class: CLASS_IN, TTL: 60, RData: rdata})
+		}
+		return response.toNetworkBytes()
+	}
+
+	var clientPK [32]byte
+	copy(clientPK[:], packet[8:40])
+	sharedKey, _ := dnscryptSharedKey(key.esVersion, &key.secretKey, &clientPK)
+	var nonce [24]byte
+	copy(nonce[:], packet[40:52])
+	padded, ok := dnscryptOpen(key.esVersion, packet[52:], &nonce, &sharedKey)
+	if !ok {
+		return nil
+	}
+	query, ok := dnscryptUnpad(padded)
+	if !ok {
+		return nil
+	}
+
+	seal := func(answer []byte) []byte {
+		rand.Read(nonce[12:])
+		response := append([]byte(DNSCRYPT_RESOLVER_MAGIC), nonce[:]...)
+		return dnscryptSeal(key.esVersion, response, dnscryptPad(answer, 0), &nonce, &sharedKey)
+	}
+
+	// answers can't be larger than queries over UDP
+	response := seal(standIn.handler(query))
+	if overUDP && len(response) > len(packet) {
+		msg := new(DNSMessage)
+		msg.fromNetworkBytes(query)
+		truncated := newResponse(msg, RCODE_NOERROR)
+		truncated.Header.Flags |= FLAG_TC
+		response = seal(truncated.toNetworkBytes())
+	}
+	return response
+}
+
+// A stand-in handler answering A questions with a number of addresses
+func answerWithMany(count int) func(query []byte) []byte {
+	return func(query []byte) []byte {
+		msg := new(DNSMessage)
+		if err := msg.fromNetworkBytes(query); err != nil {
+			return nil
+		}
+
+		response := newResponse(msg, RCODE_NOERROR)
+		for i := 0; i < count; i++ {
+			response.Answers = append(response.Answers, DNSResourceRecord{Name: msg.Questions[0].Domain, Type: TYPE_A, Class: CLASS_IN, TTL: 60, RData: []byte{10, 0, byte(i / 256), byte(i % 256)}})
+		}
+		return response.toNetworkBytes()
+	}
+}
+
+func TestDNSCryptUpstream(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, esVersion := range []uint16{DNSCRYPT_XSALSA20POLY1305, DNSCRYPT_XCHACHA20POLY1305} {
+		standIn := startDNSCryptStandIn(t, answerWith("1.2.3.4"))
+		standIn.addCert(esVersion, 1, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), standIn.providerSK)
+
+		upstream, err := newUpstream(ResolverConfig{Address: standIn.stamp()})
+		assert.Nil(err)
+		assert.Equal(upstream.String(), "dnscrypt://"+standIn.address+"#2.dnscrypt-cert.test")
+
+		answer, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+		assert.Nil(err)
+		assert.Equal(binary.BigEndian.Uint16(answer), uint16(0x1234))
+		assert.Equal(firstAddress(answer), "1.2.3.4")
+		assert.Equal(upstream.(*DNSCryptUpstream).session.cert.esVersion, esVersion)
+		assert.Equal(atomic.LoadInt32(&standIn.tcpQueries), int32(0))
+	}
+}
+
+func TestDNSCryptUpstreamTruncated(t *testing.T) {
+	assert := assert.New(t)
+
+	standIn := startDNSCryptStandIn(t, answerWithMany(40))
+	standIn.addCert(DNSCRYPT_XCHACHA20POLY1305, 1, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), standIn.providerSK)
+
+	upstream, _ := newDNSCryptUpstream(standIn.stamp())
+	answer, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+
+	msg := new(DNSMessage)
+	assert.Nil(msg.fromNetworkBytes(answer))
+	assert.Equal(len(msg.Answers), 40)
+	assert.Equal(atomic.LoadInt32(&standIn.tcpQueries), int32(1))
+}
+
+func TestDNSCryptCertRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	standIn := startDNSCryptStandIn(t, answerWith("1.2.3.4"))
+	_, otherSK, _ := ed25519.GenerateKey(rand.Reader)
+
+	// expired, not yet valid and badly signed certificates are ignored, even with a higher serial
+	standIn.addCert(DNSCRYPT_XSALSA20POLY1305, 1, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), standIn.providerSK)
+	standIn.addCert(DNSCRYPT_XSALSA20POLY1305, 2, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour), standIn.providerSK)
+	standIn.addCert(DNSCRYPT_XSALSA20POLY1305, 3, time.Now().Add(time.Hour), time.Now().Add(2*time.Hour), standIn.providerSK)
+	standIn.addCert(DNSCRYPT_XSALSA20POLY1305, 4, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), otherSK)
+
+	upstream, _ := newDNSCryptUpstream(standIn.stamp())
+	_, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+	assert.Equal(upstream.session.cert.serial, uint32(1))
+
+	// a new certificate is picked up at the next refresh
+	standIn.addCert(DNSCRYPT_XCHACHA20POLY1305, 5, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), standIn.providerSK)
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+	assert.Equal(upstream.session.cert.serial, uint32(1))
+
+	upstream.session.refreshAt = time.Now()
+	answer, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+	assert.Equal(firstAddress(answer), "1.2.3.4")
+	assert.Equal(upstream.session.cert.serial, uint32(5))
+
+	// no valid certificate at all
+	empty := startDNSCryptStandIn(t, answerWith("1.2.3.4"))
+	upstream, _ = newDNSCryptUpstream(empty.stamp())
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.NotNil(err)
+}
+
+func TestDNSCryptStamp(t *testing.T) {
+	assert := assert.New(t)
+
+	providerPK := make([]byte, 32)
+	rand.Read(providerPK)
+	data := []byte{0x01, 0x07, 0, 0, 0, 0, 0, 0, 0, 18}
+	data = append(data, "[2001:db8::1]:8443"...)
+	data = append(data, 32)
+	data = append(data, providerPK...)
+	data = append(data, 33)
+	data = append(data, "2.dnscrypt-cert.dnscrypt.example."...)
+	upstream, err := newDNSCryptUpstream("sdns://" + base64.RawURLEncoding.EncodeToString(data))
+	assert.Nil(err)
+	assert.Equal(upstream.address, "[2001:db8::1]:8443")
+	assert.Equal(upstream.providerName, "2.dnscrypt-cert.dnscrypt.example")
+	assert.Equal([]byte(upstream.providerPK), providerPK)
+
+	// default port
+	data = []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0, 7, '1', '.', '2', '.', '3', '.', '4', 32}
+	data = append(data, make([]byte, 32)...)
+	data = append(data, 8, '2', '.', 'f', 'o', 'o', '.', 'c', 'o')
+	upstream, err = newDNSCryptUpstream("sdns://" + base64.RawURLEncoding.EncodeToString(data))
+	assert.Nil(err)
+	assert.Equal(upstream.address, "1.2.3.4:443")
+
+	// DoH stamp, truncated stamp, invalid base64
+	_, err = newDNSCryptUpstream("sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5")
+	assert.NotNil(err)
+	_, err = newDNSCryptUpstream("sdns://" + base64.RawURLEncoding.EncodeToString(data[:20]))
+	assert.NotNil(err)
+	_, err = newDNSCryptUpstream("sdns://foo$")
+	assert.NotNil(err)
+}
+
+func TestDNSCryptPadding(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, size := range []int{0, 12, 63, 64, 200} {
+		message := make([]byte, size)
+		rand.Read(message)
+
+		padded := dnscryptPad(message, 0)
+		assert.Equal(len(padded)%DNSCRYPT_PADDING_BLOCK, 0)
+		assert.True(len(padded) > size)
+		unpadded, ok := dnscryptUnpad(padded)
+		assert.True(ok)
+		assert.Equal(unpadded, message)
+	}
+	assert.Equal(len(dnscryptPad(make([]byte, 30), 188)), 192)
+
+	_, ok := dnscryptUnpad(make([]byte, 64))
+	assert.False(ok)
+}
+
+// Known answer computed by libsodium 1.0.18 with crypto_box_curve25519xchacha20poly1305_easy, with the X25519 keys
+// of RFC 7748 (section 6.1) and the nonce of the NaCl box test, to catch mistakes the stand-in would share
+func TestDNSCryptXChaChaKnownAnswer(t *testing.T) {
+	assert := assert.New(t)
+
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		assert.Nil(err)
+		return b
+	}
+	var aliceSK, alicePK, bobSK, bobPK [32]byte
+	var nonce [24]byte
+	copy(aliceSK[:], decode("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"))
+	copy(alicePK[:], decode("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"))
+	copy(bobSK[:], decode("5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb"))
+	copy(bobPK[:], decode("de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"))
+	copy(nonce[:], decode("69696ee955b62b73cd62bda875fc73d68219e0036b7a0b37"))
+	message := []byte("dnswall known answer test for crypto_box_curve25519xchacha20poly1305")
+	sealed := decode("c590ea37ee53e7806b1e0f8a3f5ab0d935454cd3ea5172f959084c3473d471d983cbcd0268cd56966eb26bb635a8b749" +
+		"0c5aae21f11956a2925d9aceb2d8c3850c0aacdefdf177ea1fae392e41eb3357fff02b0d")
+
+	// crypto_box_curve25519xchacha20poly1305_beforenm, the same on both sides
+	sharedKey, err := dnscryptSharedKey(DNSCRYPT_XCHACHA20POLY1305, &aliceSK, &bobPK)
+	assert.Nil(err)
+	assert.Equal(hex.EncodeToString(sharedKey[:]), "8e47ca376bdc7e59d2ced8107ceb2c27f4a80e8575f996baffb1a869ffcd5179")
+	bobKey, err := dnscryptSharedKey(DNSCRYPT_XCHACHA20POLY1305, &bobSK, &alicePK)
+	assert.Nil(err)
+	assert.Equal(bobKey, sharedKey)
+
+	assert.Equal(dnscryptSeal(DNSCRYPT_XCHACHA20POLY1305, nil, message, &nonce, &sharedKey), sealed)
+	opened, ok := dnscryptOpen(DNSCRYPT_XCHACHA20POLY1305, sealed, &nonce, &sharedKey)
+	assert.True(ok)
+	assert.Equal(opened, message)
+
+	sealed[len(sealed)-1] ^= 1
+	_, ok = dnscryptOpen(DNSCRYPT_XCHACHA20POLY1305, sealed, &nonce, &sharedKey)
+	assert.False(ok)
+}
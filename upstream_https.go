@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// media type of DNS messages in HTTP requests and responses
+	DNS_MESSAGE_TYPE = "application/dns-message"
+
+	// how long idle connections to a DoH resolver are kept open
+	HTTPS_IDLE_TIMEOUT = 90 * time.Second
+)
+
+// DNS over HTTPS, as described in https://datatracker.ietf.org/doc/html/rfc8484. Queries are sent using POST,
+// and connections are kept alive and reused by the HTTP client, using HTTP/2 when the server supports it
+type HTTPSUpstream struct {
+	url    string       // URL of the resolver (e.g.: https://cloudflare-dns.com/dns-query)
+	client *http.Client // shared by all queries
+}
+
+// Allocate a new DoH upstream. If bootstrap addresses are given, they are used to connect to the resolver
+// instead of resolving its host name
+func newHTTPSUpstream(resolverURL string, bootstrap []string, pins []string, rootCAs *x509.CertPool) (*HTTPSUpstream, error) {
+	u, err := url.Parse(resolverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid DoH URL <%s>", resolverURL)
+	}
+
+	// server name is set by the HTTP client from the URL
+	tlsConfig, err := newTLSConfig("", pins, rootCAs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, address := range bootstrap {
+		if net.ParseIP(address) == nil {
+			return nil, fmt.Errorf("bootstrap address <%s> is not an IP address", address)
+		}
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		DialContext:         bootstrapDialer(u.Hostname(), bootstrap),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     HTTPS_IDLE_TIMEOUT,
+		TLSHandshakeTimeout: UPSTREAM_TIMEOUT,
+	}
+
+	return &HTTPSUpstream{url: resolverURL, client: &http.Client{Transport: transport, Timeout: UPSTREAM_TIMEOUT}}, nil
+}
+
+// Return a dial function connecting to the bootstrap addresses, in order, when host is dialed
+func bootstrapDialer(host string, bootstrap []string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: UPSTREAM_TIMEOUT, KeepAlive: 30 * time.Second}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		addrHost, port, err := net.SplitHostPort(address)
+		if err != nil || addrHost != host || len(bootstrap) == 0 {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		for _, ip := range bootstrap {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// Send the query with a POST request and wait for the answer
+func (upstream *HTTPSUpstream) exchange(query []byte) ([]byte, error) {
+	if len(query) < DNS_HEADER_SIZE {
+		return nil, io.ErrShortBuffer
+	}
+
+	// ID should be 0 to be cache friendly: https://datatracker.ietf.org/doc/html/rfc8484#section-4.1
+	message := make([]byte, len(query))
+	copy(message, query)
+	binary.BigEndian.PutUint16(message, 0)
+
+	request, err := http.NewRequest(http.MethodPost, upstream.url, bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", DNS_MESSAGE_TYPE)
+	request.Header.Set("Accept", DNS_MESSAGE_TYPE)
+
+	response, err := upstream.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status <%s>", response.Status)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != DNS_MESSAGE_TYPE {
+		return nil, fmt.Errorf("unexpected content type <%s>", contentType)
+	}
+
+	// a DNS message can't be larger than 64k
+	answer, err := ioutil.ReadAll(io.LimitReader(response.Body, 0xFFFF))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < DNS_HEADER_SIZE {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// restore the ID of the query
+	copy(answer[0:2], query[0:2])
+	return answer, nil
+}
+
+// Close the connections kept alive by the HTTP client
+func (upstream *HTTPSUpstream) close() {
+	upstream.client.CloseIdleConnections()
+}
+
+// Upstream address used in logs
+func (upstream *HTTPSUpstream) String() string {
+	return upstream.url
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Start a local DoH server answering with the handler. Return the port and the number of accepted connections
+func startHTTPSStandIn(t *testing.T, pki *testPKI, handler func(query []byte) []byte) (string, *int32) {
+	assert := assert.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(r.ProtoMajor, 2)
+		assert.Equal(r.Method, http.MethodPost)
+		assert.Equal(r.Header.Get("Content-Type"), DNS_MESSAGE_TYPE)
+
+		query, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(binary.BigEndian.Uint16(query), uint16(0))
+
+		w.Header().Set("Content-Type", DNS_MESSAGE_TYPE)
+		w.Write(handler(query))
+	}))
+
+	accepted := new(int32)
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(accepted, 1)
+		}
+	}
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{pki.cert}}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	return port, accepted
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	port, accepted := startHTTPSStandIn(t, pki, answerWith("1.2.3.4"))
+
+	// dns.test can only be reached using the bootstrap address
+	upstream, err := newUpstream(ResolverConfig{Address: "https://dns.test:" + port + "/dns-query", Bootstrap: []string{"127.0.0.1"}})
+	assert.Nil(err)
+	upstream.(*HTTPSUpstream).client.Transport.(*http.Transport).TLSClientConfig.RootCAs = pki.pool
+
+	for i := 0; i < 5; i++ {
+		answer, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+		assert.Nil(err)
+		assert.Equal(binary.BigEndian.Uint16(answer), uint16(0x1234))
+		assert.Equal(firstAddress(answer), "1.2.3.4")
+	}
+
+	// connection is kept alive
+	assert.Equal(atomic.LoadInt32(accepted), int32(1))
+}
+
+func TestHTTPSUpstreamErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	port, _ := startHTTPSStandIn(t, pki, answerWith("1.2.3.4"))
+
+	// wrong public key
+	other := newTestPKI(t, "dns.test")
+	upstream, err := newHTTPSUpstream("https://dns.test:"+port+"/dns-query", []string{"127.0.0.1"}, []string{other.pin()}, pki.pool)
+	assert.Nil(err)
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.NotNil(err)
+
+	// not a DoH server
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	upstream, _ = newHTTPSUpstream(server.URL+"/dns-query", nil, nil, pool)
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.NotNil(err)
+
+	_, err = newHTTPSUpstream("http://dns.test/dns-query", nil, nil, nil)
+	assert.NotNil(err)
+	_, err = newHTTPSUpstream("https://dns.test/dns-query", []string{"dns.test"}, nil, nil)
+	assert.NotNil(err)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// application protocol negotiated by DoQ clients and servers: https://datatracker.ietf.org/doc/html/rfc9250#section-4.1.1
+	DOQ_ALPN = "doq"
+
+	// error codes used when closing connections and streams: https://datatracker.ietf.org/doc/html/rfc9250#section-4.3
+	DOQ_NO_ERROR       = 0
+	DOQ_INTERNAL_ERROR = 1
+	DOQ_PROTOCOL_ERROR = 2
+)
+
+// DNS over QUIC, as described in https://datatracker.ietf.org/doc/html/rfc9250. A single connection is kept
+// open, and each query is sent on its own stream, so no ID is needed to match answers
+type QUICUpstream struct {
+	address    string       // resolver address including port (e.g.: 94.140.14.14:853)
+	tlsConfig  *tls.Config  // used to verify the resolver certificate
+	quicConfig *quic.Config // transport settings
+	allow0RTT  bool         // if true, queries can be sent before the handshake completes when resuming a session
+
+	mu   sync.Mutex      // protects conn
+	conn quic.Connection // current connection, nil if none is opened
+}
+
+// Allocate a new DoQ upstream. Certificate is verified the same way as for DoT. 0-RTT is only used if allowed,
+// as those queries can be replayed by an attacker
+func newQUICUpstream(address string, serverName string, pins []string, rootCAs *x509.CertPool, allow0RTT bool) (*QUICUpstream, error) {
+	tlsConfig, err := newTLSConfig(serverName, pins, rootCAs)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{DOQ_ALPN}
+	if allow0RTT {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	quicConfig := &quic.Config{HandshakeIdleTimeout: UPSTREAM_TIMEOUT}
+
+	return &QUICUpstream{address: address, tlsConfig: tlsConfig, quicConfig: quicConfig, allow0RTT: allow0RTT}, nil
+}
+
+// Send the query on a new stream of the shared connection, opening it if necessary
+func (upstream *QUICUpstream) exchange(query []byte) ([]byte, error) {
+	if len(query) < DNS_HEADER_SIZE {
+		return nil, io.ErrShortBuffer
+	}
+
+	// the connection might have been closed by the server while idle: try once again with a new one
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn quic.Connection
+		conn, err = upstream.connection()
+		if err != nil {
+			return nil, err
+		}
+
+		var answer []byte
+		answer, err = upstream.exchangeOnStream(conn, query)
+		if err == nil {
+			return answer, nil
+		}
+
+		// the connection is still alive when only the stream failed
+		if conn.Context().Err() == nil {
+			return nil, err
+		}
+		upstream.release(conn)
+	}
+	return nil, err
+}
+
+// Send a query on a new stream, and read the answer up to the end of the stream
+func (upstream *QUICUpstream) exchangeOnStream(conn quic.Connection, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), UPSTREAM_TIMEOUT)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream.SetDeadline(time.Now().Add(UPSTREAM_TIMEOUT))
+
+	// ID must be 0, and the message is prefixed with its length: https://datatracker.ietf.org/doc/html/rfc9250#section-4.2.1
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+	binary.BigEndian.PutUint16(message[2:], 0)
+
+	if _, err := stream.Write(message); err != nil {
+		stream.CancelRead(DOQ_INTERNAL_ERROR)
+		return nil, err
+	}
+
+	// no other query is sent on this stream
+	stream.Close()
+
+	answer, err := readTCPMessage(stream)
+	if err != nil {
+		stream.CancelRead(DOQ_INTERNAL_ERROR)
+		return nil, err
+	}
+	if len(answer) < DNS_HEADER_SIZE {
+		return nil, errors.New("DoQ answer is too short")
+	}
+
+	copy(answer[0:2], query[0:2])
+	return answer, nil
+}
+
+// Return the shared connection, or open a new one
+func (upstream *QUICUpstream) connection() (quic.Connection, error) {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	if upstream.conn != nil {
+		return upstream.conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), UPSTREAM_TIMEOUT)
+	defer cancel()
+
+	var conn quic.Connection
+	var err error
+	if upstream.allow0RTT {
+		conn, err = quic.DialAddrEarly(ctx, upstream.address, upstream.tlsConfig, upstream.quicConfig)
+	} else {
+		conn, err = quic.DialAddr(ctx, upstream.address, upstream.tlsConfig, upstream.quicConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upstream.conn = conn
+	return conn, nil
+}
+
+// Forget a connection which is no longer usable
+func (upstream *QUICUpstream) release(conn quic.Connection) {
+	conn.CloseWithError(DOQ_NO_ERROR, "")
+
+	upstream.mu.Lock()
+	if upstream.conn == conn {
+		upstream.conn = nil
+	}
+	upstream.mu.Unlock()
+}
+
+// Close the shared connection, if any
+func (upstream *QUICUpstream) close() {
+	upstream.mu.Lock()
+	conn := upstream.conn
+	upstream.conn = nil
+	upstream.mu.Unlock()
+
+	if conn != nil {
+		conn.CloseWithError(DOQ_NO_ERROR, "")
+	}
+}
+
+// Upstream address used in logs
+func (upstream *QUICUpstream) String() string {
+	return "quic://" + upstream.address + "#" + upstream.tlsConfig.ServerName
+}
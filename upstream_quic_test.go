@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Start a local DoQ server answering with the handler, one query per stream. Return the server address,
+// the number of accepted connections and the number of queries received with a non-zero ID
+func startQUICStandIn(t *testing.T, pki *testPKI, handler func(query []byte) []byte) (string, *int32, *int32) {
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{pki.cert}, NextProtos: []string{DOQ_ALPN}}
+	listener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted, nonZeroIDs := new(int32), new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						query, err := readTCPMessage(stream)
+						if err != nil {
+							return
+						}
+						if binary.BigEndian.Uint16(query) != 0 {
+							atomic.AddInt32(nonZeroIDs, 1)
+						}
+						answer := handler(query)
+						message := make([]byte, 2+len(answer))
+						binary.BigEndian.PutUint16(message, uint16(len(answer)))
+						copy(message[2:], answer)
+						stream.Write(message)
+						stream.Close()
+					}()
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), accepted, nonZeroIDs
+}
+
+func TestQUICUpstream(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	address, accepted, nonZeroIDs := startQUICStandIn(t, pki, answerWith("1.2.3.4"))
+
+	upstream, err := newQUICUpstream(address, "dns.test", []string{pki.pin()}, pki.pool, false)
+	assert.Nil(err)
+
+	// concurrent queries, each on its own stream of a single connection
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			answer, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+			assert.Nil(err)
+			assert.Equal(binary.BigEndian.Uint16(answer), uint16(0x1234))
+			assert.Equal(firstAddress(answer), "1.2.3.4")
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(atomic.LoadInt32(accepted), int32(1))
+	assert.Equal(atomic.LoadInt32(nonZeroIDs), int32(0))
+
+	// connection is closed behind our back
+	upstream.conn.CloseWithError(DOQ_NO_ERROR, "")
+	answer, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+	assert.Equal(firstAddress(answer), "1.2.3.4")
+	assert.Equal(atomic.LoadInt32(accepted), int32(2))
+}
+
+func TestQUICUpstreamVerification(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	address, _, _ := startQUICStandIn(t, pki, answerWith("1.2.3.4"))
+
+	upstream, err := newUpstream(ResolverConfig{Address: "quic://" + address + "#dns.test"})
+	assert.Nil(err)
+	assert.Equal(upstream.String(), "quic://"+address+"#dns.test")
+
+	// system CAs don't know the test CA
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.NotNil(err)
+
+	// another public key
+	other := newTestPKI(t, "dns.test")
+	upstream, _ = newUpstream(ResolverConfig{Address: "quic://" + address + "#dns.test", SPKIPins: []string{other.pin()}})
+	upstream.(*QUICUpstream).tlsConfig.RootCAs = pki.pool
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.NotNil(err)
+
+	// wrong server name
+	upstream, _ = newQUICUpstream(address, "foo.test", nil, pki.pool, false)
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.NotNil(err)
+
+	// default port
+	upstream, _ = newUpstream(ResolverConfig{Address: "quic://dns.adguard-dns.com"})
+	assert.Equal(upstream.(*QUICUpstream).address, "dns.adguard-dns.com:853")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Start a local UDP DNS server answering with the handler, and return its address
+func startUDPStandIn(t *testing.T, handler func(query []byte) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, DEFAULT_BUFFER_SIZE)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if answer := handler(buffer[:n]); answer != nil {
+				conn.WriteTo(answer, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// A stand-in handler answering every A question with the given address
+func answerWith(ip string) func(query []byte) []byte {
+	return func(query []byte) []byte {
+		msg := new(DNSMessage)
+		if err := msg.fromNetworkBytes(query); err != nil {
+			return nil
+		}
+
+		response := newResponse(msg, RCODE_NOERROR)
+		for _, question := range msg.Questions {
+			if question.QType == TYPE_A {
+				response.Answers = append(response.Answers, DNSResourceRecord{Name: question.Domain, Type: TYPE_A, Class: CLASS_IN, TTL: 60, RData: net.ParseIP(ip).To4()})
+			}
+		}
+		return response.toNetworkBytes()
+	}
+}
+
+// Decode an answer and return the first IP address found, empty string if none
+func firstAddress(buffer []byte) string {
+	msg := new(DNSMessage)
+	if err := msg.fromNetworkBytes(buffer); err != nil {
+		return ""
+	}
+	for _, rr := range msg.Answers {
+		if ip := rr.ip(); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+func TestNewUpstream(t *testing.T) {
+	assert := assert.New(t)
+
+	for spec, expected := range map[string]string{"1.1.1.1": "1.1.1.1:53", "udp://8.8.8.8:5353": "8.8.8.8:5353", "2606:4700::1111": "[2606:4700::1111]:53", "[::1]:53": "[::1]:53"} {
+		upstream, err := newUpstream(ResolverConfig{Address: spec})
+		assert.Nil(err)
+		assert.Equal(upstream.String(), expected)
+	}
+}
+
+func TestUDPUpstream(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := newUDPUpstream(startUDPStandIn(t, answerWith("1.2.3.4")))
+	answer, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+	assert.Equal(firstAddress(answer), "1.2.3.4")
+}
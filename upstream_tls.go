@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNS over TLS, as described in https://datatracker.ietf.org/doc/html/rfc7858. A single connection is kept
+// open and shared by all queries, which are pipelined and matched back using their ID
+type TLSUpstream struct {
+	address   string      // resolver address including port (e.g.: 1.1.1.1:853)
+	tlsConfig *tls.Config // used to verify the resolver certificate
+
+	mu   sync.Mutex // protects conn
+	conn *dotConn   // current connection, nil if none is opened
+}
+
+// An opened connection to a DoT resolver, with the queries waiting for their answer
+type dotConn struct {
+	conn net.Conn
+
+	writeMu sync.Mutex // only one message written at once
+
+	mu      sync.Mutex             // protects the fields below
+	pending map[uint16]chan []byte // answer channel of the outstanding queries, indexed by the ID used on the wire
+	nextID  uint16                 // next ID to try
+	err     error                  // set when the connection is no longer usable
+}
+
+// Allocate a new DoT upstream. Certificate is verified against serverName, and if pins are given, one of the
+// certificates of the chain must have a public key matching one of them
+func newTLSUpstream(address string, serverName string, pins []string, rootCAs *x509.CertPool) (*TLSUpstream, error) {
+	tlsConfig, err := newTLSConfig(serverName, pins, rootCAs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLSUpstream{address: address, tlsConfig: tlsConfig}, nil
+}
+
+// Build the TLS configuration used to connect to a resolver
+func newTLSConfig(serverName string, pins []string, rootCAs *x509.CertPool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		RootCAs:    rootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(pins) != 0 {
+		digests := make(map[string]bool)
+		for _, pin := range pins {
+			digest, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(digest) != sha256.Size {
+				return nil, errors.New("SPKI pin is not a base64 SHA-256 digest: " + pin)
+			}
+			digests[string(digest)] = true
+		}
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifySPKIPins(state, digests)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Check whether one of the certificates presented by the server has a public key found in the pins.
+// It's called after the usual certificate verification
+func verifySPKIPins(state tls.ConnectionState, digests map[string]bool) error {
+	for _, cert := range state.PeerCertificates {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if digests[string(digest[:])] {
+			return nil
+		}
+	}
+	return errors.New("no certificate matching the SPKI pins")
+}
+
+// Send the query using the shared connection, opening it if necessary
+func (upstream *TLSUpstream) exchange(query []byte) ([]byte, error) {
+	if len(query) < DNS_HEADER_SIZE {
+		return nil, io.ErrShortBuffer
+	}
+
+	// the connection might have been closed by the server while idle: try once again with a new one
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *dotConn
+		conn, err = upstream.connection()
+		if err != nil {
+			return nil, err
+		}
+
+		var answer []byte
+		answer, err = conn.exchange(query)
+		if err == nil {
+			return answer, nil
+		}
+
+		// the resolver is just too slow, other queries can still use the connection unless it's closed
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && conn.error() == nil {
+			return nil, err
+		}
+		upstream.release(conn, err)
+	}
+	return nil, err
+}
+
+// Return the shared connection, or open a new one
+func (upstream *TLSUpstream) connection() (*dotConn, error) {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	if upstream.conn != nil {
+		return upstream.conn, nil
+	}
+
+	dialer := &net.Dialer{Timeout: UPSTREAM_TIMEOUT}
+	conn, err := tls.DialWithDialer(dialer, "tcp", upstream.address, upstream.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream.conn = newDotConn(conn)
+	go upstream.conn.readAnswers(upstream)
+
+	return upstream.conn, nil
+}
+
+// Forget a connection which is no longer usable
+func (upstream *TLSUpstream) release(conn *dotConn, err error) {
+	conn.close(err)
+
+	upstream.mu.Lock()
+	if upstream.conn == conn {
+		upstream.conn = nil
+	}
+	upstream.mu.Unlock()
+}
+
+// Close the shared connection, if any
+func (upstream *TLSUpstream) close() {
+	upstream.mu.Lock()
+	conn := upstream.conn
+	upstream.conn = nil
+	upstream.mu.Unlock()
+
+	if conn != nil {
+		conn.close(errUpstreamClosed)
+	}
+}
+
+// Upstream address used in logs
+func (upstream *TLSUpstream) String() string {
+	return "tls://" + upstream.address + "#" + upstream.tlsConfig.ServerName
+}
+
+// Allocate a new connection
+func newDotConn(conn net.Conn) *dotConn {
+	return &dotConn{conn: conn, pending: make(map[uint16]chan []byte), nextID: randomID()}
+}
+
+// Send a query on the connection and wait for its answer. The query ID is replaced by one not used by any other
+// outstanding query, and restored in the answer
+func (dc *dotConn) exchange(query []byte) ([]byte, error) {
+	id, answerChan, err := dc.register()
+	if err != nil {
+		return nil, err
+	}
+	defer dc.unregister(id, answerChan)
+
+	// each message is prefixed with its length: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+	binary.BigEndian.PutUint16(message[2:], id)
+
+	dc.writeMu.Lock()
+	dc.conn.SetWriteDeadline(time.Now().Add(UPSTREAM_TIMEOUT))
+	_, err = dc.conn.Write(message)
+	dc.writeMu.Unlock()
+	if err != nil {
+		// part of the message might be written, so the stream can't be used for other messages
+		dc.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(UPSTREAM_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case answer, ok := <-answerChan:
+		if !ok {
+			return nil, dc.error()
+		}
+		copy(answer[0:2], query[0:2])
+		return answer, nil
+	case <-timer.C:
+		return nil, errTimeout
+	}
+}
+
+// Reserve an ID for a new query
+func (dc *dotConn) register() (uint16, chan []byte, error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.err != nil {
+		return 0, nil, dc.err
+	}
+	if len(dc.pending) >= 0x10000 {
+		return 0, nil, errors.New("too many outstanding queries")
+	}
+
+	for {
+		id := dc.nextID
+		dc.nextID++
+		if _, found := dc.pending[id]; !found {
+			answerChan := make(chan []byte, 1)
+			dc.pending[id] = answerChan
+			return id, answerChan, nil
+		}
+	}
+}
+
+// Release the ID of a query, unless it's already reused by another one
+func (dc *dotConn) unregister(id uint16, answerChan chan []byte) {
+	dc.mu.Lock()
+	if dc.pending[id] == answerChan {
+		delete(dc.pending, id)
+	}
+	dc.mu.Unlock()
+}
+
+// Return the error which made the connection unusable
+func (dc *dotConn) error() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.err
+}
+
+// Close the connection and wake up all outstanding queries
+func (dc *dotConn) close(err error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.err != nil {
+		return
+	}
+	dc.err = err
+	dc.conn.Close()
+
+	for id, answerChan := range dc.pending {
+		close(answerChan)
+		delete(dc.pending, id)
+	}
+}
+
+// Read answers as they come, in any order, and give them to the queries waiting for them
+func (dc *dotConn) readAnswers(upstream *TLSUpstream) {
+	for {
+		answer, err := readTCPMessage(dc.conn)
+		if err != nil {
+			upstream.release(dc, err)
+			return
+		}
+		if len(answer) < DNS_HEADER_SIZE {
+			continue
+		}
+
+		// answers for unknown or expired queries are just ignored
+		id := binary.BigEndian.Uint16(answer[0:2])
+		dc.mu.Lock()
+		if answerChan, found := dc.pending[id]; found {
+			answerChan <- answer
+			delete(dc.pending, id)
+		}
+		dc.mu.Unlock()
+	}
+}
+
+// Read a DNS message prefixed with its length, as used over TCP and TLS
+func readTCPMessage(rdr io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(rdr, length[:]); err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(rdr, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Error returned when an answer doesn't come in time
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout net.Error = timeoutError{}
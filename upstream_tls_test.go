@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A self-signed CA and a server certificate signed by it, valid for the names and 127.0.0.1
+type testPKI struct {
+	pool    *x509.CertPool  // to be used as RootCAs by clients
+	caPEM   []byte          // CA certificate
+	cert    tls.Certificate // server certificate and key
+	certPEM []byte          // server certificate
+	keyPEM  []byte          // server key
+}
+
+// Create a new CA and a server certificate
+func newTestPKI(t *testing.T, names ...string) *testPKI {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dnswall test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	pki := &testPKI{pool: x509.NewCertPool()}
+	pki.pool.AddCert(caCert)
+	pki.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	pki.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pki.keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pki.cert, err = tls.X509KeyPair(pki.certPEM, pki.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pki
+}
+
+// SPKI pin of the server certificate
+func (pki *testPKI) pin() string {
+	cert, _ := x509.ParseCertificate(pki.cert.Certificate[0])
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// Start a local DoT server answering with the handler. Queries are answered concurrently, so answers can
+// be sent back in any order. Return the server address and the number of accepted connections
+func startTLSStandIn(t *testing.T, pki *testPKI, handler func(query []byte) []byte) (string, *int32) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pki.cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+
+			go func() {
+				defer conn.Close()
+				var mu sync.Mutex
+
+				for {
+					query, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					go func() {
+						answer := handler(query)
+						if answer == nil {
+							return
+						}
+						message := make([]byte, 2+len(answer))
+						binary.BigEndian.PutUint16(message, uint16(len(answer)))
+						copy(message[2:], answer)
+
+						mu.Lock()
+						conn.Write(message)
+						mu.Unlock()
+					}()
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), accepted
+}
+
+// A stand-in handler answering with the address after the delay
+func delayed(delay time.Duration, handler func(query []byte) []byte) func(query []byte) []byte {
+	return func(query []byte) []byte {
+		time.Sleep(delay)
+		return handler(query)
+	}
+}
+
+func TestTLSUpstreamPipelining(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	fast := answerWith("1.2.3.4")
+	slow := delayed(100*time.Millisecond, answerWith("5.6.7.8"))
+	address, accepted := startTLSStandIn(t, pki, func(query []byte) []byte {
+		if msg := new(DNSMessage); msg.fromNetworkBytes(query) == nil && msg.Questions[0].Domain == "slow.test" {
+			return slow(query)
+		}
+		return fast(query)
+	})
+
+	upstream, err := newTLSUpstream(address, "dns.test", nil, pki.pool)
+	assert.Nil(err)
+
+	// queries are sent at once with the same ID, and slow ones are answered last
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			domain, expected := "fast.test", "1.2.3.4"
+			if i%2 == 0 {
+				domain, expected = "slow.test", "5.6.7.8"
+			}
+			answer, err := upstream.exchange(buildQuery(domain, TYPE_A))
+			assert.Nil(err)
+			assert.Equal(binary.BigEndian.Uint16(answer), uint16(0x1234))
+			assert.Equal(firstAddress(answer), expected)
+		}(i)
+	}
+	wg.Wait()
+
+	// only one connection is used
+	assert.Equal(atomic.LoadInt32(accepted), int32(1))
+}
+
+func TestTLSUpstreamReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	address, accepted := startTLSStandIn(t, pki, answerWith("1.2.3.4"))
+
+	upstream, err := newUpstream(ResolverConfig{Address: "tls://" + address + "#dns.test"})
+	assert.Nil(err)
+	upstream.(*TLSUpstream).tlsConfig.RootCAs = pki.pool
+
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+
+	// connection is closed behind our back
+	upstream.(*TLSUpstream).conn.conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	answer, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+	assert.Equal(firstAddress(answer), "1.2.3.4")
+	assert.Equal(atomic.LoadInt32(accepted), int32(2))
+}
+
+// A connection whose writes time out, as when the resolver stops reading
+type stalledConn struct {
+	net.Conn
+}
+
+func (conn stalledConn) Write(b []byte) (int, error) {
+	return 1, errTimeout
+}
+
+func TestTLSUpstreamWriteError(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	address, accepted := startTLSStandIn(t, pki, answerWith("1.2.3.4"))
+
+	upstream, err := newUpstream(ResolverConfig{Address: "tls://" + address + "#dns.test"})
+	assert.Nil(err)
+	upstream.(*TLSUpstream).tlsConfig.RootCAs = pki.pool
+
+	// a partly written message: the connection is closed and another one is opened
+	client, server := net.Pipe()
+	defer server.Close()
+	stalled := newDotConn(stalledConn{client})
+	upstream.(*TLSUpstream).conn = stalled
+
+	answer, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+	assert.Equal(firstAddress(answer), "1.2.3.4")
+	assert.NotNil(stalled.error())
+	assert.NotSame(upstream.(*TLSUpstream).conn, stalled)
+	assert.Equal(atomic.LoadInt32(accepted), int32(1))
+}
+
+func TestTLSUpstreamVerification(t *testing.T) {
+	assert := assert.New(t)
+
+	pki := newTestPKI(t, "dns.test")
+	address, _ := startTLSStandIn(t, pki, answerWith("1.2.3.4"))
+
+	// pinned public key
+	upstream, err := newTLSUpstream(address, "dns.test", []string{pki.pin()}, pki.pool)
+	assert.Nil(err)
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+
+	// another public key
+	other := newTestPKI(t, "dns.test")
+	upstream, _ = newTLSUpstream(address, "dns.test", []string{other.pin()}, pki.pool)
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.NotNil(err)
+
+	// wrong server name
+	upstream, _ = newTLSUpstream(address, "foo.test", nil, pki.pool)
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.NotNil(err)
+
+	// unknown CA
+	upstream, _ = newTLSUpstream(address, "dns.test", nil, other.pool)
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.NotNil(err)
+
+	_, err = newTLSUpstream(address, "dns.test", []string{"foo"}, pki.pool)
+	assert.NotNil(err)
+}
+
+func TestSplitServerName(t *testing.T) {
+	assert := assert.New(t)
+
+	address, serverName := splitServerName("1.1.1.1:853#cloudflare-dns.com")
+	assert.Equal(address, "1.1.1.1:853")
+	assert.Equal(serverName, "cloudflare-dns.com")
+
+	address, serverName = splitServerName("dns.quad9.net:853")
+	assert.Equal(address, "dns.quad9.net:853")
+	assert.Equal(serverName, "dns.quad9.net")
+
+	address, serverName = splitServerName("[2606:4700::1111]:853")
+	assert.Equal(address, "[2606:4700::1111]:853")
+	assert.Equal(serverName, "2606:4700::1111")
+}
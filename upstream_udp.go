@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// number of sockets opened to each UDP resolver, shared by all queries
+	UDP_UPSTREAM_SOCKETS = 4
+)
+
+// Plain DNS over UDP, as described in https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.1. A small
+// set of connected sockets is kept open and shared by all queries. Each query gets a random ID, and answers
+// are only accepted if both their ID and question match an outstanding query
+type UDPUpstream struct {
+	address string // resolver address including port (e.g.: 1.1.1.1:53)
+
+	mu      sync.Mutex                       // protects the fields below
+	sockets [UDP_UPSTREAM_SOCKETS]*udpSocket // opened on first use, nil until then
+	next    int                              // index of the socket used by the next query
+	closed  bool                             // set on shutdown
+}
+
+// A connected socket, with the queries waiting for their answer
+type udpSocket struct {
+	conn net.Conn
+
+	mu      sync.Mutex             // protects the fields below
+	pending map[uint16]*udpPending // outstanding queries, indexed by the ID used on the wire
+	err     error                  // set when the socket is no longer usable
+}
+
+// A query waiting for its answer
+type udpPending struct {
+	question *DNSQuestion // question of the query, nil if it has none
+	answer   chan []byte  // closed without answer if the query failed
+	err      error        // why the query failed
+}
+
+// Allocate a new UDP upstream. Sockets are only opened when needed
+func newUDPUpstream(address string) *UDPUpstream {
+	return &UDPUpstream{address: address}
+}
+
+// Send the query on one of the shared sockets and wait for the answer
+func (upstream *UDPUpstream) exchange(query []byte) ([]byte, error) {
+	if len(query) < DNS_HEADER_SIZE {
+		return nil, io.ErrShortBuffer
+	}
+	question, err := firstQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+
+	socket, err := upstream.socket()
+	if err != nil {
+		return nil, err
+	}
+	return socket.exchange(query, question)
+}
+
+// Return the next socket in turn, opening it if it's not opened yet or no longer usable
+func (upstream *UDPUpstream) socket() (*udpSocket, error) {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	if upstream.closed {
+		return nil, errUpstreamClosed
+	}
+
+	index := upstream.next
+	upstream.next = (upstream.next + 1) % UDP_UPSTREAM_SOCKETS
+	if socket := upstream.sockets[index]; socket != nil && socket.error() == nil {
+		return socket, nil
+	}
+
+	conn, err := net.Dial("udp", upstream.address)
+	if err != nil {
+		return nil, err
+	}
+
+	socket := &udpSocket{conn: conn, pending: make(map[uint16]*udpPending)}
+	upstream.sockets[index] = socket
+	go socket.readAnswers(upstream)
+
+	return socket, nil
+}
+
+// Send the query over a new TCP connection, to get an answer truncated over UDP
+func (upstream *UDPUpstream) exchangeTCP(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", upstream.address, UPSTREAM_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(UPSTREAM_TIMEOUT))
+
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+
+	answer, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < DNS_HEADER_SIZE || answer[0] != query[0] || answer[1] != query[1] {
+		return nil, errors.New("answer over TCP doesn't match the query")
+	}
+	return answer, nil
+}
+
+// Close all sockets. Outstanding queries fail, and so do the next ones
+func (upstream *UDPUpstream) close() {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	upstream.closed = true
+	for i, socket := range upstream.sockets {
+		if socket != nil {
+			socket.close(errUpstreamClosed)
+			upstream.sockets[i] = nil
+		}
+	}
+}
+
+// Upstream address used in logs
+func (upstream *UDPUpstream) String() string {
+	return upstream.address
+}
+
+// Send a query on the socket and wait for its answer. The query ID is replaced by a random one not used by
+// any other outstanding query, and restored in the answer
+func (socket *udpSocket) exchange(query []byte, question *DNSQuestion) ([]byte, error) {
+	id, pending, err := socket.register(question)
+	if err != nil {
+		return nil, err
+	}
+	defer socket.unregister(id, pending)
+
+	message := make([]byte, len(query))
+	copy(message, query)
+	binary.BigEndian.PutUint16(message, id)
+
+	if _, err := socket.conn.Write(message); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(UPSTREAM_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case answer, ok := <-pending.answer:
+		if !ok {
+			return nil, pending.err
+		}
+		copy(answer[0:2], query[0:2])
+		return answer, nil
+	case <-timer.C:
+		return nil, errTimeout
+	}
+}
+
+// Reserve a random ID for a new query
+func (socket *udpSocket) register(question *DNSQuestion) (uint16, *udpPending, error) {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+
+	if socket.err != nil {
+		return 0, nil, socket.err
+	}
+	if len(socket.pending) >= 0x10000 {
+		return 0, nil, errors.New("too many outstanding queries")
+	}
+
+	for {
+		id := randomID()
+		if _, found := socket.pending[id]; !found {
+			pending := &udpPending{question: question, answer: make(chan []byte, 1)}
+			socket.pending[id] = pending
+			return id, pending, nil
+		}
+	}
+}
+
+// Release the ID of a query, unless it's already reused by another one
+func (socket *udpSocket) unregister(id uint16, pending *udpPending) {
+	socket.mu.Lock()
+	if socket.pending[id] == pending {
+		delete(socket.pending, id)
+	}
+	socket.mu.Unlock()
+}
+
+// Return the error which made the socket unusable
+func (socket *udpSocket) error() error {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	return socket.err
+}
+
+// Close the socket and wake up all outstanding queries
+func (socket *udpSocket) close(err error) {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+
+	if socket.err != nil {
+		return
+	}
+	socket.err = err
+	socket.conn.Close()
+	socket.fail(err)
+}
+
+// Make all outstanding queries fail with the error. Lock must be held
+func (socket *udpSocket) fail(err error) {
+	for id, pending := range socket.pending {
+		pending.err = err
+		close(pending.answer)
+		delete(socket.pending, id)
+	}
+}
+
+// Read answers as they come, and give them to the queries waiting for them. As the socket is connected, only
+// datagrams sent from the resolver address are received, but the question is checked too as the ID alone is
+// easy to guess
+func (socket *udpSocket) readAnswers(upstream *UDPUpstream) {
+	buffer := make([]byte, 0xFFFF)
+	for {
+		n, err := socket.conn.Read(buffer)
+		if err != nil {
+			// the resolver port is not reachable (ICMP error): as the query it relates to is unknown, all
+			// outstanding ones fail, but the socket can still be used
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				socket.mu.Lock()
+				socket.fail(err)
+				socket.mu.Unlock()
+				continue
+			}
+			socket.close(err)
+			return
+		}
+		if n < DNS_HEADER_SIZE {
+			continue
+		}
+
+		// answers for unknown or expired queries are just ignored
+		id := binary.BigEndian.Uint16(buffer[0:2])
+		socket.mu.Lock()
+		pending, found := socket.pending[id]
+		socket.mu.Unlock()
+		if !found {
+			continue
+		}
+
+		// the query keeps waiting for the genuine answer
+		if !sameQuestion(pending.question, buffer[:n]) {
+			log.Printf("error: answer from resolver <%s> doesn't match the question of the query, ignored", upstream)
+			continue
+		}
+
+		answer := make([]byte, n)
+		copy(answer, buffer[:n])
+
+		socket.mu.Lock()
+		if socket.pending[id] == pending {
+			pending.answer <- answer
+			delete(socket.pending, id)
+		}
+		socket.mu.Unlock()
+	}
+}
+
+// Read the first question of a message, nil if it has none
+func firstQuestion(message []byte) (*DNSQuestion, error) {
+	if binary.BigEndian.Uint16(message[4:6]) == 0 {
+		return nil, nil
+	}
+
+	domain, offset, err := readDomainName(message, DNS_HEADER_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	if offset+4 > len(message) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return &DNSQuestion{
+		Domain: domain,
+		QType:  binary.BigEndian.Uint16(message[offset : offset+2]),
+		QClass: binary.BigEndian.Uint16(message[offset+2 : offset+4]),
+	}, nil
+}
+
+// Return true if the answer is for the question. Case of the domain is not significant, as some resolvers
+// change it to add entropy (https://datatracker.ietf.org/doc/html/draft-vixie-dnsext-dns0x20-00)
+func sameQuestion(question *DNSQuestion, answer []byte) bool {
+	answerQuestion, err := firstQuestion(answer)
+	if err != nil {
+		return false
+	}
+	if question == nil || answerQuestion == nil {
+		return question == answerQuestion
+	}
+
+	return strings.EqualFold(question.Domain, answerQuestion.Domain) && question.QType == answerQuestion.QType && question.QClass == answerQuestion.QClass
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Start a local UDP DNS server sending back the answers given by the handler for each query, and return its
+// address with the set of source addresses queries came from
+func startUDPSpoofer(t *testing.T, handler func(query []byte) [][]byte) (string, func() int) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var mu sync.Mutex
+	sources := make(map[string]bool)
+
+	go func() {
+		buffer := make([]byte, DEFAULT_BUFFER_SIZE)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			sources[addr.String()] = true
+			mu.Unlock()
+
+			for _, answer := range handler(buffer[:n]) {
+				conn.WriteTo(answer, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sources)
+	}
+}
+
+func TestUDPUpstreamShared(t *testing.T) {
+	assert := assert.New(t)
+
+	// answer with the last byte of the address set to the number in the domain, after a while to have
+	// queries overlap
+	address, sources := startUDPSpoofer(t, func(query []byte) [][]byte {
+		msg := new(DNSMessage)
+		msg.fromNetworkBytes(query)
+		var i int
+		fmt.Sscanf(msg.Questions[0].Domain, "www%d.foo.com", &i)
+		time.Sleep(10 * time.Millisecond)
+		return [][]byte{answerWith(fmt.Sprintf("10.0.0.%d", i))(query)}
+	})
+	upstream := newUDPUpstream(address)
+	defer upstream.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			query := buildQuery(fmt.Sprintf("www%d.foo.com", i), TYPE_A)
+			answer, err := upstream.exchange(query)
+			assert.Nil(err)
+			assert.Equal(firstAddress(answer), fmt.Sprintf("10.0.0.%d", i))
+			assert.Equal(answer[0:2], query[0:2])
+		}(i)
+	}
+	wg.Wait()
+
+	// queries only use the shared sockets
+	assert.True(sources() <= UDP_UPSTREAM_SOCKETS)
+}
+
+func TestUDPUpstreamSpoofed(t *testing.T) {
+	assert := assert.New(t)
+
+	// forged answers are sent first: another question with the right ID, and the right question with another ID
+	address, _ := startUDPSpoofer(t, func(query []byte) [][]byte {
+		otherQuestion := buildQuery("www.evil.com", TYPE_A)
+		copy(otherQuestion[0:2], query[0:2])
+		otherType := make([]byte, len(query))
+		copy(otherType, query)
+		binary.BigEndian.PutUint16(otherType[len(otherType)-4:], TYPE_AAAA)
+		otherID := make([]byte, len(query))
+		copy(otherID, query)
+		binary.BigEndian.PutUint16(otherID, binary.BigEndian.Uint16(query)+1)
+
+		return [][]byte{answerWith("6.6.6.6")(otherQuestion), answerWith("6.6.6.6")(otherType), answerWith("6.6.6.6")(otherID), answerWith("1.2.3.4")(query)}
+	})
+	upstream := newUDPUpstream(address)
+	defer upstream.close()
+
+	answer, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Nil(err)
+	assert.Equal(firstAddress(answer), "1.2.3.4")
+
+	// case of the domain doesn't matter
+	answer, err = upstream.exchange(buildQuery("WwW.FoO.cOm", TYPE_A))
+	assert.Nil(err)
+	assert.Equal(firstAddress(answer), "1.2.3.4")
+}
+
+func TestUDPUpstreamClose(t *testing.T) {
+	assert := assert.New(t)
+
+	// the resolver never answers
+	address, _ := startUDPSpoofer(t, func(query []byte) [][]byte { return nil })
+	upstream := newUDPUpstream(address)
+
+	// outstanding queries fail as soon as the upstream is closed
+	done := make(chan error)
+	go func() {
+		_, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	upstream.close()
+
+	select {
+	case err := <-done:
+		assert.Equal(err, errUpstreamClosed)
+	case <-time.After(time.Second):
+		t.Fatal("query still waiting after close")
+	}
+
+	_, err := upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.Equal(err, errUpstreamClosed)
+}
+
+func TestUDPUpstreamRefused(t *testing.T) {
+	assert := assert.New(t)
+
+	// nothing listens on the port anymore
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(err)
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	upstream := newUDPUpstream(address)
+	defer upstream.close()
+
+	start := time.Now()
+	_, err = upstream.exchange(buildQuery("www.foo.com", TYPE_A))
+	assert.NotNil(err)
+	assert.True(time.Since(start) < UPSTREAM_TIMEOUT)
+}
+
+func TestUDPUpstreamTruncated(t *testing.T) {
+	assert := assert.New(t)
+
+	// the answer is truncated over UDP, and sent whole over TCP on the same port
+	address, _ := startUDPSpoofer(t, func(query []byte) [][]byte {
+		msg := new(DNSMessage)
+		msg.fromNetworkBytes(query)
+		response := newResponse(msg, RCODE_NOERROR)
+		response.Header.Flags |= FLAG_TC
+		return [][]byte{response.toNetworkBytes()}
+	})
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			query, err := readTCPMessage(conn)
+			if err == nil {
+				answer := answerWith("1.2.3.4")(query)
+				message := make([]byte, 2, 2+len(answer))
+				binary.BigEndian.PutUint16(message, uint16(len(answer)))
+				conn.Write(append(message, answer...))
+			}
+			conn.Close()
+		}
+	}()
+
+	conf := newTestConfig(t)
+	conf.resolvers = []Upstream{newUDPUpstream(address)}
+
+	// clients querying over UDP retry over TCP themselves
+	answer, _, err := queryResolver(buildQuery("www.foo.com", TYPE_A), "www.foo.com", conf, nil, true)
+	assert.Nil(err)
+	assert.NotEqual(binary.BigEndian.Uint16(answer[2:4])&FLAG_TC, uint16(0))
+	assert.Equal(firstAddress(answer), "")
+
+	answer, _, err = queryResolver(buildQuery("www.foo.com", TYPE_A), "www.foo.com", conf, nil, false)
+	assert.Nil(err)
+	assert.Equal(binary.BigEndian.Uint16(answer[2:4])&FLAG_TC, uint16(0))
+	assert.Equal(firstAddress(answer), "1.2.3.4")
+}
@@ -0,0 +1,206 @@
+// Loader for zone files, as described in https://datatracker.ietf.org/doc/html/rfc1035#section-5
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// A logical line of a zone file: parentheses allow an entry to span several physical lines
+type zoneLine struct {
+	number int      // line number where the entry starts
+	blank  bool     // true if the line starts with a blank, meaning the owner is the previous one
+	tokens []string // list of items, quotes removed
+}
+
+// Read a zone file and add all its records to the local records
+func (local *LocalRecords) readZoneFile(zoneFile string) error {
+	data, err := ioutil.ReadFile(zoneFile)
+	if err != nil {
+		return err
+	}
+
+	lines, err := splitZoneLines(string(data))
+	if err != nil {
+		return fmt.Errorf("zone file <%s>: %v", zoneFile, err)
+	}
+
+	origin := ""
+	owner := ""
+	ttl := uint32(DEFAULT_LOCAL_TTL)
+
+	for _, line := range lines {
+		tokens := line.tokens
+
+		// directives
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) != 2 {
+				return fmt.Errorf("zone file <%s>, line %d: invalid $ORIGIN", zoneFile, line.number)
+			}
+			origin = absoluteName(tokens[1], origin)
+			continue
+		case "$TTL":
+			if len(tokens) != 2 {
+				return fmt.Errorf("zone file <%s>, line %d: invalid $TTL", zoneFile, line.number)
+			}
+			if ttl, err = parseTTL(tokens[1]); err != nil {
+				return fmt.Errorf("zone file <%s>, line %d: invalid $TTL <%s>", zoneFile, line.number, tokens[1])
+			}
+			continue
+		case "$INCLUDE":
+			return fmt.Errorf("zone file <%s>, line %d: $INCLUDE is not supported", zoneFile, line.number)
+		}
+
+		// owner is omitted when the line starts with a blank
+		if !line.blank {
+			owner = absoluteName(tokens[0], origin)
+			tokens = tokens[1:]
+		} else if owner == "" {
+			return fmt.Errorf("zone file <%s>, line %d: no owner name", zoneFile, line.number)
+		}
+
+		// TTL and class are optional, in any order
+		recordTTL := ttl
+		for len(tokens) > 0 {
+			if strings.ToUpper(tokens[0]) == "IN" {
+				tokens = tokens[1:]
+			} else if value, err := parseTTL(tokens[0]); err == nil {
+				recordTTL = value
+				tokens = tokens[1:]
+			} else {
+				break
+			}
+		}
+		if len(tokens) == 0 {
+			return fmt.Errorf("zone file <%s>, line %d: no type found", zoneFile, line.number)
+		}
+
+		// owner is already absolute, so we just need to add the trailing dot
+		rr, err := newLocalRecord(owner+".", strings.ToUpper(tokens[0]), tokens[1:], recordTTL, origin)
+		if err != nil {
+			return fmt.Errorf("zone file <%s>, line %d: %v", zoneFile, line.number, err)
+		}
+		local.add(rr)
+	}
+
+	return nil
+}
+
+// Split the zone file content into logical lines, removing comments and handling parentheses and quotes
+func splitZoneLines(data string) ([]zoneLine, error) {
+	lines := make([]zoneLine, 0)
+
+	current := zoneLine{number: 1}
+	number := 1
+	depth := 0
+	var token strings.Builder
+	inToken, inQuote := false, false
+
+	// end the current token if any
+	endToken := func() {
+		if inToken {
+			current.tokens = append(current.tokens, token.String())
+			token.Reset()
+			inToken = false
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+
+		switch {
+		case inQuote && c == '\\' && i+1 < len(data):
+			i++
+			token.WriteByte(data[i])
+		case inQuote && c == '"':
+			inQuote = false
+		case inQuote:
+			if c == '\n' {
+				return nil, fmt.Errorf("line %d: unterminated quoted string", number)
+			}
+			token.WriteByte(c)
+		case c == '"':
+			inQuote, inToken = true, true
+		case c == ';':
+			// skip the comment up to the end of line
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case c == '(':
+			endToken()
+			depth++
+		case c == ')':
+			endToken()
+			if depth--; depth < 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parentheses", number)
+			}
+		case c == '\n':
+			endToken()
+			number++
+			if depth == 0 {
+				if len(current.tokens) > 0 {
+					lines = append(lines, current)
+				}
+				current = zoneLine{number: number}
+			}
+		case c == ' ' || c == '\t' || c == '\r':
+			endToken()
+			if len(current.tokens) == 0 && depth == 0 && (i == 0 || data[i-1] == '\n') {
+				current.blank = true
+			}
+		default:
+			token.WriteByte(c)
+			inToken = true
+		}
+	}
+
+	if inQuote {
+		return nil, fmt.Errorf("line %d: unterminated quoted string", number)
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parentheses", number)
+	}
+	endToken()
+	if len(current.tokens) > 0 {
+		lines = append(lines, current)
+	}
+
+	return lines, nil
+}
+
+// Convert a TTL to seconds. Units used by BIND are accepted (e.g.: 1h30m)
+func parseTTL(text string) (uint32, error) {
+	if text == "" || text[0] < '0' || text[0] > '9' {
+		return 0, fmt.Errorf("invalid TTL <%s>", text)
+	}
+
+	// only digits
+	if value, err := strconv.ParseUint(text, 10, 32); err == nil {
+		return uint32(value), nil
+	}
+
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	total, value := uint64(0), uint64(0)
+	for _, c := range []byte(strings.ToLower(text)) {
+		if c >= '0' && c <= '9' {
+			value = value*10 + uint64(c-'0')
+			continue
+		}
+		unit, ok := units[c]
+		if !ok {
+			return 0, fmt.Errorf("invalid TTL <%s>", text)
+		}
+		total += value * unit
+		value = 0
+	}
+
+	// trailing digits are seconds
+	total += value
+	if total > 0xFFFFFFFF {
+		return 0, fmt.Errorf("TTL <%s> is too large", text)
+	}
+	return uint32(total), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	for text, expected := range map[string]uint32{"3600": 3600, "1h": 3600, "1h30m": 5400, "1w2d": 777600, "1D": 86400, "2h5": 7205} {
+		ttl, err := parseTTL(text)
+		assert.Nil(err)
+		assert.Equal(ttl, expected, text)
+	}
+
+	for _, text := range []string{"", "IN", "A", "1x", "99999999999"} {
+		_, err := parseTTL(text)
+		assert.NotNil(err, text)
+	}
+}
+
+func TestSplitZoneLines(t *testing.T) {
+	assert := assert.New(t)
+
+	lines, err := splitZoneLines("@ IN SOA ns admin ( 1 ; serial\n 2 3 4 5 )\n  IN TXT \"a b\" c ; comment\n\nfoo A 1.2.3.4")
+	assert.Nil(err)
+	assert.Equal(len(lines), 3)
+
+	assert.Equal(lines[0].number, 1)
+	assert.False(lines[0].blank)
+	assert.Equal(lines[0].tokens, []string{"@", "IN", "SOA", "ns", "admin", "1", "2", "3", "4", "5"})
+
+	assert.Equal(lines[1].number, 3)
+	assert.True(lines[1].blank)
+	assert.Equal(lines[1].tokens, []string{"IN", "TXT", "a b", "c"})
+
+	assert.Equal(lines[2].number, 5)
+	assert.Equal(lines[2].tokens, []string{"foo", "A", "1.2.3.4"})
+
+	_, err = splitZoneLines("foo TXT \"abc")
+	assert.NotNil(err)
+	_, err = splitZoneLines("foo SOA ( a b")
+	assert.NotNil(err)
+}
+
+func TestReadZoneFile(t *testing.T) {
+	assert := assert.New(t)
+
+	var local LocalRecords
+	local.init()
+	err := local.readZoneFile("./tests/home.zone")
+	assert.Nil(err)
+
+	_, found := local.zones["home"]
+	assert.True(found)
+
+	nas := local.records["nas.home"]
+	assert.Equal(len(nas), 2)
+	assert.Equal(nas[0].TTL, uint32(300))
+	assert.Equal(nas[0].ip().String(), "192.168.1.10")
+	assert.Equal(nas[1].TTL, uint32(3600))
+	assert.Equal(nas[1].ip().String(), "fd00::10")
+
+	assert.Equal(local.records["files.home"][0].target(), "nas.home")
+	assert.Equal(local.records["home"][1].target(), "ns.home")
+	assert.Equal(local.records["home"][2].RData, append([]byte{0, 10}, encodeDomainName("mail.home")...))
+	assert.Equal(local.records["_ipp._tcp.home"][0].RData, append([]byte{0, 0, 0, 5, 0x02, 0x77}, encodeDomainName("printer.lan")...))
+	assert.Equal(local.records["info.home"][0].RData, append([]byte{12}, []byte("home network\x12managed by dnswall")...))
+
+	err = local.readZoneFile("./tests/foo.zone")
+	assert.NotNil(err)
+}